@@ -2,26 +2,40 @@ package mono
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
 )
 
+const simpleAuthCookie = "mono_auth"
+
 type SimpleAuth struct {
 	Filename       string
 	Prefixes       []string
 	OnUnauthorized HandlerFunc
+	// Server decides the Secure flag of the login cookie via Server.IsTLS, RequestScheme is used if it's nil.
+	Server Server
 
 	users       map[string]string
-	logins      map[string]string
+	logins      map[string]map[string]struct{} // Session tokens by username, one per login, so devices don't log each other out.
 	usersMutex  sync.RWMutex
 	loginsMutex sync.RWMutex
 }
 
+// AddUser registers a user for HandleLogin, only the hash of the password is kept.
+func (auth *SimpleAuth) AddUser(username string, password string) {
+	auth.usersMutex.Lock()
+	defer auth.usersMutex.Unlock()
+	if auth.users == nil {
+		auth.users = make(map[string]string)
+	}
+	auth.users[username] = auth.hashed(strings.TrimSpace(password))
+}
+
 func (auth *SimpleAuth) Middleware() MiddlewareFunc {
 	return func(handler HandlerFunc) HandlerFunc {
 		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
@@ -41,7 +55,6 @@ func (auth *SimpleAuth) HandleLogin() HandlerFunc {
 		}
 		var parsed Request
 		if err := json.NewDecoder(req.Body).Decode(&parsed); err != nil {
-			auth.usersMutex.Unlock()
 			return err
 		}
 		parsed.Password = auth.hashed(strings.TrimSpace(parsed.Password))
@@ -54,6 +67,28 @@ func (auth *SimpleAuth) HandleLogin() HandlerFunc {
 			return nil
 		}
 
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+		auth.loginsMutex.Lock()
+		if auth.logins == nil {
+			auth.logins = make(map[string]map[string]struct{})
+		}
+		if auth.logins[parsed.Username] == nil {
+			auth.logins[parsed.Username] = make(map[string]struct{})
+		}
+		auth.logins[parsed.Username][hex.EncodeToString(token)] = struct{}{}
+		auth.loginsMutex.Unlock()
+
+		http.SetCookie(rw, &http.Cookie{
+			Name:     simpleAuthCookie,
+			Value:    parsed.Username + ":" + hex.EncodeToString(token),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   auth.secure(req),
+			SameSite: http.SameSiteLaxMode,
+		})
 		return nil
 	}
 }
@@ -79,20 +114,13 @@ func (auth *SimpleAuth) hashed(password string) string {
 }
 
 func (auth *SimpleAuth) isAuthed(req *http.Request) bool {
-	for _, cookie := range req.CookiesNamed("mono_auth") {
-		data, _ := json.Marshal(cookie)
-		slog.Info("auth#cookie", "val", string(data))
-		type Data struct {
-			Username  string `json:"username"`
-			AuthToken string `json:"auth_token"`
-		}
-		var parsed Data
-		if err := json.Unmarshal(data, &parsed); err != nil {
-			slog.Warn("auth#parse_cookie_err", "val", string(data), "err", err)
-			return false
+	for _, cookie := range req.CookiesNamed(simpleAuthCookie) {
+		username, token, ok := strings.Cut(cookie.Value, ":")
+		if !ok {
+			continue
 		}
 		auth.loginsMutex.RLock()
-		_, ok := auth.logins[parsed.Username]
+		_, ok = auth.logins[username][token]
 		auth.loginsMutex.RUnlock()
 		if ok {
 			return true
@@ -101,6 +129,13 @@ func (auth *SimpleAuth) isAuthed(req *http.Request) bool {
 	return false
 }
 
+func (auth *SimpleAuth) secure(req *http.Request) bool {
+	if auth.Server != nil {
+		return auth.Server.IsTLS()
+	}
+	return RequestScheme(req) == "https"
+}
+
 func Auth(prefix string, authed func(req *http.Request) bool, unauthorized ...HandlerFunc) MiddlewareFunc {
 	unauthorizedFn := def(unauthorized, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
 		http.Error(rw, "403 unauthorized", http.StatusUnauthorized)
@@ -0,0 +1,119 @@
+package mono_test
+
+import (
+	"context"
+	"github.com/kittenbark/mono"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimpleAuth(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	auth := &mono.SimpleAuth{
+		Prefixes: []string{"/private"},
+		OnUnauthorized: func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			return mono.NewStatusError(http.StatusUnauthorized, "")
+		},
+	}
+	auth.AddUser("kitten", "meow")
+	server.
+		Middleware(auth.Middleware()).
+		Handler("POST /login", auth.HandleLogin()).
+		Handler("GET /private/data", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := rw.Write([]byte("secret"))
+			return err
+		})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	login := func(body string) *http.Response {
+		resp, err := http.Post(cl.url+"/login", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+	data := func(cookie *http.Cookie) int {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, cl.url+"/private/data", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := data(nil); status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a login, got %d", status)
+	}
+	if resp := login(`{"username":"kitten","password":"woof"}`); resp.StatusCode != http.StatusNotFound || len(resp.Cookies()) != 0 {
+		t.Errorf("expected a wrong password to be rejected, got %d %v", resp.StatusCode, resp.Cookies())
+	}
+
+	sessions := []*http.Cookie{}
+	for range 2 { // E.g. a laptop and a phone.
+		resp := login(`{"username":"kitten","password":"meow"}`)
+		cookies := resp.Cookies()
+		if resp.StatusCode != http.StatusOK || len(cookies) != 1 || cookies[0].Name != "mono_auth" || !cookies[0].HttpOnly {
+			t.Fatalf("expected the login cookie, got %d %v", resp.StatusCode, cookies)
+		}
+		sessions = append(sessions, cookies[0])
+	}
+	for i, cookie := range sessions {
+		if status := data(cookie); status != http.StatusOK {
+			t.Errorf("expected the session %d to stay authorized, got %d", i, status)
+		}
+	}
+
+	username, token, _ := strings.Cut(sessions[0].Value, ":")
+	flipped := "0"
+	if strings.HasSuffix(token, "0") {
+		flipped = "1"
+	}
+	for _, value := range []string{
+		username + ":" + token[:len(token)-1] + flipped,
+		"someone:" + token,
+		token,
+	} {
+		if status := data(&http.Cookie{Name: "mono_auth", Value: value}); status != http.StatusUnauthorized {
+			t.Errorf("expected a tampered cookie %q to be rejected, got %d", value, status)
+		}
+	}
+}
+
+func TestSimpleAuth_SecureCookie(t *testing.T) {
+	enableTLS := mono.EnableTLS
+	defer func() { mono.EnableTLS = enableTLS }()
+	mono.EnableTLS = mono.EnableTLSTrue
+
+	for _, test := range []struct {
+		server mono.Server
+		secure bool
+	}{
+		{mono.New().TLS(mono.SelfSignedTLS("localhost")), true},
+		{mono.New(), false},
+	} {
+		auth := &mono.SimpleAuth{Server: test.server}
+		auth.AddUser("kitten", "meow")
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"kitten","password":"meow"}`))
+		if err := auth.HandleLogin()(t.Context(), rw, req); err != nil {
+			t.Fatal(err)
+		}
+		cookies := rw.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Secure != test.secure {
+			t.Errorf("expected Secure=%v to follow IsTLS=%v, got %v", test.secure, test.server.IsTLS(), cookies)
+		}
+	}
+}
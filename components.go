@@ -2,11 +2,48 @@ package mono
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
+	"maps"
+	"net/http"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
 )
 
+// SchemaData is the conventional template data, the same shape is used by dynamic pages by default.
+// Both build-time (*Context) and request-time (context.Context, *http.Request) values are optional,
+// {{.Value "key"}} reads a value from the request context first and from the build Context.Env second.
+type SchemaData struct {
+	Context context.Context
+	Request *http.Request
+	Build   *Context
+	Data    any
+}
+
+func NewSchemaData(ctx context.Context, build *Context, req *http.Request, data any) SchemaData {
+	return SchemaData{
+		Context: ctx,
+		Request: req,
+		Build:   build,
+		Data:    data,
+	}
+}
+
+func (data SchemaData) Value(key any) any {
+	if data.Context != nil {
+		if value := data.Context.Value(key); value != nil {
+			return value
+		}
+	}
+	if data.Build != nil {
+		return data.Build.Value(key)
+	}
+	return nil
+}
+
 func ExecuteSchema(templ *template.Template, data any) (template.HTML, error) {
 	buff := bytes.Buffer{}
 	if err := templ.Execute(&buff, data); err != nil {
@@ -21,13 +58,41 @@ func Schema(schema string, name string, funcs template.FuncMap, delims ...string
 	if len(delims) == 2 {
 		result.Delims(delims[0], delims[1])
 	}
-	return result.Parse(schema)
+	parsed, err := result.Parse(schema)
+	if err != nil {
+		return nil, schemaParseError(err, name, funcs)
+	}
+	return parsed, nil
+}
+
+var (
+	schemaUndefinedFunc = regexp.MustCompile(`function "([^"]+)" not defined`)
+	// schemaBuiltinFuncs are the funcs every template has, see text/template.
+	schemaBuiltinFuncs = []string{
+		"and", "call", "html", "index", "slice", "js", "len", "not", "or", "print", "printf", "println", "urlquery",
+		"eq", "ge", "gt", "le", "lt", "ne",
+	}
+)
+
+// schemaParseError names the source file and, for an unknown function, lists the available ones (built-ins included).
+func schemaParseError(err error, name string, funcs template.FuncMap) error {
+	match := schemaUndefinedFunc.FindStringSubmatch(err.Error())
+	if match == nil {
+		return fmt.Errorf("mono.Schema failed to parse %s: %w", name, err)
+	}
+	available := slices.Concat(slices.Collect(maps.Keys(funcs)), schemaBuiltinFuncs)
+	slices.Sort(available)
+	available = slices.Compact(available)
+	return fmt.Errorf(
+		"mono.Schema failed to parse %s: unknown function %q (available: %s): %w",
+		name, match[1], strings.Join(available, ", "), err,
+	)
 }
 
 func SchemaApply(schema string, name string, funcs template.FuncMap, data any, delims ...string) (template.HTML, error) {
 	templ, err := Schema(schema, name, funcs, delims...)
 	if err != nil {
-		return "", fmt.Errorf("mono.Schema failed to parse schema: %w", err)
+		return "", err
 	}
 	return ExecuteSchema(templ, data)
 }
@@ -0,0 +1,58 @@
+package mono_test
+
+import (
+	"context"
+	"github.com/kittenbark/mono"
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSchemaData(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.WithValue(t.Context(), "user", "kitten")
+	req := httptest.NewRequest("GET", "/profile", nil)
+	build := &mono.Context{Url: "/profile", Env: map[string]string{"site": "mono"}}
+
+	result, err := mono.SchemaApply(
+		`{{.Value "user"}}@{{.Value "site"}}{{.Request.URL.Path}}`,
+		"schema_data",
+		nil,
+		mono.NewSchemaData(ctx, build, req, nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "kitten@mono/profile" {
+		t.Fatalf(`expected "kitten@mono/profile", got "%s"`, result)
+	}
+
+	result, err = mono.SchemaApply(`{{.Value "site"}}`, "schema_data_build", nil, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "mono" {
+		t.Fatalf(`expected "mono", got "%s"`, result)
+	}
+}
+
+func TestSchemaUndefinedFunc(t *testing.T) {
+	t.Parallel()
+
+	_, err := mono.SchemaApply(
+		`<p>{{undefined_func}}</p>`,
+		"pages/index.gohtml",
+		template.FuncMap{"known_b": func() string { return "" }, "known_a": func() string { return "" }},
+		nil,
+	)
+	if err == nil {
+		t.Fatal("expected a parse error")
+	}
+	for _, expected := range []string{"pages/index.gohtml", `unknown function "undefined_func"`, "available: and, call, eq", "js, known_a, known_b, le, len", "printf"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf(`expected error to contain "%s", got "%v"`, expected, err)
+		}
+	}
+}
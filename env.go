@@ -2,11 +2,17 @@ package mono
 
 import (
 	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 )
@@ -15,6 +21,7 @@ var (
 	EnvMonoEnv        = "MONO_ENV"
 	EnvMonoRps        = "MONO_RPS"
 	EnvMonoRpsClients = "MONO_RPS_CLIENTS"
+	EnvMonoTLS        = "MONO_TLS" // "true"/"false" overrides the environment based default, see EnableTLS.
 
 	CurrentEnv                Environment
 	InMemoryFilesizeThreshold int64 = 1 << 20
@@ -22,12 +29,31 @@ var (
 	TempDirClean                    = true
 	EnableTLS                       = EnableTLSUnspecified
 	Log                             = slog.Default()
+	TrustedProxies                  = []string{} // CIDRs or IPs, whose X-Forwarded-* headers are trusted.
+	Strict                          = false      // Turns build warnings (e.g. suspiciously empty Tailwind css) into build errors.
+	StreamChunkSize                 = 32 << 10   // How much of a BuiltPage.Stream page is written between flushes.
+	MaxPatternLength                = 1 << 10    // Longer patterns of Page/Handler are build errors.
+	EnableBrotli                    = true       // Precompress static pages with brotli too (preferred over gzip), false saves memory.
 
 	Filetypes = map[string][]string{
 		"img":   {".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tiff", ".heic"},
 		"video": {".mp4", ".mov", ".webm", ".heiv"},
 		"audio": {".mp3", ".wav", ".flac", ".ogg", ".aac"},
 	}
+	// CompressibleTypes are content type prefixes of static pages worth precompressing, already compressed
+	// formats (png, jpeg, video, zip, etc.) are not.
+	CompressibleTypes = []string{
+		"text/",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/xhtml+xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"application/manifest+json",
+		"application/wasm",
+		"image/svg+xml",
+	}
 	FiletypesTags = map[string]string{
 		"img":   `<img src="%s" alt="%s">`,
 		"video": `<video src="%s" alt="%s" preload="metadata" loop autoplay muted controls>Does you browser support videos?</video>`,
@@ -41,10 +67,14 @@ var (
 			fmt.Println(values...)
 			return ""
 		},
+		"mono_theme":  ThemeFromRequest,
+		"mono_locale": LocaleFromRequest,
+		"markdown":    Markdown,
 	}
 )
 
 func init() {
+	defer func() { defaultsReset = snapshotDefaults() }()
 	if CurrentEnv == envUnspecified {
 		switch strings.ToLower(os.Getenv(EnvMonoEnv)) {
 		case "":
@@ -65,6 +95,87 @@ func init() {
 	}
 }
 
+var defaultsReset []func()
+
+// ResetDefaults restores package globals (CurrentEnv, Log, Filetypes, MarkdownTags, TLSOptions, etc.) to their
+// values at startup, so tests mutating them don't leak into each other: defer mono.ResetDefaults().
+func ResetDefaults() {
+	for _, reset := range defaultsReset {
+		reset()
+	}
+	MarkdownTags = defaultMarkdownTags() // Tags are configurable in place, so they're built anew.
+}
+
+func snapshotDefaults() []func() {
+	markdownClasses := map[string]MarkdownClassSet{}
+	for name, classes := range MarkdownClasses {
+		markdownClasses[name] = maps.Clone(classes)
+	}
+	filetypes := map[string][]string{}
+	for name, exts := range Filetypes {
+		filetypes[name] = slices.Clone(exts)
+	}
+
+	return []func(){
+		resetTo(&CurrentEnv),
+		resetTo(&InMemoryFilesizeThreshold),
+		resetTo(&TempDir),
+		resetTo(&TempDirClean),
+		resetTo(&EnableTLS),
+		resetTo(&Log),
+		resetTo(&Strict),
+		resetTo(&TLSOptions),
+		resetTo(&CookieTheme),
+		resetTo(&CookieLocale),
+		resetTo(&MarkdownLinkRewrite),
+		resetTo(&MarkdownSlugify),
+		resetTo(&MarkdownCodeHighlighter),
+		resetTo(&DefaultTailwindThemeButton),
+		resetTo(&DefaultTailwindStylesheet),
+		resetTo(&DefaultTailwindConfigJs),
+		resetTo(&DefaultRpsClientsHandler),
+		resetTo(&DefaultRpsGlobalHandler),
+		resetSlice(&TrustedProxies),
+		resetSlice(&CompressibleTypes),
+		resetSlice(&StealthHeaders),
+		resetTo(&StreamChunkSize),
+		resetTo(&MaxPatternLength),
+		resetTo(&EnableBrotli),
+		resetSlice(&MarkdownTagParagraph),
+		resetSlice(&ConfigNextjsSpecialFiles),
+		resetMap(&FiletypesTags),
+		resetMap(&DefaultPageDynamicFuncs),
+		resetMap(&SecurityHeaders),
+		func() {
+			Filetypes = map[string][]string{}
+			for name, exts := range filetypes {
+				Filetypes[name] = slices.Clone(exts)
+			}
+		},
+		func() {
+			MarkdownClasses = map[string]MarkdownClassSet{}
+			for name, classes := range markdownClasses {
+				MarkdownClasses[name] = maps.Clone(classes)
+			}
+		},
+	}
+}
+
+func resetTo[T any](ptr *T) func() {
+	value := *ptr
+	return func() { *ptr = value }
+}
+
+func resetSlice[S ~[]E, E any](ptr *S) func() {
+	value := slices.Clone(*ptr)
+	return func() { *ptr = slices.Clone(value) }
+}
+
+func resetMap[M ~map[K]V, K comparable, V any](ptr *M) func() {
+	value := maps.Clone(*ptr)
+	return func() { *ptr = maps.Clone(value) }
+}
+
 type Environment int64
 
 const (
@@ -85,22 +196,129 @@ func IsProd() bool  { return CurrentEnv == EnvProd }
 
 var statusMessageCache = [600][]byte{}
 
-func responseError(rw http.ResponseWriter, status int) error {
-	if len(statusMessageCache[status]) == 0 {
-		statusMessageCache[status] = []byte(fmt.Sprintf("%d %s", status, http.StatusText(status)))
+// responseError writes status negotiated on Accept: {"error":"...","status":N} for JSON clients, the Server.StatusPage
+// for browsers if it's registered (ctx is a handler's one, see serverContextKey), "404 Not Found"-like text otherwise.
+// An empty message is http.StatusText(status).
+func responseError(ctx context.Context, rw http.ResponseWriter, req *http.Request, status int, message string) error {
+	h := rw.Header()
+	h.Del("Content-Length")
+	switch accepted := responseErrorType(req); {
+	case accepted == "json":
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		rw.WriteHeader(status)
+		return json.NewEncoder(rw).Encode(struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}{Error: cmp.Or(message, http.StatusText(status)), Status: status})
+	case accepted == "html":
+		if server, ok := ctx.Value(serverContextKey{}).(*serverDev); ok {
+			if page, ok := server.statusPages[status]; ok {
+				h.Set("Content-Type", page.ContentType)
+				setHeaders(h, page.Headers)
+				rw.WriteHeader(status)
+				_, err := rw.Write(page.Data)
+				return err
+			}
+		}
 	}
 
+	h.Set("Content-Type", "text/plain; charset=utf-8")
 	rw.WriteHeader(status)
-	if _, err := rw.Write(statusMessageCache[status]); err != nil {
+	if message != "" {
+		_, err := fmt.Fprintf(rw, "%d %s", status, message)
 		return err
 	}
-	return nil
+	if len(statusMessageCache[status]) == 0 {
+		statusMessageCache[status] = []byte(fmt.Sprintf("%d %s", status, http.StatusText(status)))
+	}
+	_, err := rw.Write(statusMessageCache[status])
+	return err
+}
+
+// responseErrorType is "json", "html" or "text", whichever of them Accept prefers.
+func responseErrorType(req *http.Request) string {
+	for _, accepted := range acceptValues(req.Header.Get("Accept")) {
+		switch accepted = strings.ToLower(accepted); {
+		case accepted == "application/json" || strings.HasSuffix(accepted, "+json"):
+			return "json"
+		case accepted == "text/html" || accepted == "application/xhtml+xml":
+			return "html"
+		case accepted == "text/plain" || accepted == "text/*" || accepted == "*/*":
+			return "text"
+		}
+	}
+	return "text"
+}
+
+// StatusError is an error carrying the http status (and the body message) to respond with.
+// Return it from a HandlerFunc to respond with something other than 500, e.g. NewStatusError(404, "no such user").
+// Only 4xx and 5xx statuses are errors, any other one is responded to as 500.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+var _ error = StatusError{}
+
+func NewStatusError(status int, message string) error {
+	if !isErrorStatus(status) {
+		status = http.StatusInternalServerError
+	}
+	return StatusError{Status: status, Message: message}
+}
+
+func isErrorStatus(status int) bool {
+	return status >= http.StatusBadRequest && status < len(statusMessageCache)
 }
 
+func (err StatusError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("%d %s", err.Status, http.StatusText(err.Status))
+	}
+	return fmt.Sprintf("%d %s", err.Status, err.Message)
+}
+
+// responseFromError responds according to err: StatusError sets the status and message, anything else is a 500.
+// Panics are logged with their stack, and shown in the response body unless IsProd().
+func responseFromError(ctx context.Context, rw http.ResponseWriter, req *http.Request, err error) {
+	var panicErr PanicError
+	if errors.As(err, &panicErr) {
+		Log.Error("handle error", "err", err.Error(), "stack", string(panicErr.Stack))
+		message := ""
+		if !IsProd() {
+			message = fmt.Sprintf("%s\n\n%s\n\n%s", http.StatusText(http.StatusInternalServerError), err.Error(), panicErr.Stack)
+		}
+		_ = responseError(ctx, rw, req, http.StatusInternalServerError, message)
+		return
+	}
+
+	var statusErr StatusError
+	if !errors.As(err, &statusErr) || !isErrorStatus(statusErr.Status) {
+		Log.Error("handle error", "err", err.Error())
+		_ = responseError(ctx, rw, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	if statusErr.Status >= http.StatusInternalServerError {
+		Log.Error("handle error", "err", err.Error())
+	} else {
+		Log.Debug("handle error", "err", err.Error())
+	}
+	_ = responseError(ctx, rw, req, statusErr.Status, statusErr.Message)
+}
+
+// enableTLS is EnableTLS if set, then MONO_TLS, and only then the environment (so TLS can be tested locally,
+// regardless of docker detection).
 func enableTLS() bool {
 	if EnableTLS != EnableTLSUnspecified {
 		return EnableTLS == EnableTLSTrue
 	}
+	switch strings.ToLower(os.Getenv(EnvMonoTLS)) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
 	return !IsLocal()
 }
 
@@ -0,0 +1,42 @@
+package mono_test
+
+import (
+	"github.com/kittenbark/mono"
+	"slices"
+	"testing"
+)
+
+func TestResetDefaults(t *testing.T) {
+	env := mono.CurrentEnv
+	images := slices.Clone(mono.Filetypes["img"])
+	paragraph := mono.MarkdownClasses["default"]["p"]
+	tags := len(mono.MarkdownTags)
+	defer mono.ResetDefaults()
+
+	mono.Filetypes["img"] = append(mono.Filetypes["img"], ".webp")
+	mono.Filetypes["doc"] = []string{".pdf"}
+	mono.CurrentEnv = mono.EnvProd + 1
+	mono.MarkdownClasses["default"]["p"] = "mutated"
+	mono.MarkdownTags = mono.MarkdownTags[:1]
+	mono.ResetDefaults()
+
+	if _, ok := mono.Filetypes["doc"]; ok || !slices.Equal(mono.Filetypes["img"], images) {
+		t.Errorf("expected default Filetypes, got %v", mono.Filetypes)
+	}
+	if mono.CurrentEnv != env {
+		t.Errorf("expected CurrentEnv %d, got %d", env, mono.CurrentEnv)
+	}
+	if mono.MarkdownClasses["default"]["p"] != paragraph {
+		t.Errorf(`expected the default paragraph class, got "%s"`, mono.MarkdownClasses["default"]["p"])
+	}
+	if len(mono.MarkdownTags) != tags {
+		t.Errorf("expected %d markdown tags, got %d", tags, len(mono.MarkdownTags))
+	}
+
+	// The snapshot itself must not be aliased by the restored globals.
+	mono.Filetypes["img"][0] = ".mutated"
+	mono.ResetDefaults()
+	if !slices.Equal(mono.Filetypes["img"], images) {
+		t.Errorf("expected default Filetypes after a second reset, got %v", mono.Filetypes["img"])
+	}
+}
@@ -120,19 +120,27 @@ func (extension *extensionFile) SideEffects(result *BuiltPage) error {
 		if stat.IsDir() {
 			return fmt.Errorf("%s is a directory, not a file", filename)
 		}
+
+		url, _ := extension.url(filename)
 		if stat.Size() > InMemoryFilesizeThreshold {
-			Log.Warn("file size too large (unsupported for now)")
+			// Large files (e.g. videos) are streamed from disk, with Range support.
+			err = result.SetSubpattern(url, &BuiltPage{
+				ContentType: extension.getContentType(filename, nil),
+				Filename:    filename,
+			})
+		} else {
+			var data []byte
+			if data, err = os.ReadFile(filename); err != nil {
+				return err
+			}
+			err = result.SetSubpattern(url, &BuiltPage{
+				ContentType: extension.getContentType(filename, data),
+				Data:        data,
+			})
 		}
-
-		data, err := os.ReadFile(filename)
 		if err != nil {
 			return err
 		}
-		url, _ := extension.url(filename)
-		result.Subpattern[url] = &BuiltPage{
-			ContentType: extension.getContentType(filename, data),
-			Data:        data,
-		}
 		extension.urls[filename] = url
 	}
 	extension.files = []string{}
@@ -157,6 +165,9 @@ func (extension *extensionFile) getContentType(filename string, data []byte) str
 	if mime, ok := extension.mimeHints[filename]; ok {
 		return mime
 	}
+	if data == nil {
+		return contentTypeByName(filename) // Streamed files, "" is sniffed by http.ServeContent.
+	}
 	return http.DetectContentType(data)
 }
 
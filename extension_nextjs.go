@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -50,8 +51,7 @@ var ConfigNextjsSpecialFiles = []nextjsContextSpecialFile{
 			if err != nil {
 				return err
 			}
-			ctx.Page("/favicon.ico", []byte(data))
-			return nil
+			return ctx.Page("/favicon.ico", []byte(data))
 		},
 	},
 	{
@@ -66,8 +66,7 @@ var ConfigNextjsSpecialFiles = []nextjsContextSpecialFile{
 			if err != nil {
 				return err
 			}
-			ctx.Page(ctx.Url, []byte(page))
-			return nil
+			return ctx.Page(ctx.Url, []byte(page))
 		},
 	},
 	{
@@ -77,17 +76,18 @@ var ConfigNextjsSpecialFiles = []nextjsContextSpecialFile{
 			if err != nil {
 				return err
 			}
-			pageMain, err := Markdown(string(data))
+			meta, body := MarkdownFrontMatter(string(data))
+			pageMain, err := MarkdownWith(body, MarkdownOptions{Source: filepath.ToSlash(filepath.Join(ctx.Url, "index.md"))})
 			if err != nil {
 				return err
 			}
 			ctx.Funcs["children"] = func() template.HTML { return template.HTML(pageMain) }
+			ctx.Funcs["frontmatter"] = func(key string) string { return meta[key] }
 			page, err := SchemaApply(ctx.layoutSchema, path, ctx.Funcs, ctx.Context)
 			if err != nil {
 				return err
 			}
-			ctx.Page(ctx.Url, []byte(page))
-			return nil
+			return ctx.Page(ctx.Url, []byte(page))
 		},
 	},
 	{
@@ -102,8 +102,7 @@ var ConfigNextjsSpecialFiles = []nextjsContextSpecialFile{
 			if err != nil {
 				return err
 			}
-			ctx.Page(ctx.Url, []byte(page))
-			return nil
+			return ctx.Page(ctx.Url, []byte(page))
 		},
 	},
 }
@@ -141,7 +140,7 @@ func newNextjsContext(root string) (*nextjsContext, error) {
 	ctx := &nextjsContext{
 		Context: &Context{
 			Env:   make(map[string]string),
-			Funcs: make(template.FuncMap),
+			Funcs: template.FuncMap{"markdown": Markdown},
 		},
 		root: root,
 		dir:  os.DirFS(root),
@@ -171,7 +170,7 @@ type nextjsContext struct {
 	err          error
 }
 
-func (ctx *nextjsContext) Page(name string, data []byte, contentType ...string) {
+func (ctx *nextjsContext) Page(name string, data []byte, contentType ...string) error {
 	var ct string
 	if len(contentType) > 0 {
 		ct = contentType[0]
@@ -181,10 +180,10 @@ func (ctx *nextjsContext) Page(name string, data []byte, contentType ...string)
 
 	ctx.resultLock.Lock()
 	defer ctx.resultLock.Unlock()
-	ctx.result.Subpattern[name] = &BuiltPage{
+	return ctx.result.SetSubpattern(name, &BuiltPage{
 		Data:        data,
 		ContentType: ct,
-	}
+	})
 }
 
 func (ctx *nextjsContext) Clone() *nextjsContext {
@@ -208,9 +207,39 @@ func (ctx *nextjsContext) Updated(path string) *nextjsContext {
 	ctx.Funcs["set_env"] = ctx.funcSetEnv()
 	ctx.Funcs["rel"] = func(filename string) string { return filepath.Join(ctx.root, path, filename) }
 	ctx.Funcs["env"] = func(name string) template.HTML { return template.HTML(ctx.Env[name]) }
+	ctx.Funcs["frontmatter"] = func(key string) string { return "" } // Set by index.md pages.
+	ctx.Funcs["env_or"] = func(name string, fallback string) template.HTML {
+		if value, ok := ctx.Env[name]; ok {
+			return template.HTML(value)
+		}
+		return template.HTML(fallback)
+	}
+	ctx.Funcs["env_bool"] = func(name string, fallback ...bool) (bool, error) {
+		return envParse(ctx.Env, name, fallback, strconv.ParseBool)
+	}
+	ctx.Funcs["env_int"] = func(name string, fallback ...int) (int, error) {
+		return envParse(ctx.Env, name, fallback, strconv.Atoi)
+	}
 	return ctx
 }
 
+// envParse is the typed value of env[name], or the fallback (or zero) if unset. Under Strict, unset names
+// without a fallback fail the build, as a required setting is likely missing from mono.env.
+func envParse[T any](env map[string]string, name string, fallback []T, parse func(string) (T, error)) (T, error) {
+	value, ok := env[name]
+	if !ok {
+		if len(fallback) == 0 && Strict {
+			return *new(T), fmt.Errorf("env: %s is not set", name)
+		}
+		return def(fallback, *new(T)), nil
+	}
+	result, err := parse(value)
+	if err != nil {
+		return result, fmt.Errorf("env: %s=%q: %w", name, value, err)
+	}
+	return result, nil
+}
+
 func (ctx *nextjsContext) Error() error { return ctx.err }
 
 func walkDirFuncParallel(fsys fs.FS, root string, fn fs.WalkDirFunc) error {
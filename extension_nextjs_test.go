@@ -89,7 +89,7 @@ func TestConsistency(t *testing.T) {
 
 	check(
 		"/nextjs/sub",
-		"<html lang=\"en\">\n<head><title>Test</title></head>\n<body>\ncomponent_value\nenv=\"default_value\"\n/sub\n<div>\n<h1 class=\"scroll-m-20 text-center text-4xl font-extrabold tracking-tight text-balance mt-6 first:mt-0\">sub</h1>\n\n</div>\n</body>\n</html>",
+		"<html lang=\"en\">\n<head><title>Test</title></head>\n<body>\ncomponent_value\nenv=\"default_value\"\n/sub\n<div>\n<h1 id=\"sub\" class=\"scroll-m-20 text-center text-4xl font-extrabold tracking-tight text-balance mt-6 first:mt-0\">sub</h1>\n\n</div>\n</body>\n</html>",
 	)
 
 	check(
@@ -97,3 +97,48 @@ func TestConsistency(t *testing.T) {
 		"<html lang=\"en\">\n<head><title>Test</title></head>\n<body>\ncomponent_value\nenv=\"default_value\"\n/sub/subsub\nsubsub\n</body>\n</html>",
 	)
 }
+
+func TestNextjs_EnvFuncs(t *testing.T) {
+	t.Parallel()
+
+	dir := WriteFiles(t, map[string]string{
+		"mono.env":      "NAME=kitten\nDEBUG=true\nWORKERS=4\n",
+		"layout.gohtml": `{{children}}`,
+		"index.gohtml": `{{env_or "NAME" "nobody"}} {{env_or "MISSING" "fallback"}} ` +
+			`{{env_bool "DEBUG"}} {{env_bool "MISSING" true}} {{env_int "WORKERS" 1}} {{env_int "MISSING" 8}}`,
+	})
+
+	cl, server := PrepareTest()
+	server.Page("/", mono.Nextjs(dir))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	if body := strings.TrimSpace(string(cl.Get(t, "/"))); body != "kitten fallback true true 4 8" {
+		t.Errorf("unexpected env funcs output: %q", body)
+	}
+}
+
+func TestNextjs_FrontMatter(t *testing.T) {
+	t.Parallel()
+
+	dir := WriteFiles(t, map[string]string{
+		"layout.gohtml":      `<title>{{or (frontmatter "title") "Home"}}</title>{{children}}`,
+		"index.gohtml":       `home`,
+		"post/index.md":      "---\r\ntitle: \"First post\"\r\ndescription: hi\r\n---\r\n# Post\r\n",
+		"post/more/index.md": "Plain\n\n---\n\ntitle: not a front matter\n",
+	})
+
+	cl, server := PrepareTest()
+	server.Page("/", mono.Nextjs(dir))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	if body := string(cl.Get(t, "/")); !strings.HasPrefix(body, "<title>Home</title>") {
+		t.Errorf("expected the default title, got %q", body)
+	}
+	body := string(cl.Get(t, "/post"))
+	if !strings.HasPrefix(body, "<title>First post</title>") || strings.Contains(body, "description") {
+		t.Errorf("expected the front matter title and no front matter in the body, got %q", body)
+	}
+	if body := string(cl.Get(t, "/post/more")); !strings.HasPrefix(body, "<title>Home</title>") || !strings.Contains(body, "title: not a front matter") {
+		t.Errorf("expected a rule, not a front matter, got %q", body)
+	}
+}
@@ -22,11 +22,14 @@ import (
 // which is run as a child process, usually it's fast (<1s). We try to use the same stylesheet between all pages.
 // input.css could be set as Tailwind.InputCSS, if nothing is specified DefaultTailwindStylesheet is used.
 // tailwind.config.js  could be set as Tailwind.InputCSS, if nothing is specified DefaultTailwindConfigJs is used.
+// The css is minified in prod only (see IsProd).
 //
 // Flags supported:
 //   - "exe" "./your_path_to_binary_here", default: "npx @tailwindcss/cli"
 //   - "inline" "true"/"false", default: "true"
 //   - "theme" "light"/"dark"/"system", default: "system"
+//   - "nojs" "true"/"false", default: "false", the "system" theme follows prefers-color-scheme without JS too
+//     (the media query is added to the stylesheet's dark variant, the script is only needed by the toggle)
 //
 // Examples:
 // 1. <head> ... {{tailwind}} ... </head>
@@ -39,7 +42,12 @@ type Tailwind struct {
 	ConfigJS string
 	Context  context.Context
 	Timeout  time.Duration
+	// MinCSS is the expected minimum of css bytes per scanned html page, a smaller output
+	// (e.g. misconfigured content globs) is warned about, or is an error if Strict (the tailwind dir is kept then,
+	// for inspection). Default: 32, negative disables the check.
+	MinCSS   int
 	noInline bool
+	noJS     bool
 	tags     map[string]struct{}
 	tagsLock sync.Mutex
 }
@@ -52,7 +60,7 @@ var (
 	DefaultTailwindThemeButton template.HTML = `<button data-slot="button"
         class="inline-flex items-center justify-center gap-2 whitespace-nowrap rounded-md text-sm font-medium transition-all disabled:pointer-events-none disabled:opacity-50 [&amp;_svg]:pointer-events-none [&amp;_svg:not([class*='size-'])]:size-4 shrink-0 [&amp;_svg]:shrink-0 outline-none focus-visible:border-ring focus-visible:ring-ring/50 focus-visible:ring-[3px] aria-invalid:ring-destructive/20 dark:aria-invalid:ring-destructive/40 aria-invalid:border-destructive hover:bg-accent hover:text-accent-foreground dark:hover:bg-accent/50 group/toggle extend-touch-target size-8"
         title="Toggle theme"
-        onclick="localStorage.theme = document.documentElement.classList.toggle('dark') ? 'dark' : 'light'"
+        onclick="localStorage.theme = document.documentElement.classList.toggle('dark') ? 'dark' : 'light'; document.documentElement.classList.toggle('light', localStorage.theme === 'light'); document.cookie = 'mono_theme=' + localStorage.theme + '; path=/; max-age=31536000; samesite=lax'"
 >
     <svg xmlns="http://www.w3.org/2000/svg" width="24" height="24" viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" stroke-linecap="round" stroke-linejoin="round" class="size-4.5">
         <path stroke="none" d="M0 0h24v24H0z" fill="none"></path>
@@ -102,7 +110,12 @@ func (tailwind *Tailwind) SideEffects(result *BuiltPage) error {
 	if err != nil {
 		return err
 	}
-	defer func(path string) { err = errors.Join(err, removeTemp(path)) }(dir)
+	keepDir := false
+	defer func(path string) {
+		if !keepDir {
+			err = errors.Join(err, removeTemp(path))
+		}
+	}(dir)
 
 	contentDir := filepath.Join(dir, "content")
 	if err := os.Mkdir(filepath.Join(dir, "content"), 0777); err != nil {
@@ -129,7 +142,11 @@ func (tailwind *Tailwind) SideEffects(result *BuiltPage) error {
 	}
 
 	inputCSS := filepath.Join(dir, "input.css")
-	if err := os.WriteFile(inputCSS, []byte(tailwind.InputCSS), 0644); err != nil {
+	inputData := tailwind.InputCSS
+	if tailwind.noJS {
+		inputData = tailwindThemeNoJS(inputData)
+	}
+	if err := os.WriteFile(inputCSS, []byte(inputData), 0644); err != nil {
 		return err
 	}
 
@@ -137,8 +154,10 @@ func (tailwind *Tailwind) SideEffects(result *BuiltPage) error {
 	args := append(strings.Fields(tailwind.CLI),
 		"-i", inputCSS,
 		"-o", outputCSS,
-		"-m",
 	)
+	if IsProd() {
+		args = append(args, "-m") // Readable css while developing.
+	}
 	ctx, cancel := context.WithTimeout(alt(tailwind.Context, context.Background()), alt(tailwind.Timeout, time.Second*10))
 	defer cancel()
 	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
@@ -152,13 +171,20 @@ func (tailwind *Tailwind) SideEffects(result *BuiltPage) error {
 	if err != nil {
 		return err
 	}
+	if minCSS := alt(tailwind.MinCSS, 32) * len(htmls); tailwind.MinCSS >= 0 && len(strings.TrimSpace(string(dataCSS))) < minCSS {
+		msg := fmt.Sprintf("tailwind: suspiciously small css (%d bytes for %d pages), check the content config", len(dataCSS), len(htmls))
+		if Strict {
+			keepDir = true
+			return fmt.Errorf("%s (see %s)", msg, dir)
+		}
+		Log.Warn(msg)
+	}
 
 	if tailwind.noInline {
-		result.Subpattern[tailwind.urlCSS()] = &BuiltPage{
+		return result.SetSubpattern(tailwind.urlCSS(), &BuiltPage{
 			ContentType: "text/css; charset=utf-8",
 			Data:        dataCSS,
-		}
-		return nil
+		})
 	}
 
 	replaces := []string{}
@@ -203,6 +229,10 @@ func (tailwind *Tailwind) tag(args ...string) (res template.HTML, err error) {
 			if inline, err := strconv.ParseBool(value); err == nil {
 				tailwind.noInline = !inline
 			}
+		case "nojs":
+			if noJS, err := strconv.ParseBool(value); err == nil {
+				tailwind.noJS = noJS
+			}
 		case "theme":
 			themeScript, err = tailwind.buildThemeScript(value)
 			if err != nil {
@@ -225,6 +255,7 @@ func (tailwind *Tailwind) buildThemeScript(value string) (string, error) {
 try {
     const is_dark = localStorage.theme === 'dark' %s;
     document.documentElement.classList.toggle('dark', is_dark);
+    document.documentElement.classList.toggle('light', !is_dark);
     if (is_dark) {
     	document.querySelector('meta[name="theme-color"]')?.setAttribute('content', '#09090b');    
     }
@@ -250,6 +281,37 @@ try {
 	return themeScript, nil
 }
 
+const tailwindDarkVariant = "@custom-variant dark (&:is(.dark *));"
+
+// tailwindDarkVariantNoJS is the dark variant matching prefers-color-scheme: dark too, unless the theme script
+// (or the toggle) marked <html> as "light".
+const tailwindDarkVariantNoJS = `@custom-variant dark {
+    &:is(.dark *) {
+        @slot;
+    }
+    @media (prefers-color-scheme: dark) {
+        &:is(:root:not(.light) *) {
+            @slot;
+        }
+    }
+}`
+
+// tailwindThemeNoJS makes the dark variant and the .dark variables of css apply on prefers-color-scheme: dark,
+// so the "system" theme works with JS disabled, see the "nojs" flag.
+func tailwindThemeNoJS(css string) string {
+	css = strings.Replace(css, tailwindDarkVariant, tailwindDarkVariantNoJS, 1)
+	from := strings.Index(css, "\n.dark {")
+	if from == -1 {
+		return css
+	}
+	to := strings.Index(css[from:], "}")
+	if to == -1 {
+		return css
+	}
+	variables := strings.TrimPrefix(css[from+1:from+to+1], ".dark ")
+	return css + "\n@media (prefers-color-scheme: dark) {\n    :root:not(.light) " + variables + "\n}\n"
+}
+
 func removeTemp(path string) error {
 	if TempDirClean {
 		return os.RemoveAll(path)
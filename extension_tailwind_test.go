@@ -0,0 +1,158 @@
+package mono_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kittenbark/mono"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// FakeTailwindCLI is a stand-in for tailwind-cli writing css to the -o output, returns the executable path.
+func FakeTailwindCLI(t *testing.T, css string) string {
+	cli := filepath.Join(t.TempDir(), "tailwindcss")
+	script := fmt.Sprintf(`#!/bin/sh
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-o" ]; then out="$2"; fi
+	shift
+done
+printf '%%s' '%s' > "$out"
+`, css)
+	if err := os.WriteFile(cli, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestTailwind_EmptyOutput(t *testing.T) {
+	logger, strict, tempDir := mono.Log, mono.Strict, mono.TempDir
+	defer func() { mono.Log, mono.Strict, mono.TempDir = logger, strict, tempDir }()
+	logs := bytes.NewBuffer(nil)
+	mono.Log = slog.New(slog.NewTextHandler(logs, nil))
+	mono.TempDir = t.TempDir() // The strict error keeps the tailwind dir for inspection.
+	tailwindDirs := func() []string {
+		dirs, _ := filepath.Glob(filepath.Join(mono.TempDir, "mono_tailwind_*"))
+		return dirs
+	}
+
+	dir := WriteFiles(t, map[string]string{
+		"layout.gohtml": `<html><head>{{tailwind}}</head><body>{{children}}</body></html>`,
+		"index.gohtml":  `<main class="p-4">home</main>`,
+	})
+	build := func(minCSS int) error {
+		_, err := mono.Nextjs(dir, &mono.Tailwind{CLI: FakeTailwindCLI(t, ""), MinCSS: minCSS}).Apply(&mono.Context{Url: "/"})
+		return err
+	}
+
+	if err := build(0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "tailwind: suspiciously small css (0 bytes for 1 pages)") {
+		t.Fatalf("expected a warning, got logs: %s", logs.String())
+	}
+	if dirs := tailwindDirs(); len(dirs) != 0 {
+		t.Fatalf("expected the warning to remove the tailwind dir, got %v", dirs)
+	}
+
+	mono.Strict = true
+	if err := build(-1); err != nil {
+		t.Fatalf("expected a negative MinCSS to disable the check, got %v", err)
+	}
+	err := build(0)
+	if err == nil || !strings.Contains(err.Error(), "suspiciously small css") {
+		t.Fatalf("expected an error in strict mode, got %v", err)
+	}
+	if dirs := tailwindDirs(); len(dirs) != 1 || !strings.Contains(err.Error(), dirs[0]) {
+		t.Fatalf("expected the strict error to keep (and point to) the tailwind dir, got %v for %v", dirs, err)
+	}
+}
+
+func TestTailwind_ThemeNoJS(t *testing.T) {
+	t.Parallel()
+
+	// The fake cli outputs input.css as is, so the stylesheet given to tailwind is inlined.
+	cli := filepath.Join(t.TempDir(), "tailwindcss")
+	script := `#!/bin/sh
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-i" ]; then in="$2"; fi
+	if [ "$1" = "-o" ]; then out="$2"; fi
+	shift
+done
+cat "$in" > "$out"
+`
+	if err := os.WriteFile(cli, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(tag string) string {
+		dir := WriteFiles(t, map[string]string{
+			"layout.gohtml": `<html><head>` + tag + `</head><body>{{children}}</body></html>`,
+			"index.gohtml":  `<main class="p-4 dark:bg-black">home</main>`,
+		})
+		page, err := mono.Nextjs(dir, &mono.Tailwind{CLI: cli}).Apply(&mono.Context{Url: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := string(page.Data)
+		for _, sub := range page.Subpattern {
+			result += string(sub.Data)
+		}
+		return result
+	}
+
+	html := build(`{{tailwind "theme=system" "nojs=true"}}`)
+	for _, expected := range []string{
+		"@media (prefers-color-scheme: dark) {\n    :root:not(.light) {",
+		"&:is(:root:not(.light) *)",
+		"classList.toggle('light', !is_dark)",
+	} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("nojs: expected %q in %s", expected, html)
+		}
+	}
+
+	if html := build(`{{tailwind "theme=system"}}`); strings.Contains(html, "prefers-color-scheme: dark) {") {
+		t.Errorf("expected no media query css without nojs, got %s", html)
+	}
+}
+
+func TestTailwind_MinifyInProd(t *testing.T) {
+	defer mono.ResetDefaults()
+
+	// The fake cli records its args next to the css it writes.
+	argsFile := filepath.Join(t.TempDir(), "args")
+	cli := filepath.Join(t.TempDir(), "tailwindcss")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" > '%s'
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-o" ]; then out="$2"; fi
+	shift
+done
+printf '%%s' '.p-4{padding:1rem}' > "$out"
+`, argsFile)
+	if err := os.WriteFile(cli, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := WriteFiles(t, map[string]string{
+		"layout.gohtml": `<html><head>{{tailwind}}</head><body>{{children}}</body></html>`,
+		"index.gohtml":  `<main class="p-4">home</main>`,
+	})
+
+	for env, minified := range map[mono.Environment]bool{mono.EnvLocal: false, mono.EnvDev: false, mono.EnvProd: true} {
+		mono.CurrentEnv = env
+		if _, err := mono.Nextjs(dir, &mono.Tailwind{CLI: cli}).Apply(&mono.Context{Url: "/"}); err != nil {
+			t.Fatal(err)
+		}
+		args, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasMinify := slices.Contains(strings.Fields(string(args)), "-m"); hasMinify != minified {
+			t.Errorf("env %d: expected -m %v, got args %q", env, minified, args)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package mono
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,10 +12,13 @@ import (
 	"html/template"
 	"io"
 	"maps"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"slices"
+	"strings"
 	"sync"
 )
 
@@ -32,6 +38,18 @@ func (ctx *Context) Clone() *Context {
 	}
 }
 
+// Value mirrors SchemaData.Value, so templates read {{.Value "key"}} the same way in Nextjs and dynamic pages.
+func (ctx *Context) Value(key any) any {
+	name, ok := key.(string)
+	if !ok {
+		return nil
+	}
+	if value, ok := ctx.Env[name]; ok {
+		return value
+	}
+	return nil
+}
+
 func (ctx *Context) asFunc() func() Context {
 	return func() Context { return *ctx }
 }
@@ -69,22 +87,148 @@ func File(filename string, contentType ...string) HandlerFunc {
 	}
 }
 
+// FileLazy reads filename on every request rather than once, with Range support (see serveFile).
 func FileLazy(filename string, contentType ...string) HandlerFunc {
+	return serveFile(filename, def(contentType, ""))
+}
+
+// serveFile streams filename from disk via http.ServeContent: Range (206 Partial Content, e.g. for <video> seeking),
+// If-Modified-Since and HEAD are handled. An empty contentType is derived from the name or the content.
+func serveFile(filename string, contentType string) HandlerFunc {
+	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		file, err := os.Open(filename)
+		if err != nil {
+			return fmt.Errorf("serve file error: %v (file=%s)", err, filename)
+		}
+		defer func(file *os.File) { _ = file.Close() }(file)
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("serve file error: %v (file=%s)", err, filename)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("serve file error: is a directory (file=%s)", filename)
+		}
+
+		if contentType != "" {
+			rw.Header().Set("Content-Type", contentType)
+		}
+		http.ServeContent(rw, req, filename, info.ModTime(), file)
+		return nil
+	}
+}
+
+// FileGzip serves filename+".gz" as is (with Content-Encoding: gzip) to clients accepting gzip,
+// and filename otherwise, so assets compressed ahead of time aren't compressed on every request.
+// Content-Type is derived from filename (not the .gz one) unless specified, or sniffed from the (decompressed) contents.
+func FileGzip(filename string, contentType ...string) HandlerFunc {
 	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		h := rw.Header()
+		h.Add("Vary", "Accept-Encoding")
+		if headerContentType := def(contentType, contentTypeByName(filename)); headerContentType != "" {
+			h.Set("Content-Type", headerContentType)
+		}
+
+		if acceptsEncoding(req, "gzip") {
+			if reader, err := os.Open(filename + ".gz"); err == nil {
+				defer func(reader *os.File) { _ = reader.Close() }(reader)
+				if h.Get("Content-Type") == "" {
+					// Sniffed from the decompressed head, as http would sniff the gzip bytes themselves.
+					contentType, err := detectGzipContentType(reader)
+					if err != nil {
+						return fmt.Errorf("FileGzip error: %v (file=%s.gz)", err, filename)
+					}
+					h.Set("Content-Type", contentType)
+				}
+				h.Set("Content-Encoding", "gzip")
+				_, err = io.Copy(rw, reader)
+				return err
+			}
+		}
+
 		reader, err := os.Open(filename)
 		if err != nil {
-			return fmt.Errorf("FileLazy error: %v (file=%s)", err, filename)
+			return fmt.Errorf("FileGzip error: %v (file=%s)", err, filename)
 		}
-		if len(contentType) > 0 {
-			rw.Header().Set("Content-Type", contentType[0])
+		defer func(reader *os.File) { _ = reader.Close() }(reader)
+		if h.Get("Content-Type") == "" {
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(reader, head)
+			h.Set("Content-Type", http.DetectContentType(head[:n]))
+			if _, err = rw.Write(head[:n]); err != nil {
+				return err
+			}
 		}
-		if _, err := io.Copy(rw, reader); err != nil {
-			return err
+		_, err = io.Copy(rw, reader)
+		return err
+	}
+}
+
+// detectGzipContentType sniffs the content type of the gzip file's decompressed head, then rewinds the file.
+func detectGzipContentType(file *os.File) (string, error) {
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(decompressed, head)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// Redirect redirects to to, keeping the request's query (merged with to's one), code 0 is 308 (Permanent Redirect,
+// which keeps the method and body). See Server.Redirect to register one, and RedirectWith to strip the query.
+func Redirect(to string, code int) HandlerFunc {
+	return RedirectWith(to, RedirectOptions{Code: code})
+}
+
+// RedirectOptions tune a single RedirectWith handler, the zero value redirects as Redirect(to, 0) does.
+type RedirectOptions struct {
+	// Code is the 3xx status, 308 if 0, e.g. 302 or 307 for temporary redirects.
+	Code int
+	// StripQuery drops the request's query, only to's one is kept.
+	StripQuery bool
+}
+
+func RedirectWith(to string, options RedirectOptions) HandlerFunc {
+	return redirect(to, options, "")
+}
+
+// redirect appends the rest of the request's path after the subtree pattern (if any) to to, e.g. /old/a to /new/a.
+func redirect(to string, options RedirectOptions, subtree string) HandlerFunc {
+	code := options.Code
+	if code == 0 {
+		code = http.StatusPermanentRedirect
+	}
+	target, fragment, _ := strings.Cut(to, "#")
+	target, query, _ := strings.Cut(target, "?")
+	if fragment != "" {
+		fragment = "#" + fragment
+	}
+
+	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		location := target
+		if subtree != "" {
+			// Leading slashes are collapsed, so to="/" doesn't redirect /old//evil.com to //evil.com.
+			location = strings.TrimSuffix(location, "/") + "/" + strings.TrimLeft(trimPatternPrefix(req.URL.Path, subtree), "/")
+		}
+		locationQuery := query
+		if !options.StripQuery && req.URL.RawQuery != "" {
+			locationQuery = strings.TrimPrefix(locationQuery+"&"+req.URL.RawQuery, "&")
 		}
+		if locationQuery != "" {
+			location += "?" + locationQuery
+		}
+		http.Redirect(rw, req, location+fragment, code)
 		return nil
 	}
 }
 
+func contentTypeByName(filename string) string {
+	return mime.TypeByExtension(filepath.Ext(filename))
+}
+
 const contentTypeHTML = "text/html; charset=utf-8"
 
 type Page interface {
@@ -106,6 +250,43 @@ type BuiltPage struct {
 	Dynamic      bool
 	DynamicFuncs template.FuncMap
 	DynamicData  func(ctx context.Context, req *http.Request) any
+	// RequestFuncs are DynamicFuncs bound to the current request, e.g. {"user": func() User { return auth(req) }}.
+	// It's called once at build with an empty request to learn the names, so it shouldn't use req right away.
+	// Such pages are served with Cache-Control "private, no-cache", unless Headers has one.
+	RequestFuncs func(ctx context.Context, req *http.Request) template.FuncMap
+	// CoalesceKey enables request coalescing for expensive dynamic pages: concurrent requests with the same key
+	// share a single render (and get the same body), e.g. CoalesceByURL. Nil disables coalescing.
+	CoalesceKey func(req *http.Request) string
+	// Disposition is the Content-Disposition header, e.g. ContentDisposition("attachment", "report.csv").
+	Disposition string
+	// Headers are set on the page's responses after the defaults, so they may override them (e.g. Cache-Control),
+	// e.g. {"X-Robots-Tag": "noindex"} for a draft. An empty value removes the header.
+	Headers map[string]string
+	// Filename streams the page from disk on every request instead of serving Data (which must be empty), with Range
+	// support, e.g. FileMedia of a file above InMemoryFilesizeThreshold. It's neither precompressed nor transformed.
+	Filename string
+	// Stream writes dynamic pages as they render rather than buffering them, flushing every StreamChunkSize bytes
+	// and at {${flush}$} in the template, so clients get the start of large pages early. Streamed pages are gzipped
+	// on the fly and never coalesced, an error midway through the render can only cut the response short.
+	Stream bool
+}
+
+// SetSubpattern assigns page to url in result.Subpattern, assigning a different content to a taken url
+// (e.g. two pages or extensions producing the same cdn url) is reported rather than silently overwritten.
+func (page *BuiltPage) SetSubpattern(url string, subpage *BuiltPage) error {
+	if page.Subpattern == nil {
+		page.Subpattern = make(map[string]*BuiltPage)
+	}
+	if existing, ok := page.Subpattern[url]; ok && (!bytes.Equal(existing.Data, subpage.Data) || existing.Filename != subpage.Filename) {
+		return fmt.Errorf("subpattern conflict: %s is assigned different contents", url)
+	}
+	page.Subpattern[url] = subpage
+	return nil
+}
+
+// CoalesceByURL is a BuiltPage.CoalesceKey for pages which only depend on the method and url.
+func CoalesceByURL(req *http.Request) string {
+	return req.Method + " " + req.URL.RequestURI()
 }
 
 func (page BuiltPage) Apply(ctx *Context) (BuiltPage, error) { return page, nil }
@@ -145,7 +326,17 @@ func FileHtml(filename string) Page {
 	return Html(template.HTML(data))
 }
 
+// FileMedia serves filename (e.g. a video) with Range support, files above InMemoryFilesizeThreshold are streamed
+// from disk rather than held in memory, see BuiltPage.Filename.
 func FileMedia(filename string) Page {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return staticError(err)
+	}
+	if info.Size() > InMemoryFilesizeThreshold {
+		return staticPage(BuiltPage{Filename: filename, ContentType: contentTypeByName(filename)})
+	}
+
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return StaticFunc(func(ctx *Context) (BuiltPage, error) { return BuiltPage{}, err })
@@ -159,6 +350,218 @@ func FileMedia(filename string) Page {
 	)
 }
 
+// FileDownload serves filename as an attachment, so browsers save it as downloadName instead of rendering it.
+func FileDownload(filename string, downloadName string) Page {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return staticError(err)
+	}
+	contentType := contentTypeByName(filename)
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return Attachment(downloadName, staticPage(BuiltPage{Data: data, ContentType: contentType}))
+}
+
+// Attachment makes any page (e.g. FileMedia) download as downloadName, see FileDownload.
+func Attachment(downloadName string, page Page) Page {
+	return StaticFunc(func(ctx *Context) (BuiltPage, error) {
+		built, err := page.Apply(ctx)
+		if err != nil {
+			return built, err
+		}
+		built.Disposition = ContentDisposition("attachment", downloadName)
+		return built, nil
+	})
+}
+
+// Prerender executes the {${ ... }$} template of page once at build time with data (as SchemaData.Data),
+// and serves the result as a static page, i.e. cached and precompressed. It's opt-in on purpose: a page
+// depending on the request (theme, locale, query) would be frozen with whatever the build saw.
+func Prerender(page Page, data any) Page {
+	return StaticFunc(func(ctx *Context) (BuiltPage, error) {
+		built, err := page.Apply(ctx)
+		if err != nil {
+			return built, err
+		}
+		if containsDynamicContent(built.Data) {
+			funcs := maps.Clone(DefaultPageDynamicFuncs)
+			maps.Copy(funcs, built.DynamicFuncs)
+			rendered, err := SchemaApply(string(built.Data), "prerender"+ctx.Url, funcs,
+				NewSchemaData(context.Background(), ctx, nil, data), "{${", "}$}")
+			if err != nil {
+				return built, fmt.Errorf("prerender %s: %w", ctx.Url, err)
+			}
+			built.Data = []byte(rendered)
+		}
+		built.Dynamic, built.DynamicFuncs, built.DynamicData, built.CoalesceKey = false, nil, nil, nil
+		return built, nil
+	})
+}
+
+// WithLayout renders the html of page into the {{children}} slot of the layout template at build time, as Nextjs
+// layouts do, e.g. WithLayout(`<html><body>{{children}}</body></html>`, FileHtml("about.html")).
+// See Layout for funcs and data of the layout.
+func WithLayout(layout string, page Page) Page {
+	return Layout(layout, page, LayoutOptions{})
+}
+
+// LayoutOptions are the funcs (on top of the build's ones and markdown) and the data (the dot, the build's Context
+// by default) of a Layout template.
+type LayoutOptions struct {
+	Funcs template.FuncMap
+	Data  any
+}
+
+// Layout is WithLayout with options, e.g. Layout(layout, page, LayoutOptions{Data: map[string]string{"title": "About"}}).
+// Dynamic pages stay dynamic, their {${ ... }$} is left for the request time.
+func Layout(layout string, page Page, options LayoutOptions) Page {
+	return StaticFunc(func(ctx *Context) (BuiltPage, error) {
+		built, err := page.Apply(ctx)
+		if err != nil {
+			return built, err
+		}
+		if built.Filename != "" || (built.ContentType != "" && !strings.HasPrefix(built.ContentType, "text/html")) {
+			return built, fmt.Errorf("layout %s: not an html page (%s)", ctx.Url, cmp.Or(built.ContentType, built.Filename))
+		}
+
+		funcs := template.FuncMap{"markdown": Markdown}
+		maps.Copy(funcs, ctx.Funcs)
+		maps.Copy(funcs, options.Funcs)
+		children := template.HTML(built.Data)
+		funcs["children"] = func() template.HTML { return children }
+		var data any = ctx
+		if options.Data != nil {
+			data = options.Data
+		}
+		rendered, err := SchemaApply(layout, "layout"+ctx.Url, funcs, data)
+		if err != nil {
+			return built, fmt.Errorf("layout %s: %w", ctx.Url, err)
+		}
+		built.Data, built.ContentType = []byte(rendered), contentTypeHTML
+		return built, nil
+	})
+}
+
+// DynamicPage declares a page rendered on every request from a template with the usual {{ }} delimiters,
+// without wiring BuiltPage by hand: DynamicPage(contentType, `<p>{{.Data}}</p>`).Data(fn).Build().
+// Templates get SchemaData (.Data is what Data returns, .Request, .Build, etc.), funcs default to DefaultPageDynamicFuncs.
+func DynamicPage(contentType string, template string) *DynamicPageBuilder {
+	return &DynamicPageBuilder{template: template, contentType: contentType}
+}
+
+type DynamicPageBuilder struct {
+	template     string
+	contentType  string
+	data         func(ctx context.Context, req *http.Request) any
+	funcs        template.FuncMap
+	requestFuncs func(ctx context.Context, req *http.Request) template.FuncMap
+	coalesceKey  func(req *http.Request) string
+	stream       bool
+}
+
+// Data sets .Data of the template for a request.
+func (builder *DynamicPageBuilder) Data(fn func(ctx context.Context, req *http.Request) any) *DynamicPageBuilder {
+	builder.data = fn
+	return builder
+}
+
+// Funcs adds template funcs on top of DefaultPageDynamicFuncs.
+func (builder *DynamicPageBuilder) Funcs(funcs template.FuncMap) *DynamicPageBuilder {
+	builder.funcs = maps.Clone(funcs)
+	return builder
+}
+
+// RequestFuncs adds template funcs bound to the request, see BuiltPage.RequestFuncs.
+func (builder *DynamicPageBuilder) RequestFuncs(fn func(ctx context.Context, req *http.Request) template.FuncMap) *DynamicPageBuilder {
+	builder.requestFuncs = fn
+	return builder
+}
+
+// Stream writes the page as it renders, see BuiltPage.Stream ({{flush}} flushes in the template).
+func (builder *DynamicPageBuilder) Stream() *DynamicPageBuilder {
+	builder.stream = true
+	return builder
+}
+
+// Coalesce enables request coalescing, see BuiltPage.CoalesceKey.
+func (builder *DynamicPageBuilder) Coalesce(key func(req *http.Request) string) *DynamicPageBuilder {
+	builder.coalesceKey = key
+	return builder
+}
+
+func (builder *DynamicPageBuilder) Build() Page {
+	schema := builder.template
+	if !strings.Contains(schema, "{${") {
+		schema = strings.NewReplacer("{{", "{${", "}}", "}$}").Replace(schema)
+	}
+	funcs := maps.Clone(DefaultPageDynamicFuncs)
+	maps.Copy(funcs, builder.funcs)
+	dataFn := builder.data
+
+	return BuiltPage{
+		Data:         []byte(schema),
+		ContentType:  builder.contentType,
+		Dynamic:      true,
+		DynamicFuncs: funcs,
+		RequestFuncs: builder.requestFuncs,
+		CoalesceKey:  builder.coalesceKey,
+		Stream:       builder.stream,
+		DynamicData: func(ctx context.Context, req *http.Request) any {
+			var data any
+			if dataFn != nil {
+				data = dataFn(ctx, req)
+			}
+			return NewSchemaData(ctx, &Context{Url: cmp.Or(patternUrl(req.Pattern), req.URL.Path)}, req, data)
+		},
+	}
+}
+
+// patternUrl is the path of a route pattern without the method and host, so .Build.Url of dynamic pages is
+// the registered pattern (e.g. /posts/{id}), as it is for static pages.
+func patternUrl(pattern string) string {
+	route := parseRoute(pattern)
+	return strings.TrimSuffix(strings.TrimPrefix(route.Path, route.Host()), "{$}")
+}
+
+// ContentDisposition formats a Content-Disposition header value. Non-ASCII filenames are RFC 5987 encoded
+// as filename*, with an ASCII-only filename fallback for older clients.
+func ContentDisposition(disposition string, filename string) string {
+	fallback := strings.Builder{}
+	encoded := strings.Builder{}
+	ascii := true
+	for _, r := range filename {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			continue
+		case r > 0x7f:
+			ascii = false
+			fallback.WriteByte('_')
+		case r == '"' || r == '\\':
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(filename) {
+		if isRfc5987AttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			_, _ = fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	result := fmt.Sprintf(`%s; filename="%s"`, disposition, fallback.String())
+	if !ascii {
+		result += "; filename*=UTF-8''" + encoded.String()
+	}
+	return result
+}
+
+func isRfc5987AttrChar(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
 func staticError(err error) Page {
 	trace := []string{}
 	for i := range 10 {
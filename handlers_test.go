@@ -0,0 +1,231 @@
+package mono_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/kittenbark/mono"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileGzip(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	raw := []byte("console.log('raw');")
+	compressed := bytes.NewBuffer(nil)
+	compressor := gzip.NewWriter(compressed)
+	_, _ = compressor.Write([]byte("console.log('precompressed');"))
+	_ = compressor.Close()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app.js.gz"), compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an extension, the Content-Type is sniffed from the decompressed contents, not the gzip bytes.
+	page := bytes.NewBuffer(nil)
+	compressor = gzip.NewWriter(page)
+	_, _ = compressor.Write([]byte("<!DOCTYPE html><p>hi</p>"))
+	_ = compressor.Close()
+	if err := os.WriteFile(filepath.Join(dir, "page.gz"), page.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cl, server := PrepareTest()
+	server.
+		Handler("/app.js", mono.FileGzip(filepath.Join(dir, "app.js"))).
+		Handler("/page", mono.FileGzip(filepath.Join(dir, "page")))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	resp, body := cl.Do(t, http.MethodGet, "/app.js", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, compressed.Bytes()) {
+		t.Fatalf("expected the .gz variant, got %q (Content-Encoding=%q)", body, resp.Header.Get("Content-Encoding"))
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/javascript; charset=utf-8" {
+		t.Fatalf("expected javascript Content-Type, got %q", contentType)
+	}
+
+	resp, body = cl.Do(t, http.MethodGet, "/app.js", "Accept-Encoding", "identity")
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(body, raw) {
+		t.Fatalf("expected the raw file, got %q (Content-Encoding=%q)", body, resp.Header.Get("Content-Encoding"))
+	}
+
+	resp, body = cl.Do(t, http.MethodGet, "/page", "Accept-Encoding", "gzip")
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/html; charset=utf-8" || !bytes.Equal(body, page.Bytes()) {
+		t.Fatalf("expected the .gz variant as html, got %q (Content-Type=%q)", body, contentType)
+	}
+}
+
+func TestFileDownload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	report := []byte("id,name\n1,kitten\n")
+	if err := os.WriteFile(filepath.Join(dir, "report.csv"), report, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cl, server := PrepareTest()
+	server.
+		Page("/report", mono.FileDownload(filepath.Join(dir, "report.csv"), "report.csv")).
+		Page("/report/ru", mono.FileDownload(filepath.Join(dir, "report.csv"), `отчёт "2024".csv`))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	tests := map[string]string{
+		"/report":    `attachment; filename="report.csv"`,
+		"/report/ru": `attachment; filename="_____ _2024_.csv"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82%20%222024%22.csv`,
+	}
+	for path, expected := range tests {
+		resp, body := cl.Do(t, http.MethodGet, path)
+		if actual := resp.Header.Get("Content-Disposition"); actual != expected {
+			t.Errorf("%s: expected Content-Disposition %s, got %s", path, expected, actual)
+		}
+		if !bytes.Equal(body, report) {
+			t.Errorf("%s: expected the report, got %q", path, body)
+		}
+	}
+}
+
+func TestPrerender(t *testing.T) {
+	t.Parallel()
+
+	template := mono.BuiltPage{
+		Data:        []byte(`<p>{${.Data.Title}$} at {${.Build.Url}$}</p>`),
+		ContentType: "text/html; charset=utf-8",
+		Dynamic:     true,
+	}
+	cl, server := PrepareTest()
+	server.Page("/about", mono.Prerender(template, struct{ Title string }{"About"}))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	if body := cl.Get(t, "/about"); string(body) != "<p>About at /about</p>" {
+		t.Errorf("unexpected prerendered page: %s", body)
+	}
+	stats := server.StatsData()
+	if len(stats) == 0 || stats[0].Path != "/about" || stats[0].Type != mono.RouteStaticPage || stats[0].GzipBytes == 0 {
+		t.Errorf("expected a static precompressed route, got %+v", stats)
+	}
+}
+
+func TestWithLayout(t *testing.T) {
+	t.Parallel()
+
+	about := filepath.Join(t.TempDir(), "about.html")
+	if err := os.WriteFile(about, []byte("<p>about us</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	layout := `<html><body><h1>{{title}}</h1>{{children}}<footer>{{.}}</footer></body></html>`
+
+	cl, server := PrepareTest()
+	server.
+		Page("/about", mono.Layout(layout, mono.FileHtml(about), mono.LayoutOptions{
+			Funcs: template.FuncMap{"title": func() string { return "About" }},
+			Data:  "kittenbark",
+		})).
+		Page("/plain", mono.WithLayout(`<main>{{children}}</main>`, mono.Html("plain"))).
+		Page("/now", mono.WithLayout(`<main>{{children}}</main>`, mono.BuiltPage{
+			Data:        []byte(`{${ . }$}`),
+			ContentType: "text/html; charset=utf-8",
+			Dynamic:     true,
+			DynamicData: func(ctx context.Context, req *http.Request) any { return req.URL.Query().Get("q") },
+		}))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	expected := map[string]string{
+		"/about": `<html><body><h1>About</h1><p>about us</p><footer>kittenbark</footer></body></html>`,
+		"/plain": `<main>plain</main>`,
+	}
+	for path, expected := range expected {
+		if body := string(cl.Get(t, path)); body != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, body)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, cl.url+"/now?q=meow", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "<main>meow</main>" {
+		t.Errorf("expected the dynamic page to render in the layout, got %s", body)
+	}
+
+	if _, err := mono.WithLayout(layout, mono.BuiltPage{Data: []byte("{}"), ContentType: "application/json"}).
+		Apply(&mono.Context{Url: "/api"}); err == nil {
+		t.Error("expected an error for a non-html page")
+	}
+}
+
+func TestDynamicPage(t *testing.T) {
+	t.Parallel()
+
+	page := mono.DynamicPage("text/html; charset=utf-8", `<p>{{.Data}} at {{.Build.Url}}, {{shout "hi"}}</p>`).
+		Data(func(ctx context.Context, req *http.Request) any { return req.Header.Get("X-Name") }).
+		Funcs(template.FuncMap{"shout": strings.ToUpper}).
+		Build()
+	cl, server := PrepareTest()
+	server.Page("/greet", page).Page("GET /greet/{name}", page)
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for _, name := range []string{"alice", "bob"} {
+		_, body := cl.Do(t, http.MethodGet, "/greet", "X-Name", name)
+		if expected := "<p>" + name + " at /greet, HI</p>"; string(body) != expected {
+			t.Errorf("expected %q, got %q", expected, body)
+		}
+	}
+	// .Build.Url is the registered pattern, as for static pages.
+	if _, body := cl.Do(t, http.MethodGet, "/greet/carol", "X-Name", "carol"); string(body) != "<p>carol at /greet/{name}, HI</p>" {
+		t.Errorf("expected the pattern as .Build.Url, got %q", body)
+	}
+}
+
+func TestFileMediaRange(t *testing.T) {
+	defer mono.ResetDefaults()
+	mono.InMemoryFilesizeThreshold = 64
+
+	dir := t.TempDir()
+	small, large := filepath.Join(dir, "small.mp4"), filepath.Join(dir, "large.mp4")
+	if err := os.WriteFile(small, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(large, bytes.Repeat([]byte("0123456789"), 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cl, server := PrepareTest()
+	server.
+		Page("/small", mono.FileMedia(small)).
+		Page("/large", mono.FileMedia(large)).
+		Handler("/lazy", mono.FileLazy(large, "video/mp4"))
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	for _, path := range []string{"/small", "/large", "/lazy"} {
+		resp, body := cl.Do(t, http.MethodGet, path, "Range", "bytes=2-4")
+		if resp.StatusCode != http.StatusPartialContent || string(body) != "234" || resp.Header.Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s: expected 206 with the range, got %d %q", path, resp.StatusCode, body)
+		}
+		if resp, body := cl.Do(t, http.MethodGet, path); resp.StatusCode != http.StatusOK || len(body) < 10 {
+			t.Errorf("%s: expected the whole file without Range, got %d %d bytes", path, resp.StatusCode, len(body))
+		}
+	}
+
+	// Files above InMemoryFilesizeThreshold are read on request, so changes show up.
+	if err := os.WriteFile(large, bytes.Repeat([]byte("abcdefghij"), 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := cl.Do(t, http.MethodGet, "/large", "Range", "bytes=0-2"); string(body) != "abc" {
+		t.Errorf("expected a large file to stream from disk, got %q", body)
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/large"); !strings.HasPrefix(resp.Header.Get("Content-Type"), "video/mp4") || resp.Header.Get("Cache-Control") == "" {
+		t.Errorf("expected page headers for a streamed file, got %v", resp.Header)
+	}
+}
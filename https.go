@@ -1,15 +1,25 @@
 package mono
 
 import (
+	"cmp"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"io/fs"
+	"maps"
 	"math/big"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -21,6 +31,8 @@ var TLSOptions = TLSOptionsT{
 	Country:      "US",
 	ValidDays:    365,
 	KeySize:      2048,
+	HTTPSAddr:    ":443",
+	HTTPAddr:     ":80",
 }
 
 type TLSOptionsT struct {
@@ -30,6 +42,8 @@ type TLSOptionsT struct {
 	Country      string
 	ValidDays    int
 	KeySize      int
+	HTTPSAddr    string // Listened to with ACME certificates, e.g. ":8443" to test locally without root.
+	HTTPAddr     string // ACME http-01 challenges and redirects to https, "" disables it.
 }
 
 func TLS(domains ...string) (*tls.Config, error) {
@@ -90,12 +104,138 @@ func SelfSignedTLS(domains ...string) (*tls.Config, error) {
 	}, nil
 }
 
+// TLSMulti serves several domains with their own configs from one server, picked by SNI: the exact domain,
+// then a "*.example.com" wildcard entry, then the "" entry (the default), or the first domain if there is none.
+// E.g. server.TLS(TLSMulti(map[string]*tls.Config{"a.com": cfgA, "b.org": cfgB})).
+// ACME configs of TLS(...) get certificates via tls-alpn-01 only, as the http-01 handler is per server.
+// The configs are used as is for their handshakes, so ones without NextProtos get h2 and http/1.1 (and the
+// tls-alpn-01 protocol, if they have GetCertificate).
+func TLSMulti(configs map[string]*tls.Config) (*tls.Config, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("mono.TLSMulti: no configs")
+	}
+	domains := slices.Sorted(maps.Keys(configs))
+	byDomain := make(map[string]*tls.Config, len(configs))
+	for _, domain := range domains {
+		if configs[domain] == nil {
+			return nil, fmt.Errorf("mono.TLSMulti: nil config for %q", domain)
+		}
+		cfg := configs[domain].Clone()
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+		if cfg.GetCertificate != nil && !slices.Contains(cfg.NextProtos, acme.ALPNProto) {
+			cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+		}
+		byDomain[strings.ToLower(domain)] = cfg
+	}
+	fallback, ok := byDomain[""]
+	if !ok {
+		fallback = byDomain[strings.ToLower(domains[0])]
+	}
+
+	return &tls.Config{
+		ServerName: cmp.Or(fallback.ServerName, domains[0]),
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+			if cfg, ok := byDomain[name]; ok {
+				return cfg, nil
+			}
+			if _, parent, ok := strings.Cut(name, "."); ok {
+				if cfg, ok := byDomain["*."+parent]; ok {
+					return cfg, nil
+				}
+			}
+			return fallback, nil
+		},
+	}, nil
+}
+
+// logCertCache logs the domains and expiry of certificates cached by the ACME manager (see TLSOptions.CacheDir),
+// warning about expired ones and ones within the renewal window, so operators don't learn it from failed handshakes.
+// Autocert re-issues them once their domain is requested.
+func logCertCache(manager *autocert.Manager) {
+	dir, ok := manager.Cache.(autocert.DirCache)
+	if !ok {
+		return
+	}
+	entries, err := os.ReadDir(string(dir))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			Log.Warn("mono: reading the cert cache", "dir", string(dir), "err", err.Error())
+		}
+		return
+	}
+
+	renewBefore := cmp.Or(manager.RenewBefore, 30*24*time.Hour) // The autocert default.
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(string(dir), entry.Name()))
+		if err != nil {
+			Log.Warn("mono: reading the cert cache", "file", entry.Name(), "err", err.Error())
+			continue
+		}
+		cert := cachedCert(data)
+		if cert == nil {
+			continue // E.g. the ACME account key.
+		}
+
+		attrs := []any{"domains", strings.Join(cert.DNSNames, ","), "expires", cert.NotAfter.Format(time.RFC3339)}
+		switch left := time.Until(cert.NotAfter); {
+		case left <= 0:
+			Log.Warn("mono: cached cert expired", attrs...)
+		case left < renewBefore:
+			Log.Warn("mono: cached cert is due for renewal", attrs...)
+		default:
+			Log.Info("mono: cached cert", attrs...)
+		}
+	}
+}
+
+// cachedCert is the leaf of an autocert cache entry (the private key, then the chain, as PEM), nil if there is none.
+func cachedCert(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil
+			}
+			return cert
+		}
+	}
+}
+
 type cursedTLSDataAsError struct {
 	manager *autocert.Manager
 }
 
 func (data *cursedTLSDataAsError) Error() string { return "this not a real error (its cursed)" }
 
+// httpsRedirect redirects GET and HEAD requests to https as autocert does, but to the port of httpsAddr (unless 443).
+func httpsRedirect(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(rw, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		host := req.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), http.StatusFound)
+	})
+}
+
 func domainsWithWWW(domains []string) []string {
 	result := make([]string, 0, len(domains))
 	for _, domain := range domains {
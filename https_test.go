@@ -0,0 +1,228 @@
+package mono_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/kittenbark/mono"
+	"github.com/kittenbark/mono/monotest"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTLS_ForcedLocally(t *testing.T) {
+	env, enableTLS := mono.CurrentEnv, mono.EnableTLS
+	defer func() { mono.CurrentEnv, mono.EnableTLS = env, enableTLS }()
+	mono.CurrentEnv, mono.EnableTLS = mono.EnvLocal, mono.EnableTLSUnspecified
+
+	insecure := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	serve := func(t *testing.T) string {
+		addr := fmt.Sprintf(":%d", port.Add(1))
+		server := mono.New().
+			Addr(addr).
+			TLS(mono.SelfSignedTLS("localhost")).
+			Page("/", mono.Html("secure"))
+		StartForT(t, server, time.Millisecond*50, time.Millisecond*500)
+		return "localhost" + addr
+	}
+
+	t.Run("MONO_TLS", func(t *testing.T) {
+		t.Setenv(mono.EnvMonoTLS, "true")
+		host := serve(t)
+
+		resp, err := insecure.Get("https://" + host)
+		if err != nil {
+			t.Fatalf("expected the tls serve path: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.TLS == nil || string(body) != "secure" {
+			t.Fatalf(`expected "secure" over tls, got %q (tls=%v)`, body, resp.TLS != nil)
+		}
+	})
+
+	t.Run("EnableTLS", func(t *testing.T) {
+		t.Setenv(mono.EnvMonoTLS, "false")
+		mono.EnableTLS = mono.EnableTLSTrue
+		defer func() { mono.EnableTLS = mono.EnableTLSUnspecified }()
+		host := serve(t)
+
+		resp, err := insecure.Get("https://" + host)
+		if err != nil {
+			t.Fatalf("expected EnableTLS to take precedence over MONO_TLS: %v", err)
+		}
+		_ = resp.Body.Close()
+	})
+
+	t.Run("local default", func(t *testing.T) {
+		host := serve(t)
+
+		resp, err := http.Get("http://" + host)
+		if err != nil {
+			t.Fatalf("expected plain http locally: %v", err)
+		}
+		_ = resp.Body.Close()
+	})
+}
+
+func TestTLS_IsTLS(t *testing.T) {
+	enableTLS := mono.EnableTLS
+	defer func() { mono.EnableTLS = enableTLS }()
+
+	mono.EnableTLS = mono.EnableTLSTrue
+	if server := mono.New().TLS(mono.SelfSignedTLS("localhost")); !server.IsTLS() || server.Scheme() != "https" {
+		t.Errorf("expected a configured tls server, got IsTLS=%v Scheme=%s", server.IsTLS(), server.Scheme())
+	}
+	if server := mono.New(); server.IsTLS() || server.Scheme() != "http" {
+		t.Errorf("expected a plain server, got IsTLS=%v Scheme=%s", server.IsTLS(), server.Scheme())
+	}
+
+	mono.EnableTLS = mono.EnableTLSFalse
+	if server := mono.New().TLS(mono.SelfSignedTLS("localhost")); server.IsTLS() {
+		t.Errorf("expected tls to be skipped with EnableTLSFalse")
+	}
+}
+
+func TestTLS_Multi(t *testing.T) {
+	defer mono.ResetDefaults()
+	mono.EnableTLS = mono.EnableTLSTrue
+
+	configs := map[string]*tls.Config{}
+	for _, domain := range []string{"a.test", "b.test", "*.wild.test"} {
+		cfg, err := mono.SelfSignedTLS(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs[domain] = cfg
+	}
+	configs[""] = configs["a.test"]
+
+	addr := fmt.Sprintf(":%d", port.Add(1))
+	server := mono.New().
+		Addr(addr).
+		TLS(mono.TLSMulti(configs)).
+		Page("/", mono.Html("multi"))
+	StartForT(t, server, time.Millisecond*50, time.Millisecond*500)
+
+	for serverName, expected := range map[string]string{
+		"a.test":        "a.test",
+		"b.test":        "b.test",
+		"www.wild.test": "*.wild.test",
+		"unknown.test":  "a.test",
+	} {
+		conn, err := tls.Dial("tcp", "localhost"+addr, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", serverName, err)
+		}
+		state := conn.ConnectionState()
+		_ = conn.Close()
+		certs := state.PeerCertificates
+		if len(certs) == 0 || len(certs[0].DNSNames) == 0 || certs[0].DNSNames[0] != expected {
+			t.Errorf("%s: expected the %s certificate, got %v", serverName, expected, certs)
+		}
+		if state.NegotiatedProtocol != "h2" {
+			t.Errorf("%s: expected h2, got %q", serverName, state.NegotiatedProtocol)
+		}
+	}
+
+	acmeLike := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, nil }}
+	multi, err := mono.TLSMulti(map[string]*tls.Config{"acme.test": acmeLike})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := multi.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "acme.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.NextProtos, []string{"h2", "http/1.1", "acme-tls/1"}) {
+		t.Errorf("expected h2, http/1.1 and acme-tls/1, got %v", cfg.NextProtos)
+	}
+	if acmeLike.NextProtos != nil {
+		t.Errorf("expected the passed config to stay untouched, got %v", acmeLike.NextProtos)
+	}
+}
+
+func TestTLS_HTTPRedirect(t *testing.T) {
+	_ = monotest.CaptureLogs(t) // Resets the defaults below once the test ends.
+	mono.EnableTLS = mono.EnableTLSTrue
+	mono.TLSOptions.CacheDir = t.TempDir()
+	mono.TLSOptions.HTTPSAddr = fmt.Sprintf(":%d", port.Add(1))
+	mono.TLSOptions.HTTPAddr = fmt.Sprintf(":%d", port.Add(1))
+
+	server := mono.New().TLS(mono.TLS("redirect.test")).Page("/", mono.Html("ok"))
+	StartForT(t, server, time.Millisecond*50, time.Millisecond*500)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "http://localhost"+mono.TLSOptions.HTTPAddr+"/a?b=c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "redirect.test" + mono.TLSOptions.HTTPAddr
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if expected := "https://redirect.test" + mono.TLSOptions.HTTPSAddr + "/a?b=c"; resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != expected {
+		t.Errorf("expected a redirect to %s, got %d %s", expected, resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestTLS_CertCache(t *testing.T) {
+	logs := monotest.CaptureLogs(t) // Resets the defaults below once the test ends.
+	mono.EnableTLS = mono.EnableTLSTrue
+	mono.TLSOptions.CacheDir = t.TempDir()
+	mono.TLSOptions.HTTPSAddr = fmt.Sprintf(":%d", port.Add(1))
+	mono.TLSOptions.HTTPAddr = ""
+	mono.TLSOptions.KeySize = 1024
+
+	// Cached as autocert does: the private key, then the certificate.
+	cache := func(domain string, validDays int) {
+		mono.TLSOptions.ValidDays = validDays
+		cfg, err := mono.SelfSignedTLS(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := x509.MarshalPKCS8PrivateKey(cfg.Certificates[0].PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := slices.Concat(
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cfg.Certificates[0].Certificate[0]}),
+		)
+		if err := os.WriteFile(filepath.Join(mono.TLSOptions.CacheDir, domain), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache("fresh.test", 90)
+	cache("soon.test", 5)
+	cache("old.test", -1)
+	if err := os.WriteFile(filepath.Join(mono.TLSOptions.CacheDir, "acme_account+key"), []byte("not a cert"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := mono.New().TLS(mono.TLS("fresh.test", "soon.test", "old.test")).Page("/", mono.Html("ok"))
+	StartForT(t, server, time.Millisecond*50, time.Millisecond*100)
+	time.Sleep(time.Millisecond * 50)
+
+	for _, expected := range []string{
+		`level=INFO msg="mono: cached cert" domains=fresh.test`,
+		`level=WARN msg="mono: cached cert is due for renewal" domains=soon.test`,
+		`level=WARN msg="mono: cached cert expired" domains=old.test`,
+	} {
+		if !logs.Contains(expected) {
+			t.Errorf("expected %q in logs: %s", expected, logs.String())
+		}
+	}
+}
@@ -3,71 +3,169 @@ package mono
 import (
 	"cmp"
 	"fmt"
+	"golang.org/x/net/html"
 	"html/template"
 	"math"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"unicode"
+	"unicode/utf8"
 )
 
 var (
-	MarkdownTags = []MarkdownTag{
+	MarkdownTags = defaultMarkdownTags()
+
+	MarkdownTagParagraph = []string{`<p class="{md.p}">`, `</p>`}
+
+	// MarkdownClasses are named class sets for the {md.<element>} placeholders used in MarkdownTags insertions,
+	// pick one with Markdown(data, "compact") or {{markdown .Body "compact"}}. Missing elements fall back to "default".
+	MarkdownClasses = map[string]MarkdownClassSet{
+		"default": {
+			"p":          "leading-5 [&:not(:first-child)]:mt-5",
+			"h1":         "scroll-m-20 text-center text-4xl font-extrabold tracking-tight text-balance mt-6 first:mt-0",
+			"h2":         "scroll-m-20 border-b pb-2 text-3xl font-semibold tracking-tight mt-6 first:mt-0",
+			"h3":         "scroll-m-20 text-2xl font-semibold tracking-tight mt-5 first:mt-0",
+			"h4":         "scroll-m-20 text-xl font-semibold tracking-tight mt-5 first:mt-0",
+			"blockquote": "mt-5 border-l-2 pl-2 italic",
+			"code":       "bg-muted relative rounded px-[0.3rem] py-[0.2rem] font-mono font-semibold",
+			"codeblock":  "bg-muted relative rounded mt-5 first:mt-0 w-full max-w-full",
+			"pre":        "font-mono text-xs sm:text-sm p-2 sm:p-4 overflow-x-auto whitespace-pre-wrap break-words",
+			"a":          "font-medium text-primary underline underline-offset-4",
+			"tablewrap":  "my-5 first:mt-0 w-full overflow-y-auto",
+			"table":      "w-full",
+			"tr":         "m-0 border-t p-0 even:bg-muted",
+			"th":         "border px-4 py-2 font-bold",
+			"td":         "border px-4 py-2",
+			"ul":         "my-5 first:mt-0 ml-6 list-disc [&>li]:mt-2 [&_ul]:my-2",
+			"ol":         "my-5 first:mt-0 ml-6 list-decimal [&>li]:mt-2 [&_ol]:my-2",
+			"li":         "leading-5",
+			"task":       "leading-5 list-none -ml-6",
+			"hr":         "my-6 border-t",
+			"sup":        "text-xs",
+			"footnotes":  "mt-8 border-t pt-4 text-sm",
+			"checkbox":   "size-4 align-middle mr-2 accent-primary",
+		},
+		"compact": {
+			"p":          "leading-5 [&:not(:first-child)]:mt-2",
+			"h1":         "text-2xl font-bold tracking-tight mt-3 first:mt-0",
+			"h2":         "text-xl font-semibold tracking-tight mt-3 first:mt-0",
+			"h3":         "text-lg font-semibold tracking-tight mt-2 first:mt-0",
+			"h4":         "font-semibold mt-2 first:mt-0",
+			"blockquote": "mt-2 border-l-2 pl-2 italic",
+			"codeblock":  "bg-muted relative rounded mt-2 first:mt-0 w-full max-w-full",
+			"pre":        "font-mono text-xs p-2 overflow-x-auto whitespace-pre-wrap break-words",
+			"tablewrap":  "my-2 first:mt-0 w-full overflow-y-auto",
+			"th":         "border px-2 py-1 font-bold",
+			"td":         "border px-2 py-1",
+			"ul":         "my-2 first:mt-0 ml-5 list-disc [&>li]:mt-1 [&_ul]:my-1",
+			"ol":         "my-2 first:mt-0 ml-5 list-decimal [&>li]:mt-1 [&_ol]:my-1",
+			"task":       "leading-5 list-none -ml-5",
+			"hr":         "my-3 border-t",
+			"footnotes":  "mt-4 border-t pt-2 text-xs",
+			"checkbox":   "size-3.5 align-middle mr-1.5 accent-primary",
+		},
+	}
+
+	// MarkdownLinkRewrite, if set, rewrites every link href before rendering, e.g. MarkdownRewriteLinks("/docs").
+	// source is MarkdownOptions.Source of the rendered document.
+	MarkdownLinkRewrite func(href string, source string) string
+
+	// MarkdownCodeHighlighter, if set, renders fenced code blocks in place of the default <pre><code>, e.g. with chroma,
+	// so pages ship pre-highlighted. lang is the fence hint (may be empty), code is raw; errors fall back to plain code.
+	MarkdownCodeHighlighter func(lang string, code string) (template.HTML, error)
+
+	// MarkdownSlugify makes heading ids: lowercase, spaces to hyphens, punctuation stripped ("Hello, World!" is
+	// "hello-world"), so headings could be deep-linked: /docs#hello-world.
+	MarkdownSlugify = func(text string) string {
+		slug := strings.Builder{}
+		for _, rn := range strings.ToLower(strings.TrimSpace(text)) {
+			switch {
+			case unicode.IsLetter(rn) || unicode.IsDigit(rn) || rn == '-':
+				slug.WriteRune(rn)
+			case unicode.IsSpace(rn):
+				slug.WriteRune('-')
+			}
+		}
+		return slug.String()
+	}
+)
+
+// MarkdownRewriteLinks makes a MarkdownLinkRewrite for cross-linked markdown docs: internal links drop
+// the .md extension (and index) and relative ones are resolved against the directory of the source document
+// under basePath, so ./other.md of guide/setup.md becomes basePath/guide/other.
+// External urls (with a scheme or //host), anchors and absolute paths outside of markdown are left untouched.
+func MarkdownRewriteLinks(basePath string) func(href string, source string) string {
+	return func(href string, source string) string {
+		link, err := url.Parse(href)
+		if err != nil || link.Scheme != "" || link.Host != "" || link.Path == "" {
+			return href
+		}
+		if !strings.HasSuffix(link.Path, ".md") {
+			return href
+		}
+
+		link.Path = strings.TrimSuffix(link.Path, ".md")
+		if path.Base(link.Path) == "index" {
+			link.Path = strings.TrimSuffix(link.Path, "index")
+		}
+		if !strings.HasPrefix(link.Path, "/") {
+			link.Path = path.Join("/", basePath, path.Join("/", path.Dir(source), link.Path)) // Never above basePath.
+		}
+		if len(link.Path) > 1 {
+			link.Path = strings.TrimSuffix(link.Path, "/")
+		}
+		return link.String()
+	}
+}
+
+func defaultMarkdownTags() []MarkdownTag {
+	return []MarkdownTag{
 		&MarkdownTagCode{
 			Transformations: map[string]*template.Template{
 				"default": template.Must(template.New("code").
-					Funcs(map[string]any{"transform": func(data template.HTML) template.HTML {
-						from, to := strings.Index(string(data), "\n"), strings.LastIndex(string(data), "\n")
-						if from == to {
-							return ""
-						}
-						return template.HTML(template.HTMLEscapeString(string(data)[from+1 : to]))
-					}}).
-					Parse(`<div class="bg-muted relative rounded mt-5 first:mt-0 w-full max-w-full"><pre class="font-mono text-xs sm:text-sm p-2 sm:p-4 overflow-x-auto whitespace-pre-wrap break-words"><code>{{transform .Children}}</code></pre></div>`),
+					Funcs(map[string]any{
+						"transform": func(data template.HTML) template.HTML {
+							return template.HTML(template.HTMLEscapeString(markdownCodeBody(string(data))))
+						},
+						"highlight": markdownHighlight,
+					}).
+					Parse(`<div class="{md.codeblock}">{{with highlight .Lang .Children}}{{.}}{{else}}` +
+						`<pre class="{md.pre}"><code{{with .Lang}} class="language-{{.}}"{{end}}>{{transform .Children}}</code></pre>` +
+						`{{end}}</div>`),
 				),
 			},
 		},
+		&MarkdownTagTable{},
+		&MarkdownTagList{},
+		&MarkdownTagRule{},
+		&MarkdownTagHeading{},
+		&MarkdownTagLineBreak{},
+		&MarkdownTagFootnote{},
 		// TODO: sanitize `<script> console.log("example") </script>`
 		&MarkdownGenericTag{
 			Triggers:  []string{"`"},
-			Insertion: []string{`<code class="bg-muted relative rounded px-[0.3rem] py-[0.2rem] font-mono font-semibold">`, "</code>"},
-		},
-		&MarkdownGenericTag{
-			Triggers:        []string{"#### "},
-			OnNewline:       true,
-			TriggersClosing: []string{"\n"},
-			Insertion:       []string{`<h4 class="scroll-m-20 text-xl font-semibold tracking-tight mt-5 first:mt-0">`, "</h2>\n"},
-			Window:          []rune{'\n'},
-		},
-		&MarkdownGenericTag{
-			Triggers:        []string{"### "},
-			OnNewline:       true,
-			TriggersClosing: []string{"\n"},
-			Insertion:       []string{`<h3 class="scroll-m-20 text-2xl font-semibold tracking-tight mt-5 first:mt-0">`, "</h2>\n"},
-			Window:          []rune{'\n'},
-		},
-		&MarkdownGenericTag{
-			Triggers:        []string{"## "},
-			OnNewline:       true,
-			TriggersClosing: []string{"\n"},
-			Insertion:       []string{`<h2 class="scroll-m-20 border-b pb-2 text-3xl font-semibold tracking-tight mt-6 first:mt-0">`, "</h2>\n"},
-			Window:          []rune{'\n'},
-		},
-		&MarkdownGenericTag{
-			Triggers:        []string{"# "},
-			OnNewline:       true,
-			TriggersClosing: []string{"\n"},
-			Insertion:       []string{`<h1 class="scroll-m-20 text-center text-4xl font-extrabold tracking-tight text-balance mt-6 first:mt-0">`, "</h1>\n"},
-			Window:          []rune{'\n'},
+			Insertion: []string{`<code class="{md.code}">`, "</code>"},
+			Verbatim:  true,
 		},
 		&MarkdownGenericTag{
 			Triggers:        []string{"> "},
 			OnNewline:       true,
 			TriggersClosing: []string{"\n"},
-			Insertion:       []string{`<blockquote class="mt-5 border-l-2 pl-2 italic">`, "</blockquote>\n"},
+			Insertion:       []string{`<blockquote class="{md.blockquote}">`, "</blockquote>\n"},
 			Window:          []rune{'\n'},
 		},
 		&MarkdownTagLink{},
+		&MarkdownTagAutolink{}, // After code spans and links, so it doesn't take their text for a url.
+		&MarkdownGenericTag{
+			Triggers:  []string{"~~"},
+			Insertion: []string{"<del>", "</del>"},
+		},
 		&MarkdownGenericTag{
 			Triggers:  []string{"***", "___"},
 			Insertion: []string{"<b><i>", "</i></b>"},
@@ -81,40 +179,303 @@ var (
 			Insertion: []string{"<i>", "</i>"},
 		},
 	}
+}
 
-	MarkdownTagParagraph = []string{`<p class="leading-5 [&:not(:first-child)]:mt-5">`, `</p>`}
+// MarkdownClassSet maps elements (e.g. "p", "h1") to their class attribute.
+type MarkdownClassSet map[string]string
 
-	markdownLock = sync.Mutex{}
-)
+func markdownClassReplacer(profile string) (*strings.Replacer, error) {
+	classes, ok := MarkdownClasses[profile]
+	if !ok {
+		return nil, fmt.Errorf("markdown: unknown class profile %q", profile)
+	}
+	oldnew := []string{}
+	for element, class := range MarkdownClasses["default"] {
+		if override, ok := classes[element]; ok {
+			class = override
+		}
+		oldnew = append(oldnew, "{md."+element+"}", class)
+	}
+	for element, class := range classes {
+		if _, ok := MarkdownClasses["default"][element]; !ok {
+			oldnew = append(oldnew, "{md."+element+"}", class)
+		}
+	}
+	return strings.NewReplacer(oldnew...), nil
+}
+
+// Markdown renders data to HTML, it's also the `markdown` template func: {{markdown .Body}}.
+// The optional profile selects MarkdownClasses (default is "default").
+// Every call renders with its own clones of MarkdownTags, so it's safe to use from concurrently executed templates.
+func Markdown(data string, profile ...string) (template.HTML, error) {
+	return MarkdownWith(data, MarkdownOptions{Profile: def(profile, "default")})
+}
+
+// MarkdownText renders data to plain text, e.g. for search indexes: one line per heading, paragraph line, list
+// item ("- " or "1. ", indented when nested) or table row, links and images become their label (alt), code its text.
+func MarkdownText(data string) (string, error) {
+	rendered, err := MarkdownWith(data, MarkdownOptions{})
+	if err != nil {
+		return "", err
+	}
 
-func Markdown(data string) (template.HTML, error) {
-	markdownLock.Lock()
-	defer markdownLock.Unlock()
+	text := strings.Builder{}
+	lists := []int{} // Item counters of open lists, -1 for <ul>.
+	skipText, firstCell := false, false
+	cell := (*strings.Builder)(nil) // Text of the current table cell, trimmed once it's closed.
+	tokenizer := html.NewTokenizer(strings.NewReader(string(rendered)))
+	for {
+		token := tokenizer.Next()
+		if token == html.ErrorToken {
+			break
+		}
+		name, _ := tokenizer.TagName()
+		attrs := map[string]string{}
+		for hasMore := true; hasMore && (token == html.StartTagToken || token == html.SelfClosingTagToken); {
+			var key, value []byte
+			key, value, hasMore = tokenizer.TagAttr()
+			attrs[string(key)] = string(value)
+		}
+
+		switch tag := string(name); {
+		case token == html.TextToken && !skipText && cell != nil:
+			cell.Write(tokenizer.Text())
+		case token == html.TextToken && !skipText:
+			text.Write(tokenizer.Text())
+		case token == html.StartTagToken && tag == "a" && strings.HasPrefix(attrs["href"], "#fnref-"):
+			skipText = true // Footnote back links.
+		case token == html.EndTagToken && tag == "a":
+			skipText = false
+		case token == html.StartTagToken && (tag == "ul" || tag == "ol"):
+			counter := -1
+			if tag == "ol" {
+				counter, _ = strconv.Atoi(cmp.Or(attrs["start"], "1"))
+			}
+			lists = append(lists, counter)
+		case token == html.EndTagToken && (tag == "ul" || tag == "ol") && len(lists) > 0:
+			lists = lists[:len(lists)-1]
+		case token == html.StartTagToken && tag == "li" && len(lists) > 0:
+			text.WriteString("\n" + strings.Repeat("  ", len(lists)-1))
+			if counter := &lists[len(lists)-1]; *counter >= 0 {
+				text.WriteString(strconv.Itoa(*counter) + ". ")
+				*counter++
+			} else {
+				text.WriteString("- ")
+			}
+		case token == html.StartTagToken && tag == "input" || token == html.SelfClosingTagToken && tag == "input":
+			if _, checked := attrs["checked"]; checked {
+				text.WriteString("[x] ")
+			} else {
+				text.WriteString("[ ] ")
+			}
+		case (token == html.StartTagToken || token == html.SelfClosingTagToken) && tag == "img":
+			text.WriteString(attrs["alt"])
+		case token == html.StartTagToken && tag == "tr":
+			text.WriteString("\n")
+			firstCell = true
+		case token == html.StartTagToken && (tag == "td" || tag == "th"):
+			if !firstCell {
+				text.WriteString(" | ")
+			}
+			firstCell, cell = false, &strings.Builder{}
+		case token == html.EndTagToken && (tag == "td" || tag == "th") && cell != nil:
+			text.WriteString(strings.TrimSpace(cell.String()))
+			cell = nil
+		case token == html.StartTagToken && tag == "sup":
+			text.WriteString("[")
+		case token == html.EndTagToken && tag == "sup":
+			text.WriteString("]")
+		case slices.Contains([]string{"p", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre", "div", "br", "hr", "section"}, tag):
+			text.WriteString("\n")
+		}
+	}
+
+	lines := []string{}
+	for line := range strings.SplitSeq(text.String(), "\n") {
+		if line = strings.TrimRightFunc(line, unicode.IsSpace); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// MarkdownFrontMatter splits the leading front matter off a markdown document: YAML between "---" lines or TOML
+// between "+++" lines, starting at the very first line (CRLF is fine). Flat key: value (key = value for TOML) pairs
+// are parsed, with quotes around values dropped. Without a (closed) front matter meta is empty and body is data.
+func MarkdownFrontMatter(data string) (meta map[string]string, body string) {
+	meta = map[string]string{}
+	first, rest, _ := strings.Cut(strings.TrimPrefix(data, "\ufeff"), "\n")
+	fence := strings.TrimRight(first, "\r")
+	separator := map[string]string{"---": ":", "+++": "="}[fence]
+	if separator == "" {
+		return meta, data
+	}
+
+	for rest != "" {
+		var line string
+		line, rest, _ = strings.Cut(rest, "\n")
+		line = strings.TrimRight(line, "\r")
+		if line == fence {
+			return meta, rest
+		}
+		key, value, ok := strings.Cut(line, separator)
+		if key = strings.TrimSpace(key); !ok || key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			value = unquoted
+		} else if len(value) > 1 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		meta[key] = value
+	}
+	return map[string]string{}, data
+}
+
+// MarkdownOptions tune a single MarkdownWith call, the zero value renders as Markdown does.
+type MarkdownOptions struct {
+	// Profile selects MarkdownClasses, "default" if empty.
+	Profile string
+	// EscapeHTML escapes raw HTML (<script>, <img onerror=...>) of the source, e.g. for user-provided markdown.
+	// Links and images other than relative, http, https or mailto render as text. Code is escaped regardless.
+	EscapeHTML bool
+	// DisableLinks renders [text](url) links as their text and leaves bare urls as is, images are kept.
+	DisableLinks bool
+	// Tags replace MarkdownTags, they're cloned for the call too.
+	Tags []MarkdownTag
+	// SmartTypography curls quotes, and makes --- an em dash, -- an en dash, ... an ellipsis. Code is left as is.
+	SmartTypography bool
+	// Source is the path of the rendered document, e.g. guide/setup.md, it's passed to MarkdownLinkRewrite.
+	Source string
+}
+
+var markdownEscapeHTML = strings.NewReplacer("<", "&lt;", ">", "&gt;")
+
+// markdownHidePlaceholders keeps {md.<element>} of the source (e.g. in code) from being taken for a class placeholder
+// of the insertions: its brace is a private use rune until the classes are resolved.
+var markdownHidePlaceholders = strings.NewReplacer("{md.", "\uE000md.")
+
+// MarkdownWith is Markdown with options, e.g. MarkdownWith(comment, MarkdownOptions{EscapeHTML: true}) for untrusted input.
+func MarkdownWith(data string, opts MarkdownOptions) (template.HTML, error) {
+	classes, err := markdownClassReplacer(cmp.Or(opts.Profile, "default"))
+	if err != nil {
+		return "", err
+	}
 	if !strings.HasSuffix(data, "\n") {
 		data += "\n"
 	}
+	data = markdownHidePlaceholders.Replace(data)
 
 	actions := make([][]MarkdownTagAction, len(data))
 	skip := make([]bool, len(data))
+	verbatim := make([]bool, len(data))
 	paragraphs := make([]bool, len(data))
 
-	if err := markdownApplyTags(data, skip, actions, paragraphs); err != nil {
+	source := opts.Tags
+	if source == nil {
+		source = MarkdownTags
+	}
+	tags := make([]MarkdownTag, 0, len(source))
+	for _, tag := range source {
+		switch clone := markdownCloneTag(tag).(type) {
+		case *MarkdownTagAutolink:
+			if !opts.DisableLinks {
+				tags = append(tags, clone)
+			}
+		case *MarkdownTagLink:
+			clone.escape, clone.textOnly, clone.bang, clone.source = opts.EscapeHTML, opts.DisableLinks, -1, opts.Source
+			tags = append(tags, clone)
+		case *MarkdownTagFootnote:
+			clone.escape = opts.EscapeHTML
+			tags = append(tags, clone)
+		default:
+			tags = append(tags, clone)
+		}
+	}
+	if err := markdownApplyTags(tags, data, skip, verbatim, actions, paragraphs); err != nil {
 		return "", err
 	}
 	markdownApplyParagraphs(actions, paragraphs, data)
 
 	result := []rune{}
+	text := []rune{} // Source runes since the last insertion, for SmartTypography.
+	inCode, prev := false, ' '
+	flush := func() {
+		if opts.SmartTypography && !inCode {
+			text, prev = markdownSmartTypography(text, prev)
+		}
+		result = append(result, text...)
+		text = text[:0]
+	}
 	for i, rn := range data {
 		slices.SortStableFunc(actions[i], func(a, b MarkdownTagAction) int { return -cmp.Compare(a.Index, b.Index) })
+		if len(actions[i]) > 0 {
+			flush()
+		}
 		for _, action := range actions[i] {
-			result = append(result, []rune(action.Insertion)...)
+			insertion := classes.Replace(action.Insertion)
+			result = append(result, []rune(insertion)...)
+			if open, closed := strings.LastIndex(insertion, "<code"), strings.LastIndex(insertion, "</code>"); open > closed {
+				inCode = true
+			} else if closed != -1 {
+				inCode = false
+			}
+			if !strings.HasPrefix(insertion, "</") {
+				prev = ' '
+			}
 		}
 
-		if !skip[i] {
-			result = append(result, rn)
+		switch {
+		case skip[i]:
+		case opts.EscapeHTML && rn == '<':
+			text = append(text, []rune("&lt;")...)
+		case opts.EscapeHTML && rn == '>':
+			text = append(text, []rune("&gt;")...)
+		default:
+			text = append(text, rn)
 		}
 	}
-	return template.HTML(fmt.Sprintf("<div>\n%s\n</div>", string(result))), nil
+	flush()
+	html := strings.ReplaceAll(string(result), "\uE000md.", "{md.")
+	return template.HTML(fmt.Sprintf("<div>\n%s\n</div>", html)), nil
+}
+
+// markdownSmartTypography curls quotes ("a" to “a”, it's to it’s), and replaces --- with —, -- with – and ... with …
+// in text, which follows the prev rune. Raw html tags (<a href="...">) are left as is.
+func markdownSmartTypography(text []rune, prev rune) ([]rune, rune) {
+	result := make([]rune, 0, len(text))
+	opening := func() bool { return unicode.IsSpace(prev) || strings.ContainsRune("([{“‘—–", prev) }
+	inTag := false
+	for i := 0; i < len(text); i++ {
+		rn := text[i]
+		switch {
+		case inTag:
+			inTag = rn != '>'
+		case rn == '<':
+			inTag = true
+		case rn == '-' && i+2 < len(text) && text[i+1] == '-' && text[i+2] == '-':
+			rn = '—'
+			i += 2
+		case rn == '-' && i+1 < len(text) && text[i+1] == '-':
+			rn = '–'
+			i++
+		case rn == '.' && i+2 < len(text) && text[i+1] == '.' && text[i+2] == '.':
+			rn = '…'
+			i += 2
+		case rn == '"' && opening():
+			rn = '“'
+		case rn == '"':
+			rn = '”'
+		case rn == '\'' && opening():
+			rn = '‘'
+		case rn == '\'':
+			rn = '’'
+		}
+		result = append(result, rn)
+		prev = rn
+	}
+	return result, prev
 }
 
 type MarkdownTagAction struct {
@@ -124,17 +485,84 @@ type MarkdownTagAction struct {
 	Range          []int
 	IsNewBlock     bool
 	Sanitize       bool
+	// Lang and Attrs are passed to the Transformation, see MarkdownTransformData.
+	Lang  string
+	Attrs map[string]string
+	// BlockRange marks a block (e.g. a table) which must not be wrapped into a paragraph, without skipping it.
+	BlockRange []int
+	// TextRange is rendered as is, later tags skip it (e.g. the body of a code span).
+	TextRange []int
+}
+
+// MarkdownTransformData is the data of MarkdownTagAction.Transformation templates, e.g. for
+// ```go {highlight:2-4 title="main.go"} a code block gets Lang "go" and Attrs {"highlight": "2-4", "title": "main.go"}.
+type MarkdownTransformData struct {
+	Children template.HTML
+	Lang     string
+	Attrs    map[string]string
 }
 
+// MarkdownError is a failed Transformation of Markdown, Line and Column (1-based, in runes) locate the transformed
+// source, e.g. the opening fence of a code block.
+type MarkdownError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func newMarkdownError(data string, index int, err error) MarkdownError {
+	before := data[:index]
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return MarkdownError{
+		Line:   strings.Count(before, "\n") + 1,
+		Column: utf8.RuneCountInString(before[lineStart:]) + 1,
+		Err:    err,
+	}
+}
+
+func (err MarkdownError) Error() string {
+	return fmt.Sprintf("markdown %d:%d: %v", err.Line, err.Column, err.Err)
+}
+
+func (err MarkdownError) Unwrap() error { return err.Err }
+
 type MarkdownTag interface {
 	Next(index int, rn rune) []MarkdownTagAction
 }
 
+// MarkdownTagCloner is implemented by tags which need more than a shallow copy (e.g. slices they append to)
+// to get a fresh state, see markdownCloneTag. Configured MarkdownTags are never run, only their clones are.
+type MarkdownTagCloner interface {
+	Clone() MarkdownTag
+}
+
+// markdownCloneTag copies a tag for a single Markdown call, pointers to structs are shallow copied
+// (the configured tag is never run, so its state is zero), anything else is assumed to be stateless.
+func markdownCloneTag(tag MarkdownTag) MarkdownTag {
+	if cloner, ok := tag.(MarkdownTagCloner); ok {
+		return cloner.Clone()
+	}
+	value := reflect.ValueOf(tag)
+	if value.Kind() != reflect.Pointer || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return tag
+	}
+	clone := reflect.New(value.Elem().Type())
+	clone.Elem().Set(value.Elem())
+	return clone.Interface().(MarkdownTag)
+}
+
+// MarkdownTagFinisher is implemented by tags which need the end of the document, e.g. to close a table
+// on the last line, Finish is called after the last Next with index = len(data). It should also reset the tag.
+type MarkdownTagFinisher interface {
+	Finish(index int) []MarkdownTagAction
+}
+
 type MarkdownGenericTag struct {
 	Triggers        []string
 	TriggersClosing []string
 	OnNewline       bool
 	DisableSkip     bool
+	Verbatim        bool // The content is kept as text, later tags skip it.
 	Transformation  *template.Template
 	Insertion       []string
 	Window          []rune
@@ -147,6 +575,12 @@ type MarkdownGenericTag struct {
 	oldline     bool
 }
 
+func (tag *MarkdownGenericTag) Clone() MarkdownTag {
+	clone := *tag
+	clone.Window = slices.Clone(tag.Window)
+	return &clone
+}
+
 func (tag *MarkdownGenericTag) Next(index int, rn rune) []MarkdownTagAction {
 	if len(tag.TriggersClosing) == 0 {
 		tag.TriggersClosing = tag.Triggers
@@ -201,6 +635,7 @@ func (tag *MarkdownGenericTag) Next(index int, rn rune) []MarkdownTagAction {
 				Insertion:  tag.Insertion[1],
 				Range:      []int{index + 1 - len(smallerWindow), index + 1},
 				IsNewBlock: tag.OnNewline,
+				TextRange:  tag.textRange(index + 1 - len(smallerWindow)),
 			},
 		}
 	}
@@ -208,11 +643,20 @@ func (tag *MarkdownGenericTag) Next(index int, rn rune) []MarkdownTagAction {
 	return nil
 }
 
+func (tag *MarkdownGenericTag) textRange(end int) []int {
+	if !tag.Verbatim {
+		return nil
+	}
+	return []int{tag.openedIndex + len(tag.openedWith), end}
+}
+
 type MarkdownTagCode struct {
 	Transformations map[string]*template.Template
 	state           string
 	window          []rune
 	hint            []rune
+	fence           int    // Backticks of the opening fence, the closing one must be at least as long.
+	line            []rune // The current line of the body, a closing fence must be alone on it.
 	start           int
 }
 
@@ -231,34 +675,807 @@ func (tag *MarkdownTagCode) Next(index int, rn rune) []MarkdownTagAction {
 		if window == "```" {
 			tag.state = "hint"
 			tag.start = index - 2
+			tag.fence = 3
 		}
 	case "hint":
 		if rn == '\n' {
 			tag.state = "body"
+			tag.line = tag.line[:0]
+			return nil
+		}
+		if rn == '`' && len(tag.hint) == 0 {
+			tag.fence++
 			return nil
 		}
 		tag.hint = append(tag.hint, rn)
 	case "body":
-		if window != "```" {
+		if rn != '\n' {
+			tag.line = append(tag.line, rn)
+			return nil
+		}
+		if tag.isClosing() {
+			return tag.block(index)
+		}
+		tag.line = tag.line[:0]
+	}
+	return nil
+}
+
+// isClosing reports whether the current line is a closing fence, e.g. "```  " or "````" after "````".
+// Anything else on the line, "``` x" or a shorter fence, is code.
+func (tag *MarkdownTagCode) isClosing() bool {
+	line := strings.TrimSpace(string(tag.line))
+	return len(line) >= tag.fence && strings.Trim(line, "`") == ""
+}
+
+// Finish treats the rest of the document as code if the last block isn't closed, rather than as markdown.
+func (tag *MarkdownTagCode) Finish(index int) []MarkdownTagAction {
+	if tag.state != "body" {
+		return nil
+	}
+	return tag.block(index)
+}
+
+// block is the code block from the opening fence up to end (exclusive, the newline after the closing fence).
+func (tag *MarkdownTagCode) block(end int) []MarkdownTagAction {
+	tag.state = "new"
+	lang, attrs := markdownParseInfo(string(tag.hint))
+	transformation := tag.Transformations["default"]
+	if specific, ok := tag.Transformations[lang]; ok {
+		transformation = specific
+	}
+	return []MarkdownTagAction{{
+		Index:          tag.start,
+		Range:          []int{tag.start, end},
+		Transformation: transformation,
+		IsNewBlock:     true,
+		Lang:           lang,
+		Attrs:          attrs,
+	}}
+}
+
+// markdownCodeBody strips the fence lines of a code block.
+func markdownCodeBody(data string) string {
+	from, to := strings.Index(data, "\n"), strings.LastIndex(data, "\n")
+	if from == to {
+		return ""
+	}
+	return data[from+1 : to]
+}
+
+// markdownHighlight is MarkdownCodeHighlighter's output, empty (the plain <pre><code> rendering) if it's unset or fails.
+func markdownHighlight(lang string, data template.HTML) template.HTML {
+	if MarkdownCodeHighlighter == nil {
+		return ""
+	}
+	html, err := MarkdownCodeHighlighter(lang, markdownCodeBody(string(data)))
+	if err != nil {
+		Log.Warn("markdown: code highlighter failed, rendering plain code", "lang", lang, "err", err)
+		return ""
+	}
+	return html
+}
+
+// markdownParseInfo splits a fenced code block info string into the language and attributes,
+// attributes are key:value or key=value pairs (values may be quoted), optionally wrapped in braces.
+func markdownParseInfo(info string) (lang string, attrs map[string]string) {
+	info = strings.TrimSpace(info)
+	lang, rest, _ := strings.Cut(info, " ")
+	if strings.HasPrefix(lang, "{") {
+		lang, rest = "", info
+	}
+	rest = strings.TrimSpace(rest)
+	rest = strings.TrimSuffix(strings.TrimPrefix(rest, "{"), "}")
+
+	attrs = map[string]string{}
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " \t,")
+		end := strings.IndexAny(rest, ":= \t,")
+		if end == -1 {
+			end = len(rest)
+		}
+		key := rest[:end]
+		rest = rest[end:]
+		if key == "" {
 			break
 		}
-		tag.state = "new"
-		transformation := tag.Transformations["default"]
-		if specific, ok := tag.Transformations[string(tag.hint)]; ok {
-			transformation = specific
+		if rest == "" || (rest[0] != ':' && rest[0] != '=') {
+			attrs[key] = "true"
+			continue
 		}
-		return []MarkdownTagAction{{
-			Index:          tag.start,
-			Range:          []int{tag.start, index + 1},
-			Transformation: transformation,
-			IsNewBlock:     true,
-		}}
+
+		rest = rest[1:]
+		value := ""
+		if quoted, err := strconv.QuotedPrefix(rest); err == nil {
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			end := strings.IndexAny(rest, " \t,")
+			if end == -1 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		attrs[key] = value
 	}
+	return lang, attrs
+}
+
+// MarkdownTagTable renders GitHub-style tables: a header row, a |---|:---:|---:| separator line and body rows.
+// Alignment hints become text-left/center/right classes, missing cells are padded, and \| doesn't split cells.
+type MarkdownTagTable struct {
+	lines   markdownLines
+	header  *markdownTableRow
+	aligns  []string
+	open    bool
+	start   int
+	lastEnd int
+}
+
+// markdownLines assembles lines for line based tags (tables, lists), runes taken by other tags (e.g. code blocks)
+// end the current line, reported as a gap.
+type markdownLines struct {
+	line  strings.Builder
+	start int
+	next  int
+}
+
+func (lines *markdownLines) Next(index int, rn rune) (line string, start int, gap bool, ok bool) {
+	if index != lines.next && lines.line.Len() > 0 {
+		lines.line.Reset()
+		gap = true
+	}
+	lines.next = index + utf8.RuneLen(rn)
+	if lines.line.Len() == 0 {
+		lines.start = index
+	}
+	lines.line.WriteRune(rn)
+	if rn != '\n' {
+		return "", 0, gap, false
+	}
+	line = lines.line.String()
+	lines.line.Reset()
+	return line, lines.start, gap, true
+}
+
+func (lines *markdownLines) Reset() {
+	lines.line.Reset()
+	lines.next = 0
+}
+
+type markdownTableRow struct {
+	start   int
+	end     int // Index of the trailing '\n'.
+	cells   [][2]int
+	pipes   []int
+	escapes []int
+}
+
+var markdownTableSeparator = regexp.MustCompile(`^:?-+:?$`)
+
+func (tag *MarkdownTagTable) Next(index int, rn rune) []MarkdownTagAction {
+	var result []MarkdownTagAction
+	line, lineStart, gap, ok := tag.lines.Next(index, rn)
+	if gap {
+		result = tag.close()
+	}
+	if !ok {
+		return result
+	}
+
+	row, isRow := markdownParseTableRow(line, lineStart)
+	switch {
+	case tag.open && isRow:
+		result = append(result, tag.row(row, "td")...)
+		tag.lastEnd = row.end
+	case tag.open:
+		result = append(result, tag.close()...)
+	case tag.header != nil && isRow && tag.isSeparator(line, row):
+		result = append(result, MarkdownTagAction{
+			Index:     tag.header.start,
+			Insertion: `<div class="{md.tablewrap}"><table class="{md.table}"><thead>`,
+		})
+		result = append(result, tag.row(*tag.header, "th")...)
+		result = append(result,
+			MarkdownTagAction{Index: tag.header.end, Insertion: "</thead><tbody>"},
+			MarkdownTagAction{Index: row.start, Range: []int{row.start, row.end + 1}},
+		)
+		tag.open, tag.start, tag.lastEnd, tag.header = true, tag.header.start, row.end, nil
+	case isRow:
+		tag.header = &row
+	default:
+		tag.header = nil
+	}
+	return result
+}
+
+func (tag *MarkdownTagTable) Finish(index int) []MarkdownTagAction {
+	tag.lines.Reset()
+	return tag.close()
+}
+
+func (tag *MarkdownTagTable) close() []MarkdownTagAction {
+	tag.header = nil
+	if !tag.open {
+		return nil
+	}
+	tag.open = false
+	return []MarkdownTagAction{{
+		Index:      tag.lastEnd,
+		Insertion:  "</tbody></table></div>",
+		BlockRange: []int{tag.start, tag.lastEnd + 1},
+	}}
+}
+
+func (tag *MarkdownTagTable) isSeparator(line string, row markdownTableRow) bool {
+	if len(row.cells) != len(tag.header.cells) {
+		return false
+	}
+	aligns := make([]string, 0, len(row.cells))
+	for _, cell := range row.cells {
+		hint := strings.TrimSpace(line[cell[0]-row.start : cell[1]-row.start])
+		if !markdownTableSeparator.MatchString(hint) {
+			return false
+		}
+		switch left, right := strings.HasPrefix(hint, ":"), strings.HasSuffix(hint, ":"); {
+		case left && right:
+			aligns = append(aligns, " text-center")
+		case right:
+			aligns = append(aligns, " text-right")
+		case left:
+			aligns = append(aligns, " text-left")
+		default:
+			aligns = append(aligns, "")
+		}
+	}
+	tag.aligns = aligns
+	return true
+}
+
+func (tag *MarkdownTagTable) row(row markdownTableRow, cell string) []MarkdownTagAction {
+	result := []MarkdownTagAction{{Index: row.start, Insertion: `<tr class="{md.tr}">`}}
+	for _, index := range slices.Concat(row.pipes, row.escapes) {
+		result = append(result, MarkdownTagAction{Index: index, Range: []int{index, index + 1}})
+	}
+	for i := range max(len(row.cells), len(tag.aligns)) {
+		align := ""
+		if i < len(tag.aligns) {
+			align = tag.aligns[i]
+		}
+		from, to := row.end, row.end
+		if i < len(row.cells) {
+			from, to = row.cells[i][0], row.cells[i][1]
+		}
+		result = append(result,
+			MarkdownTagAction{Index: from, Insertion: fmt.Sprintf(`<%s class="{md.%s}%s">`, cell, cell, align)},
+			MarkdownTagAction{Index: to, Insertion: fmt.Sprintf("</%s>", cell)},
+		)
+	}
+	return append(result, MarkdownTagAction{Index: row.end, Insertion: "</tr>"})
+}
+
+// markdownParseTableRow splits a line (starting at offset, ending with '\n') by unescaped pipes, isRow is false
+// if there are none. Leading and trailing pipes are optional.
+func markdownParseTableRow(line string, offset int) (row markdownTableRow, isRow bool) {
+	row = markdownTableRow{start: offset, end: offset + len(line) - 1}
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			row.escapes = append(row.escapes, offset+i)
+			i++
+		case line[i] == '|':
+			row.pipes = append(row.pipes, offset+i)
+		}
+	}
+	if len(row.pipes) == 0 {
+		return row, false
+	}
+
+	trimmed := strings.TrimSpace(line)
+	bounds := slices.Concat([]int{offset - 1}, row.pipes, []int{row.end})
+	for i := 1; i < len(bounds); i++ {
+		from, to := bounds[i-1]+1, bounds[i]
+		if i == 1 && strings.HasPrefix(trimmed, "|") {
+			continue
+		}
+		if i == len(bounds)-1 && strings.HasSuffix(trimmed, "|") {
+			continue
+		}
+		row.cells = append(row.cells, [2]int{from, to})
+	}
+	return row, true
+}
+
+// MarkdownTagRule renders a line of three or more "-", "*" or "_" (only) as <hr>, if it starts the document
+// or follows a blank line, so it's not confused with emphasis or "text\n---" headings. A "---" first line
+// closed by another "---" line is a front matter fence, and left untouched.
+type MarkdownTagRule struct {
+	lines       markdownLines
+	afterBlank  bool
+	frontMatter []MarkdownTagAction // The first line's rule, until it turns out to be a front matter fence.
+}
+
+func (tag *MarkdownTagRule) Next(index int, rn rune) []MarkdownTagAction {
+	line, lineStart, gap, ok := tag.lines.Next(index, rn)
+	if gap {
+		tag.afterBlank = false
+	}
+	if !ok {
+		return nil
+	}
+
+	afterBlank := tag.afterBlank || lineStart == 0
+	tag.afterBlank = strings.TrimSpace(line) == ""
+	rule := strings.TrimSpace(line)
+	if len(rule) < 3 || strings.Trim(rule, rule[:1]) != "" || !strings.Contains("-*_", rule[:1]) {
+		return nil
+	}
+
+	if rule == "---" && tag.frontMatter != nil {
+		tag.frontMatter = nil
+		return nil
+	}
+	if !afterBlank {
+		return nil
+	}
+	action := []MarkdownTagAction{{
+		Index:      lineStart,
+		Insertion:  `<hr class="{md.hr}">`,
+		Range:      []int{lineStart, lineStart + len(line) - 1},
+		BlockRange: []int{lineStart, lineStart + len(line)},
+	}}
+	if lineStart == 0 && rule == "---" {
+		tag.frontMatter = action
+		return nil
+	}
+	return action
+}
+
+func (tag *MarkdownTagRule) Finish(index int) []MarkdownTagAction {
+	result := tag.frontMatter
+	tag.lines.Reset()
+	tag.afterBlank, tag.frontMatter = false, nil
+	return result
+}
+
+// MarkdownTagHeading renders "# " to "#### " lines as <h1> to <h4>, with the MarkdownSlugify id of the text,
+// repeated ids within a document get "-1", "-2", ... suffixes.
+type MarkdownTagHeading struct {
+	lines markdownLines
+	slugs map[string]int
+}
+
+func (tag *MarkdownTagHeading) Next(index int, rn rune) []MarkdownTagAction {
+	line, lineStart, _, ok := tag.lines.Next(index, rn)
+	if !ok {
+		return nil
+	}
+	level := len(line) - len(strings.TrimLeft(line, "#"))
+	if level < 1 || level > 4 || line[level] != ' ' {
+		return nil
+	}
+
+	id := ""
+	if slug := MarkdownSlugify(line[level+1:]); slug != "" {
+		if tag.slugs == nil {
+			tag.slugs = map[string]int{}
+		}
+		if seen := tag.slugs[slug]; seen > 0 {
+			tag.slugs[slug]++
+			slug = fmt.Sprintf("%s-%d", slug, seen)
+		}
+		tag.slugs[slug]++
+		id = fmt.Sprintf(` id="%s"`, template.HTMLEscapeString(slug))
+	}
+	end := lineStart + len(line) - 1
+	return []MarkdownTagAction{
+		{
+			Index:      lineStart,
+			Insertion:  fmt.Sprintf(`<h%d%s class="{md.h%d}">`, level, id, level),
+			Range:      []int{lineStart, lineStart + level + 1},
+			IsNewBlock: true,
+		},
+		{
+			Index:      end,
+			Insertion:  fmt.Sprintf("</h%d>\n", level),
+			Range:      []int{end, end + 1},
+			IsNewBlock: true,
+		},
+	}
+}
+
+func (tag *MarkdownTagHeading) Finish(index int) []MarkdownTagAction {
+	tag.lines.Reset()
+	tag.slugs = nil
+	return nil
+}
+
+// MarkdownTagLineBreak renders a line ending with two spaces (or a backslash) as <br>, unless it's the last line
+// of a paragraph, i.e. followed by a blank line, a block (heading, list, etc.) or the end of the document.
+type MarkdownTagLineBreak struct {
+	lines   markdownLines
+	pending []MarkdownTagAction // Line break of the previous line, if the paragraph goes on.
+}
+
+func (tag *MarkdownTagLineBreak) Next(index int, rn rune) []MarkdownTagAction {
+	line, lineStart, gap, ok := tag.lines.Next(index, rn)
+	if gap {
+		tag.pending = nil
+	}
+	if !ok {
+		return nil
+	}
+
+	var result []MarkdownTagAction
+	if strings.TrimSpace(line) != "" {
+		result = tag.pending
+	}
+	tag.pending = nil
+
+	content := strings.TrimSuffix(line, "\n")
+	end := lineStart + len(content)
+	trailing := 0
+	switch {
+	case strings.TrimSpace(content) == "":
+	case strings.HasSuffix(content, "\\"):
+		trailing = 1
+	case strings.HasSuffix(content, "  "):
+		trailing = len(content) - len(strings.TrimRight(content, " "))
+	}
+	if trailing > 0 {
+		tag.pending = []MarkdownTagAction{{Index: end - trailing, Insertion: "<br>", Range: []int{end - trailing, end}}}
+	}
+	return result
+}
+
+func (tag *MarkdownTagLineBreak) Finish(index int) []MarkdownTagAction {
+	tag.lines.Reset()
+	tag.pending = nil
 	return nil
 }
 
+// MarkdownTagFootnote renders text[^1] references to "[^1]: definition" lines as superscript links to a footnotes
+// section at the end of the document, numbered in the order of references. References to undefined footnotes
+// are left as text, definition lines are taken out of the text (and their text is rendered as is, without markdown).
+type MarkdownTagFootnote struct {
+	lines    markdownLines
+	ref      strings.Builder
+	refStart int
+	next     int
+	refs     []markdownFootnote
+	defs     []markdownFootnote
+	escape   bool // See MarkdownOptions.EscapeHTML.
+}
+
+type markdownFootnote struct {
+	label string
+	text  string // Definitions only.
+	start int
+	end   int
+}
+
+func (tag *MarkdownTagFootnote) Next(index int, rn rune) []MarkdownTagAction {
+	gap := index != tag.next
+	tag.next = index + utf8.RuneLen(rn)
+	if line, lineStart, _, ok := tag.lines.Next(index, rn); ok {
+		if label, text, isDef := markdownParseFootnote(line); isDef {
+			tag.defs = append(tag.defs, markdownFootnote{label: label, text: text, start: lineStart, end: lineStart + len(line)})
+		}
+	}
+
+	if tag.ref.Len() > 0 {
+		switch {
+		case gap || unicode.IsSpace(rn) || rn == '[' || tag.ref.Len() == 1 && rn != '^':
+			tag.ref.Reset()
+		case rn == ']':
+			if label := tag.ref.String()[2:]; label != "" {
+				tag.refs = append(tag.refs, markdownFootnote{label: label, start: tag.refStart, end: index + 1})
+			}
+			tag.ref.Reset()
+			return nil
+		default:
+			tag.ref.WriteRune(rn)
+			return nil
+		}
+	}
+	if rn == '[' {
+		tag.refStart = index
+		tag.ref.WriteRune(rn)
+	}
+	return nil
+}
+
+func (tag *MarkdownTagFootnote) Finish(index int) []MarkdownTagAction {
+	defer func() {
+		tag.lines.Reset()
+		tag.ref.Reset()
+		tag.next, tag.refs, tag.defs = 0, nil, nil
+	}()
+	if len(tag.defs) == 0 {
+		return nil
+	}
+
+	var result []MarkdownTagAction
+	texts := map[string]string{}
+	for _, def := range tag.defs {
+		if _, ok := texts[def.label]; !ok {
+			texts[def.label] = def.text
+			if tag.escape {
+				texts[def.label] = markdownEscapeHTML.Replace(def.text)
+			}
+		}
+		result = append(result, MarkdownTagAction{Index: def.start, Range: []int{def.start, def.end}, BlockRange: []int{def.start, def.end}})
+	}
+
+	numbers := map[string]int{}
+	labels := []string{}
+	for _, ref := range tag.refs {
+		text, ok := texts[ref.label]
+		inDef := slices.ContainsFunc(tag.defs, func(def markdownFootnote) bool { return ref.start >= def.start && ref.start < def.end })
+		if !ok || inDef || text == "" {
+			continue
+		}
+		number, seen := numbers[ref.label]
+		id := ""
+		if !seen {
+			number = len(numbers) + 1
+			numbers[ref.label] = number
+			labels = append(labels, ref.label)
+			id = fmt.Sprintf(` id="fnref-%d"`, number)
+		}
+		result = append(result, MarkdownTagAction{
+			Index:     ref.start,
+			Insertion: fmt.Sprintf(`<sup class="{md.sup}"><a%s href="#fn-%d">%d</a></sup>`, id, number, number),
+			Range:     []int{ref.start, ref.end},
+		})
+	}
+	if len(labels) == 0 {
+		return result
+	}
+
+	section := strings.Builder{}
+	section.WriteString(`<section class="{md.footnotes}"><ol class="{md.ol}">`)
+	for i, label := range labels {
+		fmt.Fprintf(&section, `<li id="fn-%d" class="{md.li}">%s <a href="#fnref-%d">↩</a></li>`, i+1, texts[label], i+1)
+	}
+	section.WriteString("</ol></section>\n")
+	return append(result, MarkdownTagAction{Index: index - 1, Insertion: section.String(), BlockRange: []int{index - 1, index}})
+}
+
+// markdownParseFootnote parses "[^label]: text" definition lines.
+func markdownParseFootnote(line string) (label string, text string, ok bool) {
+	if !strings.HasPrefix(line, "[^") {
+		return "", "", false
+	}
+	end := strings.Index(line, "]:")
+	if end < 3 || strings.ContainsFunc(line[2:end], unicode.IsSpace) {
+		return "", "", false
+	}
+	return line[2:end], strings.TrimSpace(line[end+2:]), true
+}
+
+// MarkdownTagAutolink links bare http:// and https:// urls starting a word, trailing punctuation (e.g. the end of
+// a sentence) is left out. Urls of [text](url) links, or in `code`, don't start a word, so they're left alone.
+type MarkdownTagAutolink struct {
+	url        strings.Builder
+	start      int
+	next       int
+	afterSpace bool
+}
+
+func (tag *MarkdownTagAutolink) Next(index int, rn rune) []MarkdownTagAction {
+	var result []MarkdownTagAction
+	gap := index != tag.next
+	tag.next = index + utf8.RuneLen(rn)
+	defer func() { tag.afterSpace = unicode.IsSpace(rn) }()
+
+	if tag.url.Len() > 0 {
+		if !gap && !unicode.IsSpace(rn) {
+			tag.url.WriteRune(rn)
+			if !markdownIsURLPrefix(tag.url.String()) {
+				tag.url.Reset()
+			}
+			return nil
+		}
+		result = tag.flush()
+	}
+
+	if rn == 'h' && (index == 0 || gap || tag.afterSpace) {
+		tag.start = index
+		tag.url.WriteRune(rn)
+	}
+	return result
+}
+
+func (tag *MarkdownTagAutolink) Finish(index int) []MarkdownTagAction {
+	result := tag.flush()
+	tag.next, tag.afterSpace = 0, false
+	return result
+}
+
+func (tag *MarkdownTagAutolink) flush() []MarkdownTagAction {
+	link := strings.TrimRight(tag.url.String(), ".,;:!?)'\"*_~")
+	tag.url.Reset()
+	if !strings.HasPrefix(link, "https://") && !strings.HasPrefix(link, "http://") || strings.HasSuffix(link, "//") {
+		return nil
+	}
+	escaped := template.HTMLEscapeString(link)
+	return []MarkdownTagAction{{
+		Index:     tag.start,
+		Insertion: fmt.Sprintf(`<a class="{md.a}" href="%s">%s</a>`, escaped, escaped),
+		Range:     []int{tag.start, tag.start + len(link)},
+	}}
+}
+
+func markdownIsURLPrefix(link string) bool {
+	for _, scheme := range []string{"https://", "http://"} {
+		if strings.HasPrefix(link, scheme) || strings.HasPrefix(scheme, link) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkdownTagList renders consecutive "- ", "* " or "+ " lines as <ul> lists and "1. " (or "1) ") lines as <ol>
+// lists, starting at the first item's number (later numbers are ignored, as in GitHub). Lines indented by two spaces
+// (or a tab) more than the previous item are nested into it. Blank lines (or any other line) end the list.
+// Items starting with "[ ] " or "[x] " are GitHub task list items, rendered with a disabled checkbox.
+type MarkdownTagList struct {
+	lines   markdownLines
+	stack   []markdownListLevel
+	start   int
+	lastEnd int
+}
+
+type markdownListLevel struct {
+	level int
+	tag   string
+}
+
+type markdownListItem struct {
+	markdownListLevel
+	content int // Offset of the item's text within the line.
+	number  int // Ordered lists only.
+	task    bool
+	checked bool
+}
+
+func (tag *MarkdownTagList) Next(index int, rn rune) []MarkdownTagAction {
+	var result []MarkdownTagAction
+	line, lineStart, gap, ok := tag.lines.Next(index, rn)
+	if gap {
+		result = tag.close()
+	}
+	if !ok {
+		return result
+	}
+
+	item, isItem := markdownParseListItem(line)
+	if !isItem {
+		return append(result, tag.close()...)
+	}
+
+	closing, opening := "", ""
+	for len(tag.stack) > 0 && tag.stack[len(tag.stack)-1].level > item.level {
+		closing += fmt.Sprintf("</li></%s>", tag.stack[len(tag.stack)-1].tag)
+		tag.stack = tag.stack[:len(tag.stack)-1]
+	}
+	switch top := len(tag.stack) - 1; {
+	case top >= 0 && tag.stack[top].level == item.level && tag.stack[top].tag == item.tag:
+		closing += "</li>"
+	case top >= 0 && tag.stack[top].level == item.level:
+		closing += fmt.Sprintf("</li></%s>", tag.stack[top].tag)
+		tag.stack = tag.stack[:top]
+		fallthrough
+	default:
+		if len(tag.stack) == 0 {
+			tag.start = lineStart
+		}
+		start := ""
+		if item.tag == "ol" && item.number != 1 {
+			start = fmt.Sprintf(` start="%d"`, item.number)
+		}
+		opening += fmt.Sprintf(`<%s class="{md.%s}"%s>`, item.tag, item.tag, start)
+		tag.stack = append(tag.stack, item.markdownListLevel)
+	}
+	switch {
+	case item.checked:
+		opening += `<li class="{md.task}"><input type="checkbox" class="{md.checkbox}" disabled checked>`
+	case item.task:
+		opening += `<li class="{md.task}"><input type="checkbox" class="{md.checkbox}" disabled>`
+	default:
+		opening += `<li class="{md.li}">`
+	}
+
+	if closing != "" {
+		result = append(result, MarkdownTagAction{Index: tag.lastEnd, Insertion: closing})
+	}
+	tag.lastEnd = lineStart + len(line) - 1
+	return append(result, MarkdownTagAction{
+		Index:     lineStart,
+		Insertion: opening,
+		Range:     []int{lineStart, lineStart + item.content},
+	})
+}
+
+func (tag *MarkdownTagList) Finish(index int) []MarkdownTagAction {
+	tag.lines.Reset()
+	return tag.close()
+}
+
+func (tag *MarkdownTagList) close() []MarkdownTagAction {
+	if len(tag.stack) == 0 {
+		return nil
+	}
+	closing := ""
+	for i := len(tag.stack) - 1; i >= 0; i-- {
+		closing += fmt.Sprintf("</li></%s>", tag.stack[i].tag)
+	}
+	tag.stack = nil
+	return []MarkdownTagAction{{
+		Index:      tag.lastEnd,
+		Insertion:  closing,
+		BlockRange: []int{tag.start, tag.lastEnd + 1},
+	}}
+}
+
+// markdownParseListItem parses the indentation (two spaces or a tab per level) and the marker of a list line.
+func markdownParseListItem(line string) (item markdownListItem, ok bool) {
+	spaces, i := 0, 0
+	for ; i < len(line) && (line[i] == ' ' || line[i] == '\t'); i++ {
+		if line[i] == '\t' {
+			spaces += 2
+		} else {
+			spaces++
+		}
+	}
+	item.level = spaces / 2
+
+	rest := line[i:]
+	if len(rest) >= 2 && strings.ContainsRune("-*+", rune(rest[0])) && rest[1] == ' ' {
+		item.tag = "ul"
+		item.content = i + 2
+		return markdownParseTaskItem(line, item), true
+	}
+
+	digits := 0
+	for digits < len(rest) && digits < 9 && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 || len(rest) < digits+2 || (rest[digits] != '.' && rest[digits] != ')') || rest[digits+1] != ' ' {
+		return item, false
+	}
+	item.number, _ = strconv.Atoi(rest[:digits])
+	item.tag = "ol"
+	item.content = i + digits + 2
+	return markdownParseTaskItem(line, item), true
+}
+
+func markdownParseTaskItem(line string, item markdownListItem) markdownListItem {
+	box := line[item.content:]
+	if len(box) < 4 || box[0] != '[' || box[2] != ']' || (box[3] != ' ' && box[3] != '\n') {
+		return item
+	}
+	switch box[1] {
+	case ' ':
+		item.task = true
+	case 'x', 'X':
+		item.task, item.checked = true, true
+	default:
+		return item
+	}
+	item.content += 3
+	if box[3] == ' ' {
+		item.content++
+	}
+	return item
+}
+
+// MarkdownTagLink renders [text](url) links and ![alt](src "title") images, Parser gets the whole source
+// (with the leading "!" for images).
 type MarkdownTagLink struct {
 	Parser    func(template.HTML) (template.HTML, error)
+	bang      int // Index of the "!" right before a "[", -1 if there is none.
 	skip      bool
 	openHint  bool
 	openLink  bool
@@ -267,13 +1484,34 @@ type MarkdownTagLink struct {
 	openAt    int
 	link      string
 	template  *template.Template
+	escape    bool   // See MarkdownOptions.EscapeHTML.
+	textOnly  bool   // See MarkdownOptions.DisableLinks.
+	source    string // See MarkdownOptions.Source.
 }
 
 func (tag *MarkdownTagLink) Next(index int, rn rune) []MarkdownTagAction {
 	if tag.Parser == nil {
 		tag.Parser = func(data template.HTML) (template.HTML, error) {
+			if strings.HasPrefix(string(data), "!") {
+				return markdownImage(string(data[2:len(data)-1]), tag.escape, tag.source), nil
+			}
 			hint, link, _ := strings.Cut(string(data[1:len(data)-1]), "](")
-			schema := fmt.Sprintf(`<a class="font-medium text-primary underline underline-offset-4" href="%s">%s</a>`, link, hint)
+			if tag.escape {
+				hint = markdownEscapeHTML.Replace(hint)
+			}
+			if tag.textOnly {
+				return template.HTML(hint), nil
+			}
+			if MarkdownLinkRewrite != nil {
+				link = MarkdownLinkRewrite(link, tag.source)
+			}
+			if tag.escape && !markdownSafeURL(link) {
+				return template.HTML(hint), nil
+			}
+			if tag.escape {
+				return template.HTML(fmt.Sprintf(`<a class="{md.a}" href="%s">%s</a>`, template.HTMLEscapeString(link), hint)), nil
+			}
+			schema := fmt.Sprintf(`<a class="{md.a}" href="%s">%s</a>`, link, hint)
 			return ExecuteSchema(template.Must(template.New("").Parse(schema)), nil)
 		}
 	}
@@ -306,57 +1544,132 @@ func (tag *MarkdownTagLink) Next(index int, rn rune) []MarkdownTagAction {
 		tag.openHint = false
 	case tag.openHint:
 
+	case rn == '!':
+		tag.bang = index
 	case rn == '[':
 		tag.openHint = true
 		tag.openIndex = index
+		if tag.bang != -1 && tag.bang == index-1 {
+			tag.openIndex = tag.bang
+		}
+		tag.bang = -1
+	default:
+		tag.bang = -1
 	}
 
 	return nil
 }
 
-func markdownApplyTags(data string, skip []bool, actions [][]MarkdownTagAction, paragraphs []bool) error {
-	for _, tag := range MarkdownTags {
+// markdownImage renders `alt](src "title"` with FiletypesTags by the src extension, so ![clip](demo.mp4)
+// is a <video>, anything unknown is an <img>. With escape, an unsafe src renders just the alt text.
+func markdownImage(source string, escape bool, document string) template.HTML {
+	alt, src, _ := strings.Cut(source, "](")
+	src, title, hasTitle := strings.Cut(strings.TrimSpace(src), " ")
+	if MarkdownLinkRewrite != nil {
+		src = MarkdownLinkRewrite(src, document)
+	}
+	if escape && !markdownSafeURL(src) {
+		return template.HTML(template.HTMLEscapeString(alt))
+	}
+
+	schema := FiletypesTags["img"]
+	ext := strings.ToLower(filepath.Ext(src))
+	for filetype, exts := range Filetypes {
+		if slices.Contains(exts, ext) && FiletypesTags[filetype] != "" {
+			schema = FiletypesTags[filetype]
+			break
+		}
+	}
+	result := fmt.Sprintf(schema, template.HTMLEscapeString(src), template.HTMLEscapeString(alt))
+	if title = strings.Trim(strings.TrimSpace(title), `"`); hasTitle && title != "" {
+		if end := strings.Index(result, ">"); end != -1 {
+			result = fmt.Sprintf(`%s title="%s"%s`, result[:end], template.HTMLEscapeString(title), result[end:])
+		}
+	}
+	return template.HTML(result)
+}
+
+// markdownSafeURL reports whether an untrusted link may be rendered: relative, http, https or mailto.
+func markdownSafeURL(link string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return false
+	}
+	switch parsed.Scheme {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+func markdownApplyTags(tags []MarkdownTag, data string, skip, verbatim []bool, actions [][]MarkdownTagAction, paragraphs []bool) error {
+	for _, tag := range tags {
 		for index, rn := range data {
-			if skip[index] {
+			if skip[index] || verbatim[index] {
 				continue
 			}
+			if err := markdownApplyActions(data, tag.Next(index, rn), skip, verbatim, actions, paragraphs); err != nil {
+				return err
+			}
+		}
+		if finisher, ok := tag.(MarkdownTagFinisher); ok {
+			if err := markdownApplyActions(data, finisher.Finish(len(data)), skip, verbatim, actions, paragraphs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-			isNewlineBased := false
-			from, to := math.MaxInt, 0
-			for _, action := range tag.Next(index, rn) {
-				if len(action.Range) > 1 {
-					for i := action.Range[0]; i < action.Range[1]; i++ {
-						skip[i] = true
-					}
-					from = min(from, action.Range[0])
-					to = max(to, action.Range[1])
-				}
-
-				if action.IsNewBlock {
-					isNewlineBased = true
-				}
-
-				if action.Transformation == nil {
-					actions[action.Index] = append(actions[action.Index], action)
-					continue
-				}
-
-				target := template.HTML(data[action.Range[0]:action.Range[1]])
-				transformed, err := ExecuteSchema(action.Transformation, struct{ Children template.HTML }{target})
-				if err != nil {
-					return err
-				}
-				actions[action.Range[0]] = append(actions[action.Index], MarkdownTagAction{
-					Index:     action.Range[0],
-					Insertion: string(transformed),
-				})
+func markdownApplyActions(data string, tagActions []MarkdownTagAction, skip, verbatim []bool, actions [][]MarkdownTagAction, paragraphs []bool) error {
+	isNewlineBased := false
+	from, to := math.MaxInt, 0
+	for _, action := range tagActions {
+		if len(action.Range) > 1 {
+			for i := action.Range[0]; i < action.Range[1]; i++ {
+				skip[i] = true
+			}
+			from = min(from, action.Range[0])
+			to = max(to, action.Range[1])
+		}
+		if len(action.BlockRange) > 1 {
+			for i := action.BlockRange[0]; i < action.BlockRange[1]; i++ {
+				paragraphs[i] = true
 			}
-			if isNewlineBased {
-				for i := from; i < to; i++ {
-					paragraphs[i] = true
-				}
+		}
+		if len(action.TextRange) > 1 {
+			for i := action.TextRange[0]; i < action.TextRange[1]; i++ {
+				verbatim[i] = true
 			}
 		}
+
+		if action.IsNewBlock {
+			isNewlineBased = true
+		}
+
+		if action.Transformation == nil {
+			actions[action.Index] = append(actions[action.Index], action)
+			continue
+		}
+
+		target := template.HTML(data[action.Range[0]:action.Range[1]])
+		transformed, err := ExecuteSchema(action.Transformation, MarkdownTransformData{
+			Children: target,
+			Lang:     action.Lang,
+			Attrs:    action.Attrs,
+		})
+		if err != nil {
+			return newMarkdownError(data, action.Range[0], err)
+		}
+		actions[action.Range[0]] = append(actions[action.Index], MarkdownTagAction{
+			Index:     action.Range[0],
+			Insertion: string(transformed),
+		})
+	}
+	if isNewlineBased {
+		for i := from; i < to; i++ {
+			paragraphs[i] = true
+		}
 	}
 	return nil
 }
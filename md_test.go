@@ -0,0 +1,789 @@
+package mono_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kittenbark/mono"
+	"html/template"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMarkdownFunc(t *testing.T) {
+	t.Parallel()
+
+	body := "# Title\n\nSome **bold** text."
+	expected, err := mono.Markdown(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(expected), "<b>bold</b>") {
+		t.Fatalf("expected bold text, got %s", expected)
+	}
+
+	wg := sync.WaitGroup{}
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			actual, err := mono.SchemaApply(`<main>{{markdown .}}</main>`, "test", mono.DefaultPageDynamicFuncs, body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if actual != "<main>"+expected+"</main>" {
+				t.Errorf("expected %s, got %s", expected, actual)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMarkdownFunc_DynamicPage(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.Page("/", mono.BuiltPage{
+		Data:        []byte(`<main>{${ markdown . }$}</main>`),
+		ContentType: "text/html; charset=utf-8",
+		Dynamic:     true,
+		DynamicData: func(ctx context.Context, req *http.Request) any { return "**hi**" },
+	})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	if body := string(cl.Get(t, "/")); !strings.Contains(body, "<b>hi</b>") {
+		t.Fatalf("expected rendered markdown, got %s", body)
+	}
+}
+
+func TestMarkdownFunc_Profiles(t *testing.T) {
+	t.Parallel()
+
+	body := "## Comment\n\nFirst paragraph.\n\nSecond paragraph."
+	schema := `{{markdown .}}|{{markdown . "compact"}}`
+	actual, err := mono.SchemaApply(schema, "test", mono.DefaultPageDynamicFuncs, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	article, comment, _ := strings.Cut(string(actual), "|")
+	for _, expected := range []string{
+		`<p class="` + mono.MarkdownClasses["default"]["p"] + `">`,
+		`<h2 id="comment" class="` + mono.MarkdownClasses["default"]["h2"] + `">`,
+	} {
+		if !strings.Contains(article, expected) {
+			t.Errorf("default profile: expected %s in %s", expected, article)
+		}
+	}
+	for _, expected := range []string{
+		`<p class="` + mono.MarkdownClasses["compact"]["p"] + `">`,
+		`<h2 id="comment" class="` + mono.MarkdownClasses["compact"]["h2"] + `">`,
+	} {
+		if !strings.Contains(comment, expected) {
+			t.Errorf("compact profile: expected %s in %s", expected, comment)
+		}
+	}
+	if strings.Contains(article+comment, "{md.") {
+		t.Errorf("unresolved class placeholder in %s", actual)
+	}
+
+	if _, err := mono.SchemaApply(`{{markdown . "missing"}}`, "test", mono.DefaultPageDynamicFuncs, body); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestMarkdownClassPlaceholderInText(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("```\n<p class=\"{md.p}\">\n```\n\n[see {md.a}](/a) and `{md.code}`\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`&lt;p class=&#34;{md.p}&#34;&gt;`, `href="/a">see {md.a}</a>`, `>{md.code}</code>`} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Count(string(html), mono.MarkdownClasses["default"]["p"]) != 1 {
+		t.Errorf("expected the class of the only paragraph, got %s", html)
+	}
+}
+
+func TestMarkdownLinkRewrite(t *testing.T) {
+	defer func() { mono.MarkdownLinkRewrite = nil }()
+	mono.MarkdownLinkRewrite = mono.MarkdownRewriteLinks("")
+
+	html, err := mono.Markdown("[x](./y.md) and [z](https://z)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`href="/y">x</a>`, `href="https://z">z</a>`} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+
+	html, err = mono.MarkdownWith("[x](./y.md) and [z](../z.md)", mono.MarkdownOptions{Source: "guide/setup/index.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`href="/guide/setup/y">x</a>`, `href="/guide/z">z</a>`} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+
+	rewrite := mono.MarkdownRewriteLinks("/docs")
+	tests := map[string]string{
+		"./y.md":            "/docs/y",
+		"guide/setup.md#go": "/docs/guide/setup#go",
+		"guide/index.md":    "/docs/guide",
+		"index.md":          "/docs",
+		"guide/reindex.md":  "/docs/guide/reindex",
+		"/blog/post.md":     "/blog/post",
+		"https://z/y.md":    "https://z/y.md",
+		"//z/y.md":          "//z/y.md",
+		"#anchor":           "#anchor",
+		"./image.png":       "./image.png",
+	}
+	for href, expected := range tests {
+		if actual := rewrite(href, ""); actual != expected {
+			t.Errorf("%s: expected %s, got %s", href, expected, actual)
+		}
+	}
+
+	tests = map[string]string{
+		"./y.md":         "/docs/guide/y",
+		"setup/index.md": "/docs/guide/setup",
+		"../index.md":    "/docs",
+		"../../up.md":    "/docs/up",
+		"/blog/post.md":  "/blog/post",
+	}
+	for href, expected := range tests {
+		if actual := rewrite(href, "guide/intro.md"); actual != expected {
+			t.Errorf("%s of guide/intro.md: expected %s, got %s", href, expected, actual)
+		}
+	}
+}
+
+func TestMarkdownCodeInfo(t *testing.T) {
+	code := mono.MarkdownTags[0].(*mono.MarkdownTagCode)
+	code.Transformations["go"] = template.Must(template.New("go").Parse(
+		`<figure data-lang="{{.Lang}}" data-highlight="{{index .Attrs "highlight"}}" data-wrap="{{index .Attrs "wrap"}}">{{.Attrs.title}}</figure>`,
+	))
+	defer delete(code.Transformations, "go")
+
+	html, err := mono.Markdown("```go {highlight:2-4 title=\"main.go\" wrap}\nfmt.Println()\n```\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<figure data-lang="go" data-highlight="2-4" data-wrap="true">main.go</figure>`
+	if !strings.Contains(string(html), expected) {
+		t.Fatalf("expected %s in %s", expected, html)
+	}
+
+	html, err = mono.Markdown("```python title=main.py\nprint()\n```\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "print()") {
+		t.Fatalf("expected the default transformation for python, got %s", html)
+	}
+}
+
+func TestMarkdownError(t *testing.T) {
+	code := mono.MarkdownTags[0].(*mono.MarkdownTagCode)
+	code.Transformations["broken"] = template.Must(template.New("broken").Parse(`{{index .Attrs.missing 1}}`))
+	defer delete(code.Transformations, "broken")
+
+	_, err := mono.Markdown("# Title\n\nÜber text\n\n- item ```broken\nx\n```\n")
+	var mdErr mono.MarkdownError
+	if !errors.As(err, &mdErr) {
+		t.Fatalf("expected a MarkdownError, got %v", err)
+	}
+	if mdErr.Line != 5 || mdErr.Column != 8 || !strings.HasPrefix(err.Error(), "markdown 5:8: ") {
+		t.Errorf("expected the error at 5:8, got %d:%d (%v)", mdErr.Line, mdErr.Column, err)
+	}
+	if mdErr.Err == nil || !strings.Contains(err.Error(), "index") {
+		t.Errorf("expected the template error to be wrapped, got %v", err)
+	}
+}
+
+func TestMarkdownCodeLanguage(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("```go\nfmt.Println(\"<hi>\")\n```\n\n```\nplain\n```\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<code class="language-go">fmt.Println(&#34;&lt;hi&gt;&#34;)</code>`,
+		`<code>plain</code>`,
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+}
+
+func TestMarkdownCodeFences(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		source     string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:       "unclosed",
+			source:     "intro\n\n```go\nfmt.Println()\n\nmore *not em*\n",
+			expected:   []string{"<code class=\"language-go\">fmt.Println()\n\nmore *not em*</code></pre></div>"},
+			unexpected: []string{"<i>not em</i>"},
+		},
+		{
+			name:       "trailing whitespace",
+			source:     "```go\nfmt.Println()\n```  \t\n\nafter *em*\n",
+			expected:   []string{"<code class=\"language-go\">fmt.Println()</code></pre></div>\n", "after <i>em</i>"},
+			unexpected: []string{"</div>  "},
+		},
+		{
+			name:     "fence inside a line",
+			source:   "```go\ns := \"```\"\n```\n",
+			expected: []string{"<code class=\"language-go\">s := &#34;```&#34;</code>"},
+		},
+		{
+			name:     "indented closing fence",
+			source:   "```\ncode\n   ```\n\nnext\n",
+			expected: []string{"<code>code</code>", "next</p>"},
+		},
+		{
+			name:       "longer fence",
+			source:     "````\ncode\n```\n````\nafter *em*\n",
+			expected:   []string{"<code>code\n```</code>", "after <i>em</i>"},
+			unexpected: []string{"<i>em</i></code>"},
+		},
+		{
+			name:     "text after a closing fence",
+			source:   "```\ncode\n``` x\n```\n\nnext\n",
+			expected: []string{"<code>code\n``` x</code>", "next</p>"},
+		},
+	}
+	for _, test := range tests {
+		html, err := mono.Markdown(test.source)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(string(html), expected) {
+				t.Errorf("%s: expected %q in %s", test.name, expected, html)
+			}
+		}
+		for _, unexpected := range test.unexpected {
+			if strings.Contains(string(html), unexpected) {
+				t.Errorf("%s: unexpected %q in %s", test.name, unexpected, html)
+			}
+		}
+	}
+}
+
+func TestMarkdownCodeHighlighter(t *testing.T) {
+	defer mono.ResetDefaults()
+	mono.MarkdownCodeHighlighter = func(lang string, code string) (template.HTML, error) {
+		if lang == "broken" {
+			return "", fmt.Errorf("unsupported")
+		}
+		return template.HTML(`<pre class="chroma" data-lang="` + lang + `">` + strings.ToUpper(code) + `</pre>`), nil
+	}
+
+	html, err := mono.Markdown("```go\nfmt.Println()\n```\n\n```broken\nplain\n```\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<pre class="chroma" data-lang="go">FMT.PRINTLN()</pre>`,
+		`<code class="language-broken">plain</code>`,
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+}
+
+func TestMarkdownWith(t *testing.T) {
+	t.Parallel()
+
+	source := "Hi <script>alert(1)</script> **bold** `<b>`\n\n```html\n<i>x</i>\n```\n\n" +
+		"[<img src=x onerror=y>](/a)\n\n> quote\n"
+	html, err := mono.MarkdownWith(source, mono.MarkdownOptions{EscapeHTML: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(html), "<script>") || strings.Contains(string(html), "<img") {
+		t.Errorf("expected raw html to be escaped, got %s", html)
+	}
+	for _, expected := range []string{
+		"Hi &lt;script&gt;alert(1)&lt;/script&gt; <b>bold</b>",
+		"&lt;b&gt;</code>",
+		`<code class="language-html">&lt;i&gt;x&lt;/i&gt;</code>`,
+		`href="/a">&lt;img src=x onerror=y&gt;</a>`,
+		"<blockquote",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if unescaped, _ := mono.Markdown(source); !strings.Contains(string(unescaped), "<script>") {
+		t.Errorf("expected Markdown to keep raw html, got %s", unescaped)
+	}
+
+	html, err = mono.MarkdownWith("[a](JavaScript:void) ![b](javascript:void) [c](mailto:x@y.dev) [d](/d) ![e](https://x.dev/e.png)",
+		mono.MarkdownOptions{EscapeHTML: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(html)), "javascript") {
+		t.Errorf("expected unsafe urls as text, got %s", html)
+	}
+	for _, expected := range []string{"a b ", `href="mailto:x@y.dev">c</a>`, `href="/d">d</a>`, `src="https://x.dev/e.png"`} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+
+	html, err = mono.MarkdownWith("[docs](https://x.dev) and https://y.dev", mono.MarkdownOptions{DisableLinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(html), "<a ") || !strings.Contains(string(html), "docs and https://y.dev") {
+		t.Errorf("expected links as text, got %s", html)
+	}
+
+	html, err = mono.MarkdownWith("**b** *i*", mono.MarkdownOptions{
+		Profile: "compact",
+		Tags:    []mono.MarkdownTag{&mono.MarkdownGenericTag{Triggers: []string{"**"}, Insertion: []string{"<b>", "</b>"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "<b>b</b> *i*") {
+		t.Errorf("expected only the custom tags, got %s", html)
+	}
+}
+
+func TestMarkdownFrontMatter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		data string
+		meta map[string]string
+		body string
+	}{
+		{"---\ntitle: Hello: world\ndescription: \"quoted\"\n# comment\n---\n# Body\n",
+			map[string]string{"title": "Hello: world", "description": "quoted"}, "# Body\n"},
+		{"---\r\ntitle: 'crlf'\r\n---\r\nBody", map[string]string{"title": "crlf"}, "Body"},
+		{"+++\ntitle = \"toml\"\ndraft = true\n+++\nBody", map[string]string{"title": "toml", "draft": "true"}, "Body"},
+		{"Intro\n---\ntitle: no\n---\n", map[string]string{}, "Intro\n---\ntitle: no\n---\n"},
+		{"---\ntitle: unclosed\n", map[string]string{}, "---\ntitle: unclosed\n"},
+	}
+	for _, test := range tests {
+		meta, body := mono.MarkdownFrontMatter(test.data)
+		if !maps.Equal(meta, test.meta) || body != test.body {
+			t.Errorf("%q: expected %v %q, got %v %q", test.data, test.meta, test.body, meta, body)
+		}
+	}
+}
+
+func TestMarkdownSmartTypography(t *testing.T) {
+	t.Parallel()
+
+	source := "\"Quoted\" and 'single', it's 1--2 --- wait... **\"bold\"** `\"code\" -- ...`\n\n" +
+		"<span title=\"raw\">x</span>\n\n---\n\n```\n\"fenced\" -- ...\n```\n"
+	html, err := mono.MarkdownWith(source, mono.MarkdownOptions{SmartTypography: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"“Quoted” and ‘single’, it’s 1–2 — wait… <b>“bold”</b>",
+		"\"code\" -- ...</code>",
+		`<span title="raw">x</span>`,
+		"<hr",
+		"&#34;fenced&#34; -- ...",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if plain, _ := mono.Markdown(source); strings.ContainsAny(string(plain), "“”‘’–—…") {
+		t.Errorf("expected SmartTypography to be off by default, got %s", plain)
+	}
+}
+
+func TestMarkdownText(t *testing.T) {
+	t.Parallel()
+
+	text, err := mono.MarkdownText("# Title\n\nSome **bold** and [a link](https://x.dev) with `code`.[^1]\nSecond line.\n\n" +
+		"- one\n- two\n  1. nested\n- [x] done\n\n| A | B |\n|---|---|\n| **1** | 2 |\n\n" +
+		"```go\nfmt.Println(\"<hi>\")\n```\n\n![alt text](pic.png) &amp; more\n\n[^1]: The note.\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"Title",
+		"Some bold and a link with code.[1]",
+		"Second line.",
+		"- one",
+		"- two",
+		"  1. nested",
+		"- [x] done",
+		"A | B",
+		"1 | 2",
+		`fmt.Println("<hi>")`,
+		"alt text & more",
+		"1. The note.",
+	}, "\n")
+	if text != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, text)
+	}
+}
+
+func TestMarkdownTable(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("Intro.\n\n| Name | Qty | Price |\n|:-----|:---:|------:|\n| a \\| b | **1** | 2 |\n| short |\n\nNot | a table.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := mono.MarkdownClasses["default"]
+	for _, expected := range []string{
+		`<p class="` + classes["p"] + `">Intro.</p>`,
+		`<table class="` + classes["table"] + `"><thead><tr class="` + classes["tr"] + `">`,
+		`<th class="` + classes["th"] + ` text-left"> Name </th>`,
+		`<th class="` + classes["th"] + ` text-center"> Qty </th>`,
+		`<th class="` + classes["th"] + ` text-right"> Price </th></tr></thead><tbody>`,
+		`<td class="` + classes["td"] + ` text-left"> a | b </td>`,
+		`<td class="` + classes["td"] + ` text-center"> <b>1</b> </td>`,
+		`<td class="` + classes["td"] + ` text-left"> short </td><td class="` + classes["td"] + ` text-center"></td>` +
+			`<td class="` + classes["td"] + ` text-right"></td></tr></tbody></table></div>`,
+		"Not | a table.</p>",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Contains(string(html), "<p class=\""+classes["p"]+"\"><div") || strings.Contains(string(html), "|:---") {
+		t.Errorf("the table must not be wrapped in a paragraph nor keep the separator: %s", html)
+	}
+}
+
+func TestMarkdownList(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("Intro.\n\n- one *emph*\n- two\n  - nested **bold**\n\t- tab nested\n    - deeper\n- three\n\nAfter.\n* x\n+ y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := mono.MarkdownClasses["default"]
+	ul, li := `<ul class="`+classes["ul"]+`">`, `<li class="`+classes["li"]+`">`
+	for _, expected := range []string{
+		ul + li + "one <i>emph</i></li>\n" + li + "two\n" + ul + li + "nested <b>bold</b></li>\n" +
+			li + "tab nested\n" + ul + li + "deeper</li></ul></li></ul></li>\n" + li + "three</li></ul>",
+		"After.</p>\n" + ul + li + "x</li>\n" + li + "y</li></ul>",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Contains(string(html), `<p class="`+classes["p"]+`"><ul`) || strings.Contains(string(html), "- ") {
+		t.Errorf("lists must not be wrapped in a paragraph nor keep the markers: %s", html)
+	}
+}
+
+func TestMarkdownOrderedList(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("Steps:\n\n3. first *emph*\n3. second\n  1) nested\n  - mixed\n7. third\n\n1. fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := mono.MarkdownClasses["default"]
+	ol, ul, li := `<ol class="`+classes["ol"]+`"`, `<ul class="`+classes["ul"]+`">`, `<li class="`+classes["li"]+`">`
+	for _, expected := range []string{
+		ol + ` start="3">` + li + "first <i>emph</i></li>\n" + li + "second\n" + ol + ">" + li + "nested</li></ol>\n" +
+			ul + li + "mixed</li></ul></li>\n" + li + "third</li></ol>",
+		ol + ">" + li + "fresh</li></ol>",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Contains(string(html), `<p class="`+classes["p"]+`"><ol`) || strings.Contains(string(html), "3. ") {
+		t.Errorf("lists must not be wrapped in a paragraph nor keep the markers: %s", html)
+	}
+}
+
+func TestMarkdownTaskList(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("- [ ] todo\n- [x] done *now*\n- [X] DONE\n- [y] not a task\n1. [ ] ordered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := mono.MarkdownClasses["default"]
+	task, li := `<li class="`+classes["task"]+`">`, `<li class="`+classes["li"]+`">`
+	checkbox := `<input type="checkbox" class="` + classes["checkbox"] + `" disabled`
+	for _, expected := range []string{
+		task + checkbox + ">todo</li>",
+		task + checkbox + " checked>done <i>now</i></li>",
+		task + checkbox + " checked>DONE</li>",
+		li + "[y] not a task</li>",
+		task + checkbox + ">ordered</li></ol>",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+}
+
+func TestMarkdownStrikethrough(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("~~a~~ and ~b~, \\~\\~c\\~\\~ and ~~**d**~~")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"<del>a</del> and ~b~", "~c", "<del><b>d</b></del>"} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Count(string(html), "<del>") != 2 {
+		t.Errorf("only ~~a~~ and ~~**d**~~ must be struck: %s", html)
+	}
+}
+
+func TestMarkdownImage(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown(`Wow! Look: ![a cat](/img/cat.png "The cat") and ![clip](demo.mp4), [link](/x) \![not](/img)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`Wow! Look: <img src="/img/cat.png" alt="a cat" title="The cat">`,
+		`<video src="demo.mp4" alt="clip" preload`,
+		`href="/x">link</a>`,
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Contains(string(html), `alt="not"`) || !strings.Contains(string(html), `\!<a`) {
+		t.Errorf("escaped ! must stay in front of a link: %s", html)
+	}
+}
+
+func TestMarkdownLinkAfterText(t *testing.T) {
+	t.Parallel()
+
+	for source, expected := range map[string]string{
+		"x[link](y)":         `mt-5">x<a class`,
+		"![a](b.png)x[c](d)": `alt="a">x<a class`,
+	} {
+		html, err := mono.Markdown(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("%s: expected %s in %s", source, expected, html)
+		}
+	}
+}
+
+func TestMarkdownRule(t *testing.T) {
+	t.Parallel()
+
+	classes := mono.MarkdownClasses["default"]
+	hr := `<hr class="` + classes["hr"] + `">`
+	tests := map[string]int{
+		"***\nintro\n\n---\n\n___\ntext\n---\n**bold** __bold__": 3,
+		"---\ntitle: x\n---\n\nbody":                             0,
+		"---\n\nbody":                                            1,
+		"| a | b |\n|---|---|\n| 1 | 2 |\n\n- - -\n":             0,
+	}
+	for markdown, expected := range tests {
+		html, err := mono.Markdown(markdown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := strings.Count(string(html), hr); actual != expected {
+			t.Errorf("%q: expected %d rules, got %d in %s", markdown, expected, actual, html)
+		}
+		if strings.Contains(string(html), `<p class="`+classes["p"]+`">`+hr) {
+			t.Errorf("%q: rules must not be wrapped in a paragraph: %s", markdown, html)
+		}
+	}
+}
+
+func TestMarkdownHeadingIds(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("# Hello, World!\n\n## Use `mono` (v2)\n\n### Hello world\n#### Hello World\n\n#No heading\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := mono.MarkdownClasses["default"]
+	for _, expected := range []string{
+		`<h1 id="hello-world" class="` + classes["h1"] + `">Hello, World!</h1>`,
+		`<h2 id="use-mono-v2" class="` + classes["h2"] + `">Use <code`,
+		`<h3 id="hello-world-1" class="` + classes["h3"] + `">Hello world</h3>`,
+		`<h4 id="hello-world-2" class="` + classes["h4"] + `">Hello World</h4>`,
+		"#No heading",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+}
+
+func TestMarkdownSlugify(t *testing.T) {
+	defer mono.ResetDefaults()
+	mono.MarkdownSlugify = func(text string) string { return "custom" }
+
+	html, err := mono.Markdown("# One\n# Two\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), `<h1 id="custom" `) || !strings.Contains(string(html), `<h1 id="custom-1" `) {
+		t.Errorf("expected the custom slugs in %s", html)
+	}
+}
+
+func TestMarkdownAutolink(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("See https://example.com/a_b?x=1&y=2. Or [docs](https://example.com/docs), `http://code`\n" +
+		"- http://example.org, hello\nhttp is not a link, nor http://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := `<a class="` + mono.MarkdownClasses["default"]["a"] + `" href=`
+	for _, expected := range []string{
+		`See ` + a + `"https://example.com/a_b?x=1&amp;y=2">https://example.com/a_b?x=1&amp;y=2</a>. Or`,
+		a + `"https://example.com/docs">docs</a>,`,
+		`>http://code</code>`,
+		a + `"http://example.org">http://example.org</a>, hello`,
+		"http is not a link, nor http://",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Count(string(html), "<a ") != 3 {
+		t.Errorf("expected exactly 3 links in %s", html)
+	}
+
+	html, err = mono.Markdown("[visit https://x.com](https://y.com) and `curl https://x.com/a`\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{a + `"https://y.com">visit https://x.com</a>`, `>curl https://x.com/a</code>`} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Count(string(html), "<a ") != 1 {
+		t.Errorf("expected urls in link text and code to stay text in %s", html)
+	}
+}
+
+func TestMarkdownConcurrent(t *testing.T) {
+	t.Parallel()
+
+	documents := []string{}
+	for i := range 32 {
+		documents = append(documents, fmt.Sprintf(
+			"# Title %d\n\nSome *emph* and **bold** %d, `code`, [link](/%d) and https://example.com/%d.\n\n"+
+				"- one\n  - nested ~~%d~~\n1. first\n\n| a | b |\n|---|---|\n| %d | x |\n\n```go\nfmt.Println(%d)\n```\n",
+			i, i, i, i, i, i, i,
+		))
+	}
+	serial := make([]template.HTML, len(documents))
+	for i, document := range documents {
+		html, err := mono.Markdown(document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial[i] = html
+	}
+
+	wg := sync.WaitGroup{}
+	for range 8 {
+		for i, document := range documents {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				html, err := mono.Markdown(document)
+				if err != nil {
+					t.Error(err)
+				} else if html != serial[i] {
+					t.Errorf("concurrent render of document %d differs:\n%s\nvs serial:\n%s", i, html, serial[i])
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestMarkdownLineBreak(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("Roses are red,  \nviolets are blue\\\nend of the poem  \n\nLast line\\\n# Heading  \ntext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"Roses are red,<br>\nviolets are blue<br>\nend of the poem  </p>",
+		"Last line\\</p>",
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %q in %s", expected, html)
+		}
+	}
+	if strings.Count(string(html), "<br>") != 2 {
+		t.Errorf("expected exactly 2 line breaks in %s", html)
+	}
+}
+
+func TestMarkdownFootnotes(t *testing.T) {
+	t.Parallel()
+
+	html, err := mono.Markdown("Cats[^cat] purr[^2], dogs[^missing] bark[^cat].\n\n[^cat]: Felis catus.\n[^2]: Purring.\n[^unused]: Never referenced.\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := mono.MarkdownClasses["default"]
+	sup := `<sup class="` + classes["sup"] + `">`
+	for _, expected := range []string{
+		"Cats" + sup + `<a id="fnref-1" href="#fn-1">1</a></sup> purr` + sup + `<a id="fnref-2" href="#fn-2">2</a></sup>`,
+		"dogs[^missing] bark" + sup + `<a href="#fn-1">1</a></sup>.`,
+		`<section class="` + classes["footnotes"] + `"><ol class="` + classes["ol"] + `">` +
+			`<li id="fn-1" class="` + classes["li"] + `">Felis catus. <a href="#fnref-1">↩</a></li>` +
+			`<li id="fn-2" class="` + classes["li"] + `">Purring. <a href="#fnref-2">↩</a></li></ol></section>`,
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("expected %s in %s", expected, html)
+		}
+	}
+	if strings.Contains(string(html), "[^cat]:") || strings.Contains(string(html), "Never referenced") {
+		t.Errorf("definitions must be taken out of the text: %s", html)
+	}
+
+	if html, err := mono.Markdown("No such[^note] footnote."); err != nil || !strings.Contains(string(html), "No such[^note] footnote.") {
+		t.Errorf("undefined references must stay as text: %s (%v)", html, err)
+	}
+}
@@ -0,0 +1,59 @@
+package mono
+
+import (
+	"cmp"
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	metricsRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mono_http_requests_total",
+		Help: "Requests by route pattern, method and response status.",
+	}, []string{"route", "method", "status"})
+	metricsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mono_http_request_duration_seconds",
+		Help:    "Request latency by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	metricsRegister = sync.OnceFunc(func() {
+		prometheus.MustRegister(metricsRequests, metricsDuration)
+	})
+)
+
+// Metrics records request counts (by status) and latency histograms per route with prometheus, in its default
+// registry, see Server.Metrics to expose them. Routes are labeled by their pattern, not the path, so the labels
+// stay bounded. An error returned by a handler is counted with the status the server responds with (500 unless
+// it's a StatusError), even if the handler didn't write it. Register it last to time the rest of the middleware too:
+//
+//	server.Middleware(mono.Metrics()).Metrics("/metrics")
+func Metrics() MiddlewareFunc {
+	metricsRegister()
+	return func(handler HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			start := time.Now()
+			writer := &recordWriter{ResponseWriter: rw}
+			err := handler(ctx, writer, req)
+
+			route := cmp.Or(req.Pattern, "unmatched") // E.g. the NotFound handler.
+			status := strconv.Itoa(writer.responseStatus(err))
+			metricsRequests.WithLabelValues(route, req.Method, status).Inc()
+			metricsDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// Metrics serves the prometheus default registry at pattern (e.g. "/metrics"), the Metrics middleware included.
+func (server *serverDev) Metrics(pattern string) Server {
+	metrics := promhttp.Handler()
+	return server.Handler(pattern, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		metrics.ServeHTTP(rw, req)
+		return nil
+	})
+}
@@ -1,12 +1,21 @@
 package mono
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"math"
 	"net/http"
 	"os"
+	"regexp"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,10 +24,50 @@ import (
 const (
 	headerCacheControlDay  = "public, max-age=86400"
 	headerCacheControlWeek = "public, max-age=604800"
+	// headerCacheControlImmutable is for /mono/cdn/ assets, their urls change along with the contents.
+	headerCacheControlImmutable = "public, max-age=31536000, immutable"
+	// headerCacheControlPrivate is for pages rendered per request (RequestFuncs), shared caches mustn't keep them.
+	headerCacheControlPrivate = "private, no-cache"
+)
+
+// SecurityHeaders are set by SaneHeaders in prod, set a value to "" to omit a header.
+// COEP is "credentialless" rather than "require-corp": /mono/cdn/... assets are same-origin so they load either way,
+// but credentialless doesn't break cross-origin images and fonts lacking a Cross-Origin-Resource-Policy.
+var SecurityHeaders = map[string]string{
+	"Permissions-Policy":           "camera=(), microphone=(), geolocation=(), payment=(), usb=(), interest-cohort=()",
+	"Cross-Origin-Opener-Policy":   "same-origin",
+	"Cross-Origin-Embedder-Policy": "credentialless",
+	"Cross-Origin-Resource-Policy": "same-origin",
+}
+
+// DefaultRpsClientsHandler and DefaultRpsGlobalHandler respond to throttled requests, unless the limiter has its own
+// (RpsLimiterClients.Handler429, RpsLimiterGlobal.HandlerLimited): a client over its quota gets 429, while a global
+// overload is 503 (with Retry-After).
+var (
+	DefaultRpsClientsHandler HandlerFunc = defaultHandler429
+	DefaultRpsGlobalHandler  HandlerFunc = defaultHandler503
 )
 
 type MiddlewareFunc = func(handler HandlerFunc) HandlerFunc
 
+// MiddlewareChain composes middlewares into one, outermost first: MiddlewareChain(a, b)(handler) is a(b(handler)),
+// so a sees the request before b, and the response after it. Repeated Server.Middleware calls are the other way
+// around, the last registered is the outermost. A chain is a named stack for routes or the whole server, e.g.
+// api := MiddlewareChain(RpsLimitClients(10), Stealth()) for server.Handler("/api/", api(fn)) or server.Middleware(api).
+func MiddlewareChain(middlewares ...MiddlewareFunc) MiddlewareFunc {
+	return func(handler HandlerFunc) HandlerFunc {
+		for _, middleware := range slices.Backward(middlewares) {
+			handler = middleware(handler)
+		}
+		return handler
+	}
+}
+
+// StealthHeaders are removed from responses by Stealth, e.g. a Server header copied from a Proxy upstream.
+var StealthHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version", "X-Generator", "X-Runtime", "Via"}
+
+// SaneHeaders is the default header preset of New: nosniff, no framing, no caching (pages override it with
+// their max-age), and in prod a CSP along with SecurityHeaders.
 func SaneHeaders(handler HandlerFunc) HandlerFunc {
 	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
 		h := rw.Header()
@@ -27,52 +76,302 @@ func SaneHeaders(handler HandlerFunc) HandlerFunc {
 		h.Set("X-Frame-Options", "DENY")
 		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
 		h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		h.Set("Expires", "0")
 		if IsProd() {
 			// NOTE: this blocks <script src="https://cdn.tailwind.com"/>
 			h.Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'")
+			setSecurityHeaders(h)
 		}
 
 		return handler(ctx, rw, req)
 	}
 }
 
+// StrictHeaders is SaneHeaders with a tighter CSP (no plugins, no foreign forms or base), and HSTS in prod.
+func StrictHeaders(handler HandlerFunc) HandlerFunc {
+	return SaneHeaders(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		h := rw.Header()
+
+		h.Set("X-Permitted-Cross-Domain-Policies", "none")
+		if IsProd() {
+			h.Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; "+
+				"object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'")
+			h.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+
+		return handler(ctx, rw, req)
+	})
+}
+
+// MinimalHeaders only sets nosniff and the referrer policy, leaving caching and framing to the app (or a gateway).
+func MinimalHeaders(handler HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		h := rw.Header()
+
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+
+		return handler(ctx, rw, req)
+	}
+}
+
+func setSecurityHeaders(h http.Header) {
+	for key, value := range SecurityHeaders {
+		if value != "" {
+			h.Set(key, value)
+		}
+	}
+}
+
+// ServerSideTheme adds class="dark" to the <html> element of HTML responses when the theme cookie says dark,
+// so the page doesn't flash light before the theme script runs. Without the cookie (or with "system") it's a no-op.
+// Responses vary by Cookie then, and the ETags of dark ones get a "-dark" suffix, so caches keep the variants apart.
+func ServerSideTheme(handler HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		rw.Header().Add("Vary", "Cookie")
+		if ThemeFromRequest(req) != ThemeDark {
+			return handler(ctx, rw, req)
+		}
+
+		// The body gets rewritten, so ask for it uncompressed, and validate only the ETags of dark responses.
+		req = req.Clone(ctx)
+		req.Header.Del("Accept-Encoding")
+		if ifNoneMatch := themeETags(req.Header.Get("If-None-Match"), ThemeDark); ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		} else {
+			req.Header.Del("If-None-Match")
+		}
+		writer := &themeWriter{ResponseWriter: rw, class: ThemeDark}
+		err := handler(ctx, writer, req)
+		return errors.Join(err, writer.finish())
+	}
+}
+
+// themeETags keeps the ETags of If-None-Match with the class's suffix (and "*"), without the suffix.
+func themeETags(ifNoneMatch string, class string) string {
+	var result []string
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			result = append(result, candidate)
+		} else if etag, ok := strings.CutSuffix(candidate, "-"+class+`"`); ok {
+			result = append(result, etag+`"`)
+		}
+	}
+	return strings.Join(result, ", ")
+}
+
+// Stealth hardens against fingerprinting: StealthHeaders are removed from responses, and errors other than
+// StatusError respond with a bare "500 Internal Server Error", without panic messages or stacks (even outside prod).
+// The errors are still logged. Register it last, so headers set by other middleware are covered too.
+func Stealth() MiddlewareFunc {
+	return func(handler HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			writer := &stealthWriter{ResponseWriter: rw}
+			err := handler(ctx, writer, req)
+			if err == nil {
+				return nil
+			}
+			writer.strip() // The error is responded to with rw, by the server.
+			var statusErr StatusError
+			if errors.As(err, &statusErr) {
+				return err
+			}
+
+			var panicErr PanicError
+			if errors.As(err, &panicErr) {
+				Log.Error("handle error", "err", err.Error(), "stack", string(panicErr.Stack))
+			} else {
+				Log.Error("handle error", "err", err.Error())
+			}
+			return responseError(ctx, writer, req, http.StatusInternalServerError, "")
+		}
+	}
+}
+
+// CorsOptions configures Cors.
+type CorsOptions struct {
+	// AllowedOrigins are exact origins ("https://app.example.com"), subdomain wildcards ("https://*.example.com"),
+	// or "*" for any origin.
+	AllowedOrigins []string
+	AllowedMethods []string // Default: GET, HEAD, POST.
+	AllowedHeaders []string // Request headers of preflights, "*" allows whichever are asked for.
+	// AllowCredentials lets cookies and Authorization through, it requires explicit AllowedOrigins (not "*").
+	AllowCredentials bool
+	MaxAge           time.Duration // How long browsers cache a preflight, 0 leaves it to them.
+}
+
+// Cors answers CORS preflights (OPTIONS with Access-Control-Request-Method) of allowed origins with 204 and the
+// Access-Control-* headers, without reaching the handler, and adds the origin's headers to other responses.
+// Register it after the header preset (e.g. New's SaneHeaders), so it runs first: the CSP and SecurityHeaders
+// don't get in the way, browsers apply Cross-Origin-Resource-Policy to no-cors loads only.
+// It panics on AllowCredentials with "*" origins, as any site could then make credentialed requests.
+func Cors(opts CorsOptions) MiddlewareFunc {
+	methods := "GET, HEAD, POST"
+	if len(opts.AllowedMethods) > 0 {
+		methods = strings.Join(opts.AllowedMethods, ", ")
+	}
+	headers := strings.Join(opts.AllowedHeaders, ", ")
+	anyHeader := slices.Contains(opts.AllowedHeaders, "*")
+	anyOrigin := slices.Contains(opts.AllowedOrigins, "*")
+	if anyOrigin && opts.AllowCredentials {
+		panic(`Cors error: AllowCredentials requires explicit AllowedOrigins, not "*"`)
+	}
+	maxAge := strconv.Itoa(int(opts.MaxAge.Seconds()))
+
+	return func(handler HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			h := rw.Header()
+			origin := req.Header.Get("Origin")
+			if !anyOrigin {
+				h.Add("Vary", "Origin")
+			}
+			allowed := origin != "" && (anyOrigin || corsOriginAllowed(origin, opts.AllowedOrigins))
+			if allowed {
+				if anyOrigin {
+					h.Set("Access-Control-Allow-Origin", "*")
+				} else {
+					h.Set("Access-Control-Allow-Origin", origin)
+				}
+				if opts.AllowCredentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+			if !isPreflight(req) {
+				return handler(ctx, rw, req)
+			}
+
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if allowed {
+				h.Set("Access-Control-Allow-Methods", methods)
+				if requested := req.Header.Get("Access-Control-Request-Headers"); anyHeader && requested != "" {
+					h.Set("Access-Control-Allow-Headers", requested)
+				} else if headers != "" && !anyHeader {
+					h.Set("Access-Control-Allow-Headers", headers)
+				}
+				if opts.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", maxAge)
+				}
+			}
+			rw.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+}
+
+// isPreflight reports whether req is a CORS preflight rather than a plain OPTIONS request.
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func corsOriginAllowed(origin string, allowed []string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if origin == pattern {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(pattern, "*."); ok &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+suffix) &&
+			len(origin) > len(prefix)+len(suffix)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestLogOptions configures RequestLog, the zero value logs every request at slog.LevelInfo.
+type RequestLogOptions struct {
+	// SkipPaths aren't logged, an entry ending with "/" skips the subtree, e.g. "/healthz" or "/mono/cdn/".
+	SkipPaths []string
+	Level     slog.Level
+	Message   string                        // Default: "request".
+	Attrs     func(req *http.Request) []any // Appended to each record, e.g. the user agent.
+}
+
+// RequestLog logs a structured record per request through Log: method, path, status, bytes written, remote addr
+// and duration. As with Metrics, an error returned by the handler is logged with the status the server responds
+// with. Register it last to time the rest of the middleware too.
+func RequestLog(opts RequestLogOptions) MiddlewareFunc {
+	message := cmp.Or(opts.Message, "request")
+	return func(handler HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			if requestLogSkip(req.URL.Path, opts.SkipPaths) {
+				return handler(ctx, rw, req)
+			}
+
+			start := time.Now()
+			writer := &recordWriter{ResponseWriter: rw}
+			err := handler(ctx, writer, req)
+
+			attrs := []any{
+				"method", req.Method,
+				"path", req.URL.Path,
+				"status", writer.responseStatus(err),
+				"bytes", writer.bytes,
+				"remote", req.RemoteAddr,
+				"duration", time.Since(start),
+			}
+			if opts.Attrs != nil {
+				attrs = append(attrs, opts.Attrs(req)...)
+			}
+			Log.Log(ctx, opts.Level, message, attrs...)
+			return err
+		}
+	}
+}
+
+func requestLogSkip(path string, skip []string) bool {
+	for _, prefix := range skip {
+		if path == prefix || strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // RpsLimitClients shows 429 for each client, which len(requests) > quota in the last second.
 // Use RpsLimiterClients if you need a different timeout from 1s.
 func RpsLimitClients(quota int64, handler429 ...HandlerFunc) MiddlewareFunc {
 	limiter := &RpsLimiterClients{
 		Quota:      quota,
 		Timeout:    time.Second,
-		Handler429: def(handler429, defaultHandler429),
+		Handler429: def(handler429, DefaultRpsClientsHandler),
 	}
 	return limiter.Apply
 }
 
-func RpsLimitGlobal(quota int64, handler429 ...HandlerFunc) MiddlewareFunc {
+// RpsLimitGlobal shows 503 (DefaultRpsGlobalHandler) when all clients together made more than quota requests
+// in the last second.
+func RpsLimitGlobal(quota int64, handler503 ...HandlerFunc) MiddlewareFunc {
 	limiter := &RpsLimiterGlobal{
-		Quota:      quota,
-		Timeout:    time.Second,
-		Handler429: def(handler429, defaultHandler429),
+		Quota:          quota,
+		Timeout:        time.Second,
+		HandlerLimited: def(handler503, DefaultRpsGlobalHandler),
 	}
 	return limiter.Apply
 }
 
 type RpsLimiterGlobal struct {
-	Quota      int64
-	Timeout    time.Duration
-	Handler429 HandlerFunc
-	Cleans     chan time.Time
-	checkedEnv bool
-	state      atomic.Int64
-	cleaning   atomic.Bool
+	Quota   int64
+	Timeout time.Duration
+	// HandlerLimited responds to throttled requests (Retry-After is already set), default: DefaultRpsGlobalHandler (503).
+	HandlerLimited HandlerFunc
+	Allowlist      []string // CIDRs or IPs never throttled nor counted, e.g. health checks and monitoring.
+	Cleans         chan time.Time
+	checkedEnv     bool
+	state          atomic.Int64
+	cleaning       atomic.Bool
+	throttled      atomic.Int64
 }
 
 func (limiter *RpsLimiterGlobal) Apply(handler HandlerFunc) HandlerFunc {
 	if limiter.Timeout == 0 {
 		limiter.Timeout = time.Second
 	}
-	if limiter.Handler429 == nil {
-		limiter.Handler429 = defaultHandler429
+	if limiter.HandlerLimited == nil {
+		limiter.HandlerLimited = DefaultRpsGlobalHandler
 	}
 	if limiter.Cleans == nil {
 		limiter.Cleans = make(chan time.Time, limiter.Quota)
@@ -93,9 +392,16 @@ func (limiter *RpsLimiterGlobal) Apply(handler HandlerFunc) HandlerFunc {
 	}
 
 	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		if ipInList(remoteIP(req), limiter.Allowlist) {
+			return handler(ctx, rw, req)
+		}
 		defer func() { limiter.Cleans <- time.Now().Add(limiter.Timeout) }()
 		if limiter.state.Add(1) > limiter.Quota {
-			return limiter.Handler429(ctx, rw, req)
+			limiter.throttled.Add(1)
+			if rw != nil {
+				rw.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(limiter.Timeout.Seconds())), 10))
+			}
+			return limiter.HandlerLimited(ctx, rw, req)
 		}
 		return handler(ctx, rw, req)
 	}
@@ -105,10 +411,13 @@ type RpsLimiterClients struct {
 	Quota      int64
 	Timeout    time.Duration
 	Handler429 HandlerFunc
+	Allowlist  []string // CIDRs or IPs never throttled nor counted, e.g. health checks and monitoring.
 	mutex      sync.Mutex
 	limits     map[string]int64
 	checkedEnv bool
-	cleans     []limitClean
+	cleans     []limitClean // Sorted by After.
+	epoch      time.Time
+	throttled  atomic.Int64
 }
 
 func (limit *RpsLimiterClients) Apply(handler HandlerFunc) HandlerFunc {
@@ -122,11 +431,15 @@ func (limit *RpsLimiterClients) Apply(handler HandlerFunc) HandlerFunc {
 		limit.Timeout = time.Second
 	}
 	if limit.Handler429 == nil {
-		limit.Handler429 = defaultHandler429
+		limit.Handler429 = DefaultRpsClientsHandler
 	}
 
 	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		if ipInList(remoteIP(req), limit.Allowlist) {
+			return handler(ctx, rw, req)
+		}
 		if limit.rate(req.RemoteAddr) > limit.Quota {
+			limit.throttled.Add(1)
 			return limit.Handler429(ctx, rw, req)
 		}
 		return handler(ctx, rw, req)
@@ -137,40 +450,102 @@ func (limit *RpsLimiterClients) rate(addr string) int64 {
 	limit.mutex.Lock()
 	defer limit.mutex.Unlock()
 
+	// Durations since the epoch are monotonic, so wall clock jumps neither expire nor stick requests.
+	if limit.epoch.IsZero() {
+		limit.epoch = time.Now()
+	}
+	current := time.Since(limit.epoch)
+
 	limit.limits[addr] += 1
-	current := time.Now()
-	cleaned := -1
-	for i, clean := range limit.cleans {
-		if clean.After.After(current) {
+	cleaned := 0
+	for _, clean := range limit.cleans {
+		if clean.After > current {
 			break
 		}
-		cleaned = i
-		limit.limits[clean.RemoteAddr] -= 1
-		if limit.limits[clean.RemoteAddr] == 0 {
+		cleaned++
+		if limit.limits[clean.RemoteAddr] <= 1 {
 			delete(limit.limits, clean.RemoteAddr)
+		} else {
+			limit.limits[clean.RemoteAddr] -= 1
 		}
 	}
+	limit.cleans = limit.cleans[cleaned:]
 
-	limit.cleans = append(
-		limit.cleans[cleaned+1:],
-		limitClean{
-			RemoteAddr: addr,
-			After:      current.Add(limit.Timeout),
-		},
-	)
+	// Timeout may be changed on the fly, so a new clean isn't necessarily the last one.
+	next := limitClean{RemoteAddr: addr, After: current + limit.Timeout}
+	at := len(limit.cleans)
+	for at > 0 && limit.cleans[at-1].After > next.After {
+		at--
+	}
+	limit.cleans = slices.Insert(limit.cleans, at, next)
 	return limit.limits[addr]
 }
 
+// Snapshot copies the current per-client counts (requests within the last Timeout, throttled ones included).
+func (limit *RpsLimiterClients) Snapshot() RpsLimiterSnapshot {
+	limit.mutex.Lock()
+	clients := maps.Clone(limit.limits)
+	limit.mutex.Unlock()
+
+	snapshot := RpsLimiterSnapshot{Clients: clients, Throttled: limit.throttled.Load()}
+	for _, count := range clients {
+		snapshot.Current += count
+	}
+	return snapshot
+}
+
+// Snapshot of the global limiter has no Clients, only the totals.
+func (limiter *RpsLimiterGlobal) Snapshot() RpsLimiterSnapshot {
+	return RpsLimiterSnapshot{Current: max(limiter.state.Load(), 0), Throttled: limiter.throttled.Load()}
+}
+
+// RpsLimiterSnapshot is a copy of a limiter's state, safe to inspect (or serialize) without blocking requests.
+type RpsLimiterSnapshot struct {
+	Clients   map[string]int64 // Requests within the window by client address.
+	Current   int64            // Requests within the window.
+	Throttled int64            // Requests rejected since the start.
+}
+
+type RpsLimiterClientCount struct {
+	RemoteAddr string
+	Count      int64
+}
+
+// Top returns up to n clients with the most requests within the window, the most active first, n <= 0 is all of them.
+func (snapshot RpsLimiterSnapshot) Top(n int) []RpsLimiterClientCount {
+	result := make([]RpsLimiterClientCount, 0, len(snapshot.Clients))
+	for addr, count := range snapshot.Clients {
+		result = append(result, RpsLimiterClientCount{RemoteAddr: addr, Count: count})
+	}
+	slices.SortFunc(result, func(a, b RpsLimiterClientCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.RemoteAddr, b.RemoteAddr))
+	})
+	if n <= 0 {
+		return result
+	}
+	return result[:min(n, len(result))]
+}
+
 type limitClean struct {
-	After      time.Time
+	After      time.Duration // Since RpsLimiterClients.epoch.
 	RemoteAddr string
 }
 
+// PanicError is a recovered handler panic, outside of prod its message and stack are shown in the 500 response.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+var _ error = PanicError{}
+
+func (err PanicError) Error() string { return fmt.Sprintf("panic: %v", err.Value) }
+
 func interpretPanicsAsError(handler HandlerFunc) HandlerFunc {
 	return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) (err error) {
 		defer func() {
 			if r := recover(); r != nil {
-				err = errors.Join(err, fmt.Errorf("panic: %v", r))
+				err = errors.Join(err, PanicError{Value: r, Stack: debug.Stack()})
 			}
 		}()
 
@@ -179,7 +554,14 @@ func interpretPanicsAsError(handler HandlerFunc) HandlerFunc {
 }
 
 func defaultHandler429(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
-	return responseError(rw, http.StatusTooManyRequests)
+	return responseError(ctx, rw, req, http.StatusTooManyRequests, "")
+}
+
+func defaultHandler503(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+	if rw.Header().Get("Retry-After") == "" {
+		rw.Header().Set("Retry-After", "1")
+	}
+	return responseError(ctx, rw, req, http.StatusServiceUnavailable, "")
 }
 
 func tryQuotaFromEnv(env string, checked *bool, quota *int64) (ok bool) {
@@ -202,3 +584,165 @@ func tryQuotaFromEnv(env string, checked *bool, quota *int64) (ok bool) {
 	*quota = parsed
 	return *quota > 0
 }
+
+// themeWriter buffers HTML responses (and only them) for ServerSideTheme.
+type themeWriter struct {
+	http.ResponseWriter
+	class   string
+	status  int
+	decided bool
+	buffer  *bytes.Buffer
+}
+
+func (writer *themeWriter) WriteHeader(status int) {
+	if writer.decided {
+		return
+	}
+	writer.decided = true
+	writer.status = status
+	h := writer.Header()
+	if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+writer.class+`"`)
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/html") && h.Get("Content-Encoding") == "" {
+		writer.buffer = bytes.NewBuffer(nil)
+		return
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *themeWriter) Write(data []byte) (int, error) {
+	if !writer.decided {
+		writer.WriteHeader(http.StatusOK)
+	}
+	if writer.buffer != nil {
+		return writer.buffer.Write(data)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *themeWriter) Flush() {
+	if writer.buffer != nil {
+		return
+	}
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (writer *themeWriter) Unwrap() http.ResponseWriter { return writer.ResponseWriter }
+
+func (writer *themeWriter) finish() error {
+	if writer.buffer == nil {
+		return nil
+	}
+	data := htmlRootWithClass(writer.buffer.Bytes(), writer.class)
+	writer.Header().Del("Content-Length")
+	writer.ResponseWriter.WriteHeader(writer.status)
+	_, err := writer.ResponseWriter.Write(data)
+	return err
+}
+
+// recordWriter records the response status and size, for Metrics and RequestLog.
+type recordWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (writer *recordWriter) WriteHeader(status int) {
+	if writer.status == 0 && status >= 200 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *recordWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	n, err := writer.ResponseWriter.Write(data)
+	writer.bytes += n
+	return n, err
+}
+
+func (writer *recordWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (writer *recordWriter) Unwrap() http.ResponseWriter { return writer.ResponseWriter }
+
+// responseStatus is the status written, or the one the server responds with to the handler's err
+// (see responseFromError), as it's written after the middleware returns.
+func (writer *recordWriter) responseStatus(err error) int {
+	if writer.status != 0 {
+		return writer.status
+	}
+	if err == nil {
+		return http.StatusOK
+	}
+	var statusErr StatusError
+	if errors.As(err, &statusErr) && statusErr.Status >= 100 && statusErr.Status < len(statusMessageCache) {
+		return statusErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// stealthWriter removes StealthHeaders right before they're sent.
+type stealthWriter struct {
+	http.ResponseWriter
+}
+
+func (writer *stealthWriter) WriteHeader(status int) {
+	writer.strip()
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *stealthWriter) Write(data []byte) (int, error) {
+	writer.strip()
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *stealthWriter) strip() {
+	h := writer.Header()
+	for _, header := range StealthHeaders {
+		h.Del(header)
+	}
+}
+
+func (writer *stealthWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (writer *stealthWriter) Unwrap() http.ResponseWriter { return writer.ResponseWriter }
+
+var (
+	htmlRootTag   = regexp.MustCompile(`(?i)<html(\s[^>]*)?>`)
+	htmlClassAttr = regexp.MustCompile(`(?i)\sclass\s*=\s*"([^"]*)"`)
+)
+
+// htmlRootWithClass adds class to the first <html> tag, keeping its other attributes intact.
+func htmlRootWithClass(data []byte, class string) []byte {
+	loc := htmlRootTag.FindIndex(data)
+	if loc == nil {
+		return data
+	}
+	tag := data[loc[0]:loc[1]]
+
+	var updated []byte
+	if attr := htmlClassAttr.FindSubmatchIndex(tag); attr != nil {
+		classes := strings.Fields(string(tag[attr[2]:attr[3]]))
+		if slices.Contains(classes, class) {
+			return data
+		}
+		classes = append(classes, class)
+		updated = slices.Concat(tag[:attr[2]], []byte(strings.Join(classes, " ")), tag[attr[3]:])
+	} else {
+		updated = slices.Concat(tag[:len(tag)-1], []byte(fmt.Sprintf(` class="%s">`, class)))
+	}
+	return slices.Concat(data[:loc[0]], updated, data[loc[1]:])
+}
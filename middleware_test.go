@@ -4,8 +4,12 @@ import (
 	"context"
 	"fmt"
 	"github.com/kittenbark/mono"
+	"github.com/kittenbark/mono/monotest"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -236,7 +240,7 @@ func BenchmarkRpsLimiterGlobal(b *testing.B) {
 	limiter := &mono.RpsLimiterGlobal{
 		Quota:   100,
 		Timeout: time.Microsecond * 100,
-		Handler429: func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		HandlerLimited: func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
 			timeouts.Add(1)
 			return nil
 		},
@@ -266,3 +270,537 @@ func BenchmarkRpsLimiterGlobal(b *testing.B) {
 		b.Fatal("no timeout?")
 	}
 }
+
+func TestServerSideTheme(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		Middleware(mono.ServerSideTheme).
+		Page("/", mono.Html(`<!DOCTYPE html><html lang="en"><body>hi</body></html>`)).
+		Page("/styled", mono.Html(`<html class="font-sans"><body>hi</body></html>`))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for _, tc := range []struct {
+		path     string
+		cookie   string
+		expected string
+	}{
+		{path: "/", cookie: "", expected: `<!DOCTYPE html><html lang="en"><body>hi</body></html>`},
+		{path: "/", cookie: "mono_theme=system", expected: `<!DOCTYPE html><html lang="en"><body>hi</body></html>`},
+		{path: "/", cookie: "mono_theme=dark", expected: `<!DOCTYPE html><html lang="en" class="dark"><body>hi</body></html>`},
+		{path: "/styled", cookie: "mono_theme=dark", expected: `<html class="font-sans dark"><body>hi</body></html>`},
+	} {
+		// Dark responses are rewritten, so those are served uncompressed even to gzip-accepting clients.
+		acceptEncoding := "identity"
+		if strings.Contains(tc.cookie, "dark") {
+			acceptEncoding = "gzip"
+		}
+		resp, body := cl.Do(t, http.MethodGet, tc.path, "Cookie", tc.cookie, "Accept-Encoding", acceptEncoding)
+		if string(body) != tc.expected {
+			t.Errorf(`%s (cookie "%s"): expected "%s", got "%s"`, tc.path, tc.cookie, tc.expected, body)
+		}
+		if !slices.Contains(resp.Header.Values("Vary"), "Cookie") {
+			t.Errorf(`%s (cookie "%s"): expected Vary: Cookie, got %q`, tc.path, tc.cookie, resp.Header.Values("Vary"))
+		}
+	}
+
+	// The light and dark variants have distinct ETags, neither validates the other.
+	light, _ := cl.Do(t, http.MethodGet, "/", "Accept-Encoding", "identity")
+	dark, _ := cl.Do(t, http.MethodGet, "/", "Cookie", "mono_theme=dark")
+	lightETag, darkETag := light.Header.Get("ETag"), dark.Header.Get("ETag")
+	if lightETag == "" || darkETag != strings.TrimSuffix(lightETag, `"`)+`-dark"` {
+		t.Fatalf(`expected the dark ETag to be the light one with "-dark", got %s and %s`, lightETag, darkETag)
+	}
+	for _, tc := range []struct {
+		cookie   string
+		etag     string
+		expected int
+	}{
+		{cookie: "mono_theme=dark", etag: lightETag, expected: http.StatusOK},
+		{cookie: "mono_theme=dark", etag: darkETag, expected: http.StatusNotModified},
+		{cookie: "", etag: darkETag, expected: http.StatusOK},
+		{cookie: "", etag: lightETag, expected: http.StatusNotModified},
+	} {
+		resp, body := cl.Do(t, http.MethodGet, "/", "Cookie", tc.cookie, "If-None-Match", tc.etag, "Accept-Encoding", "identity")
+		if resp.StatusCode != tc.expected {
+			t.Errorf(`cookie "%s", If-None-Match %s: expected %d, got %d %q`, tc.cookie, tc.etag, tc.expected, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestSaneHeaders_SecurityHeaders(t *testing.T) {
+	env := mono.CurrentEnv
+	defer func() { mono.CurrentEnv = env }()
+	mono.CurrentEnv = mono.EnvProd
+
+	cl, server := PrepareTest()
+	server.
+		Page("/", mono.Html("home")).
+		Page("/mono/cdn/file/logo.txt", mono.BuiltPage{Data: []byte("logo"), ContentType: "text/plain"})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for _, path := range []string{"/", "/mono/cdn/file/logo.txt"} {
+		resp, body := cl.Do(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Fatalf("%s: expected 200 with a body, got %d %q", path, resp.StatusCode, body)
+		}
+		for key, value := range mono.SecurityHeaders {
+			if actual := resp.Header.Get(key); actual != value {
+				t.Errorf(`%s: expected %s "%s", got "%s"`, path, key, value, actual)
+			}
+		}
+	}
+}
+
+func TestSaneHeaders_Caching(t *testing.T) {
+	defer mono.ResetDefaults()
+	mono.CurrentEnv = mono.EnvProd
+
+	cl, server := PrepareTest()
+	server.
+		Page("/", mono.Html("home")).
+		Page("/style.css", mono.BuiltPage{Data: []byte("p{}"), ContentType: "text/css; charset=utf-8"}).
+		Handler("/api", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil })
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for path, expected := range map[string]string{
+		"/":          "public, max-age=86400",
+		"/style.css": "public, max-age=604800",
+		"/api":       "no-cache, no-store, must-revalidate",
+	} {
+		resp, _ := cl.Do(t, http.MethodGet, path)
+		if values := resp.Header.Values("Cache-Control"); len(values) != 1 || values[0] != expected {
+			t.Errorf("%s: expected a single Cache-Control %q, got %q", path, expected, values)
+		}
+		if expires := resp.Header.Values("Expires"); len(expires) != 0 {
+			t.Errorf("%s: expected no Expires along with Cache-Control, got %q", path, expires)
+		}
+	}
+}
+
+func TestNewWithoutDefaults(t *testing.T) {
+	t.Parallel()
+
+	presets := []struct {
+		name    string
+		preset  mono.MiddlewareFunc
+		present []string
+		absent  []string
+	}{
+		{"none", nil, nil, []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy"}},
+		{"minimal", mono.MinimalHeaders, []string{"X-Content-Type-Options", "Referrer-Policy"}, []string{"X-Frame-Options"}},
+		{"sane", mono.SaneHeaders, []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy"}, []string{"X-Permitted-Cross-Domain-Policies"}},
+		{"strict", mono.StrictHeaders, []string{"X-Content-Type-Options", "X-Frame-Options", "X-Permitted-Cross-Domain-Policies"}, nil},
+	}
+	for _, preset := range presets {
+		t.Run(preset.name, func(t *testing.T) {
+			t.Parallel()
+
+			addr := fmt.Sprintf(":%d", port.Add(1))
+			cl := MonoClient{url: fmt.Sprintf("http://localhost%s", addr)}
+			server := mono.NewWithoutDefaults().Addr(addr)
+			if preset.preset != nil {
+				server.Middleware(preset.preset)
+			}
+			server.Page("/", mono.Html("home"))
+			StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+			resp, body := cl.Do(t, http.MethodGet, "/")
+			if string(body) != "home" {
+				t.Fatalf(`expected "home", got "%s"`, body)
+			}
+			for _, key := range preset.present {
+				if resp.Header.Get(key) == "" {
+					t.Errorf("expected %s to be set", key)
+				}
+			}
+			for _, key := range preset.absent {
+				if value := resp.Header.Get(key); value != "" {
+					t.Errorf(`expected no %s, got "%s"`, key, value)
+				}
+			}
+		})
+	}
+}
+
+func TestRpsLimiterClients_VaryingTimeout(t *testing.T) {
+	t.Parallel()
+
+	throttled := atomic.Int64{}
+	limiter := &mono.RpsLimiterClients{
+		Quota:   3,
+		Timeout: 50 * time.Millisecond,
+		Handler429: func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			throttled.Add(1)
+			return nil
+		},
+	}
+	ok := atomic.Int64{}
+	handler := limiter.Apply(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		ok.Add(1)
+		return nil
+	})
+	request := func(addr string) {
+		if err := handler(t.Context(), nil, &http.Request{RemoteAddr: addr}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Shrinking and growing timeouts mid-flight with bursty arrivals used to break the cleans ordering.
+	for i := range 200 {
+		limiter.Timeout = time.Duration(1+rand.Intn(20)) * time.Millisecond
+		for range rand.Intn(5) {
+			request(fmt.Sprintf("127.0.0.1:%d", 1000+i%3))
+		}
+		if rand.Intn(10) == 0 {
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// Every client starts from scratch: exactly the quota passes (a negative count would let more through).
+	limiter.Timeout = time.Second
+	for _, addr := range []string{"127.0.0.1:1000", "127.0.0.1:1001", "127.0.0.1:1002"} {
+		ok.Store(0)
+		throttled.Store(0)
+		for range 5 {
+			request(addr)
+		}
+		if ok.Load() != 3 || throttled.Load() != 2 {
+			t.Errorf("%s: expected 3 ok and 2 throttled, got %d and %d", addr, ok.Load(), throttled.Load())
+		}
+	}
+}
+
+func TestRpsLimiterClients_Snapshot(t *testing.T) {
+	t.Parallel()
+
+	limiter := &mono.RpsLimiterClients{
+		Quota:      2,
+		Timeout:    time.Minute,
+		Handler429: func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil },
+	}
+	handler := limiter.Apply(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil })
+	for _, addr := range []string{"127.0.0.1:1", "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:1"} {
+		if err := handler(t.Context(), nil, &http.Request{RemoteAddr: addr}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := limiter.Snapshot()
+	if snapshot.Clients["127.0.0.1:1"] != 3 || snapshot.Clients["127.0.0.1:2"] != 1 || snapshot.Current != 4 || snapshot.Throttled != 1 {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+	if top := snapshot.Top(1); len(top) != 1 || top[0].RemoteAddr != "127.0.0.1:1" || top[0].Count != 3 {
+		t.Errorf("unexpected top: %+v", top)
+	}
+	for _, n := range []int{0, -1} {
+		if top := snapshot.Top(n); len(top) != 2 || top[0].RemoteAddr != "127.0.0.1:1" {
+			t.Errorf("Top(%d): expected all clients, got %+v", n, top)
+		}
+	}
+
+	snapshot.Clients["127.0.0.1:2"] = 100
+	if limiter.Snapshot().Clients["127.0.0.1:2"] != 1 {
+		t.Error("snapshot must be a copy")
+	}
+}
+
+func TestRpsLimitGlobal_Default503(t *testing.T) {
+	t.Parallel()
+
+	handler := mono.RpsLimitGlobal(1)(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		return nil
+	})
+	statuses := []int{}
+	for range 2 {
+		rw := httptest.NewRecorder()
+		if err := handler(t.Context(), rw, httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, rw.Code)
+		if rw.Code == http.StatusServiceUnavailable && rw.Header().Get("Retry-After") != "1" {
+			t.Errorf("expected Retry-After: 1, got %q", rw.Header().Get("Retry-After"))
+		}
+	}
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusServiceUnavailable {
+		t.Errorf("expected 200 then 503, got %v", statuses)
+	}
+}
+
+func TestRpsLimiter_Allowlist(t *testing.T) {
+	t.Parallel()
+
+	throttled := atomic.Int64{}
+	handler429 := func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		throttled.Add(1)
+		return nil
+	}
+	clients := &mono.RpsLimiterClients{Quota: 2, Timeout: time.Minute, Handler429: handler429, Allowlist: []string{"10.0.0.0/8"}}
+	global := &mono.RpsLimiterGlobal{Quota: 2, Timeout: time.Minute, HandlerLimited: handler429, Allowlist: []string{"10.1.2.3"}}
+	handler := clients.Apply(global.Apply(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		return nil
+	}))
+
+	for range 50 {
+		if err := handler(t.Context(), nil, &http.Request{RemoteAddr: "10.1.2.3:4000"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if throttled.Load() != 0 || global.Snapshot().Current != 0 || clients.Snapshot().Current != 0 {
+		t.Errorf("allowlisted requests must be neither throttled nor counted (throttled=%d)", throttled.Load())
+	}
+
+	for range 3 {
+		if err := handler(t.Context(), nil, &http.Request{RemoteAddr: "192.168.0.1:4000"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if throttled.Load() != 1 {
+		t.Errorf("expected the 3rd request of a regular client to be throttled, got %d", throttled.Load())
+	}
+}
+
+func TestStealth(t *testing.T) {
+	t.Parallel()
+
+	identify := func(rw http.ResponseWriter) {
+		rw.Header().Set("Server", "nginx/1.25")
+		rw.Header().Set("X-Powered-By", "PHP/8.3")
+	}
+	cl, server := PrepareTest()
+	server.
+		Middleware(mono.Stealth()).
+		Handler("/ok", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			identify(rw)
+			_, err := rw.Write([]byte("ok"))
+			return err
+		}).
+		Handler("/panic", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			identify(rw)
+			panic("secret details")
+		}).
+		Handler("/missing", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			identify(rw)
+			return mono.NewStatusError(http.StatusNotFound, "no such thing")
+		})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for path, expected := range map[string]struct {
+		status int
+		body   string
+	}{
+		"/ok":      {http.StatusOK, "ok"},
+		"/panic":   {http.StatusInternalServerError, "500 Internal Server Error"},
+		"/missing": {http.StatusNotFound, "404 no such thing"},
+	} {
+		resp, body := cl.Do(t, http.MethodGet, path)
+		if resp.StatusCode != expected.status || string(body) != expected.body {
+			t.Errorf("%s: expected %d %q, got %d %q", path, expected.status, expected.body, resp.StatusCode, body)
+		}
+		for _, header := range mono.StealthHeaders {
+			if value := resp.Header.Get(header); value != "" {
+				t.Errorf("%s: expected no %s header, got %q", path, header, value)
+			}
+		}
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	t.Parallel()
+
+	trace := func(name string) mono.MiddlewareFunc {
+		return func(handler mono.HandlerFunc) mono.HandlerFunc {
+			return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+				rw.Header().Add("X-Trace", name+" in")
+				err := handler(ctx, rw, req)
+				_, _ = fmt.Fprintf(rw, " %s out", name)
+				return err
+			}
+		}
+	}
+	handler := func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		_, err := rw.Write([]byte("handler"))
+		return err
+	}
+
+	cl, server := PrepareTest()
+	server.
+		Handler("/chain", mono.MiddlewareChain(trace("a"), trace("b"), trace("c"))(handler)).
+		Handler("/empty", mono.MiddlewareChain()(handler)).
+		Middleware(trace("a")).
+		Middleware(trace("b")).
+		Handler("/server", handler)
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	for path, expected := range map[string]struct{ in, out string }{
+		"/chain":  {"a in,b in,c in", "handler c out b out a out"}, // Outermost first.
+		"/empty":  {"", "handler"},
+		"/server": {"b in,a in", "handler a out b out"}, // The last registered is the outermost.
+	} {
+		resp, body := cl.Do(t, http.MethodGet, path)
+		if in := strings.Join(resp.Header.Values("X-Trace"), ","); in != expected.in || string(body) != expected.out {
+			t.Errorf("%s: expected %q then %q, got %q then %q", path, expected.in, expected.out, in, body)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		Middleware(mono.Metrics()).
+		Metrics("/metrics").
+		Get("/metered/ok", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := rw.Write([]byte("ok"))
+			return err
+		}).
+		Get("/metered/missing", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			return mono.NewStatusError(http.StatusNotFound, "no such thing")
+		}).
+		Get("/metered/boom", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			panic("boom")
+		}).
+		Post("/metered/{id}", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			rw.WriteHeader(http.StatusCreated)
+			return nil
+		})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	for _, request := range []struct{ method, path string }{
+		{http.MethodGet, "/metered/ok"},
+		{http.MethodGet, "/metered/missing"},
+		{http.MethodGet, "/metered/boom"},
+		{http.MethodPost, "/metered/1"},
+		{http.MethodPost, "/metered/2"},
+	} {
+		cl.Do(t, request.method, request.path)
+	}
+
+	metrics := string(cl.Get(t, "/metrics"))
+	for _, expected := range []string{
+		`mono_http_requests_total{method="GET",route="GET /metered/ok",status="200"}`,
+		`mono_http_requests_total{method="GET",route="GET /metered/missing",status="404"}`,
+		`mono_http_requests_total{method="GET",route="GET /metered/boom",status="500"}`,
+		`mono_http_requests_total{method="POST",route="POST /metered/{id}",status="201"}`,
+		`mono_http_request_duration_seconds_count{method="GET",route="GET /metered/ok"}`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected %s in metrics:\n%s", expected, metrics)
+		}
+	}
+	if strings.Contains(metrics, `route="/metered/1"`) {
+		t.Error("expected routes to be labeled by pattern, not path")
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	logs := monotest.CaptureLogs(t)
+
+	hello := func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		_, err := rw.Write([]byte("hello"))
+		return err
+	}
+	cl, server := PrepareTest()
+	server.
+		Middleware(mono.RequestLog(mono.RequestLogOptions{
+			SkipPaths: []string{"/healthz", "/mono/cdn/"},
+			Attrs:     func(req *http.Request) []any { return []any{"agent", req.UserAgent()} },
+		})).
+		Get("/hello", hello).
+		Get("/healthz", hello).
+		Get("/mono/cdn/app.css", hello).
+		Get("/gone", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			return mono.NewStatusError(http.StatusGone, "")
+		})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for _, path := range []string{"/hello", "/healthz", "/mono/cdn/app.css", "/gone"} {
+		cl.Get(t, path)
+	}
+	for _, expected := range []string{
+		`level=INFO msg=request method=GET path=/hello status=200 bytes=5 remote=127.0.0.1:`,
+		`method=GET path=/gone status=410 bytes=0`,
+		`agent=Go-http-client/1.1`,
+	} {
+		if !logs.Contains(expected) {
+			t.Errorf("expected %q in logs: %s", expected, logs.String())
+		}
+	}
+	for _, skipped := range []string{"path=/healthz", "path=/mono/cdn/"} {
+		if logs.Contains(skipped) {
+			t.Errorf("expected %s to be skipped, got logs: %s", skipped, logs.String())
+		}
+	}
+}
+
+func TestCors(t *testing.T) {
+	t.Parallel()
+
+	items := func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		_, err := rw.Write([]byte("items"))
+		return err
+	}
+	cl, server := PrepareTest()
+	server.
+		Middleware(mono.Cors(mono.CorsOptions{
+			AllowedOrigins:   []string{"https://app.example.com", "https://*.kitten.dev"},
+			AllowedMethods:   []string{http.MethodGet, http.MethodPut},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			AllowCredentials: true,
+			MaxAge:           time.Minute * 10,
+		})).
+		Get("/api/items", items).
+		Put("/api/items", items)
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	preflight := func(origin string) *http.Response {
+		resp, _ := cl.Do(t, http.MethodOptions, "/api/items",
+			"Origin", origin, "Access-Control-Request-Method", "PUT", "Access-Control-Request-Headers", "content-type")
+		return resp
+	}
+	for _, origin := range []string{"https://app.example.com", "https://docs.kitten.dev"} {
+		resp := preflight(origin)
+		h := resp.Header
+		if resp.StatusCode != http.StatusNoContent ||
+			h.Get("Access-Control-Allow-Origin") != origin ||
+			h.Get("Access-Control-Allow-Methods") != "GET, PUT" ||
+			h.Get("Access-Control-Allow-Headers") != "Content-Type, Authorization" ||
+			h.Get("Access-Control-Allow-Credentials") != "true" ||
+			h.Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("%s: unexpected preflight %d %v", origin, resp.StatusCode, h)
+		}
+	}
+	for _, origin := range []string{"https://evil.example.com", "https://kitten.dev.evil.com"} {
+		if resp := preflight(origin); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: expected a preflight without cors headers, got %d %v", origin, resp.StatusCode, resp.Header)
+		}
+	}
+
+	resp, body := cl.Do(t, http.MethodGet, "/api/items", "Origin", "https://app.example.com")
+	if string(body) != "items" ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		!slices.Contains(resp.Header.Values("Vary"), "Origin") ||
+		resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expected cors headers along with the preset ones, got %v %q", resp.Header, body)
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/api/items"); resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no cors headers without Origin, got %v", resp.Header)
+	}
+	if resp, _ := cl.Do(t, http.MethodOptions, "/api/items"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected plain OPTIONS to stay 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestCors_AnyOriginWithCredentials(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Error(`expected a panic for AllowCredentials with "*" origins`)
+		}
+	}()
+	mono.Cors(mono.CorsOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+}
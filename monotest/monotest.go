@@ -0,0 +1,109 @@
+// Package monotest runs mono servers in tests, in memory via httptest, e.g.:
+//
+//	client := monotest.Start(t, mono.New().Page("/", mono.Nextjs("./app")))
+//	resp, body := client.Get("/")
+//
+// Env and CaptureLogs change package globals (mono.CurrentEnv and mono.Log), tests calling them mustn't be parallel.
+package monotest
+
+import (
+	"bytes"
+	"github.com/kittenbark/mono"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Client requests the server of Start, failing the test on transport errors.
+type Client struct {
+	URL    string // e.g. "http://127.0.0.1:34567", without a trailing slash.
+	Client *http.Client
+	t      testing.TB
+}
+
+// Start builds server and serves it with httptest until the test ends, a build error fails the test.
+func Start(t testing.TB, server mono.Server) *Client {
+	t.Helper()
+	handler, err := server.Build()
+	if err != nil {
+		t.Fatalf("monotest.Start: %v", err)
+	}
+
+	internal := httptest.NewServer(handler)
+	t.Cleanup(internal.Close)
+	t.Cleanup(server.Stop) // Runs first, so streaming handlers don't keep Close waiting.
+	return &Client{URL: internal.URL, Client: internal.Client(), t: t}
+}
+
+// Get requests path, which may have a query, e.g. "/search?q=mono".
+func (client *Client) Get(path string, headers ...string) (*http.Response, []byte) {
+	client.t.Helper()
+	return client.Do(client.Request(http.MethodGet, path, nil, headers...))
+}
+
+// Request is a request to path with headers as key-value pairs, e.g. "Accept", "application/json".
+func (client *Client) Request(method string, path string, body io.Reader, headers ...string) *http.Request {
+	client.t.Helper()
+	req, err := http.NewRequestWithContext(client.t.Context(), method, client.URL+path, body)
+	if err != nil {
+		client.t.Fatalf("monotest: %v", err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	return req
+}
+
+// Do sends req and reads the whole body.
+func (client *Client) Do(req *http.Request) (*http.Response, []byte) {
+	client.t.Helper()
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		client.t.Fatalf("monotest: %s %s: %v", req.Method, req.URL, err)
+	}
+	defer func(body io.ReadCloser) { _ = body.Close() }(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		client.t.Fatalf("monotest: %s %s: reading body: %v", req.Method, req.URL, err)
+	}
+	return resp, body
+}
+
+// Env sets mono.CurrentEnv until the test ends (all mono defaults are reset then), call it before building the server.
+func Env(t testing.TB, env mono.Environment) {
+	t.Cleanup(mono.ResetDefaults)
+	mono.CurrentEnv = env
+}
+
+// Logs are mono.Log records captured by CaptureLogs, as slog text lines.
+type Logs struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (logs *Logs) Write(data []byte) (int, error) {
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+	return logs.buf.Write(data)
+}
+
+func (logs *Logs) String() string {
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+	return logs.buf.String()
+}
+
+// Contains reports whether any record contains substr, e.g. `level=WARN`.
+func (logs *Logs) Contains(substr string) bool { return strings.Contains(logs.String(), substr) }
+
+// CaptureLogs redirects mono.Log (debug level included) until the test ends (all mono defaults are reset then).
+func CaptureLogs(t testing.TB) *Logs {
+	t.Cleanup(mono.ResetDefaults)
+	logs := &Logs{}
+	mono.Log = slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return logs
+}
@@ -0,0 +1,40 @@
+package monotest_test
+
+import (
+	"context"
+	"github.com/kittenbark/mono"
+	"github.com/kittenbark/mono/monotest"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStart(t *testing.T) {
+	monotest.Env(t, mono.EnvProd)
+	logs := monotest.CaptureLogs(t)
+
+	client := monotest.Start(t, mono.New().
+		Page("/", mono.BuiltPage{Data: []byte("<h1>hello</h1>"), ContentType: "text/html"}).
+		Get("/search", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := rw.Write([]byte(req.URL.Query().Get("q")))
+			return err
+		}).
+		Handler("/boom", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			panic("boom")
+		}))
+
+	resp, body := client.Get("/")
+	if resp.StatusCode != http.StatusOK || string(body) != "<h1>hello</h1>" {
+		t.Errorf("unexpected page: %d %q", resp.StatusCode, body)
+	}
+	if _, body := client.Get("/search?q=mono"); string(body) != "mono" {
+		t.Errorf("expected the query to reach the handler, got %q", body)
+	}
+	resp, body = client.Get("/boom", "Accept", "application/json")
+	if resp.StatusCode != http.StatusInternalServerError || strings.Contains(string(body), "goroutine") {
+		t.Errorf("expected a prod 500 without the stack, got %d %q", resp.StatusCode, body)
+	}
+	if !logs.Contains("level=ERROR") || !logs.Contains("boom") {
+		t.Errorf("expected the panic to be logged, got %q", logs.String())
+	}
+}
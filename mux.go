@@ -5,192 +5,1056 @@ import (
 	"cmp"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/singleflight"
 	"html/template"
-	"log"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 type Server interface {
 	Page(pattern string, page Page) Server
+	Pages(pages map[string]Page) Server
 	Handler(pattern string, fn HandlerFunc) Server
+	Get(pattern string, fn HandlerFunc) Server
+	Post(pattern string, fn HandlerFunc) Server
+	Put(pattern string, fn HandlerFunc) Server
+	Delete(pattern string, fn HandlerFunc) Server
+	Patch(pattern string, fn HandlerFunc) Server
+	SSE(pattern string, fn func(ctx context.Context, send func(event, data string) error) error) Server
+	WebSocket(pattern string, fn func(ctx context.Context, conn *Conn) error) Server
 	WithBuildError(err error) Server
 	Middleware(fn MiddlewareFunc) Server
-	Proxy(source, destination string) Server
+	Transform(fn func(pattern string, page *BuiltPage) error) Server
+	Header(key, value string) Server
+	Headers(headers map[string]string) Server
+	Proxy(source, destination string, options ...ProxyOption) Server
+	Redirect(from, to string, code ...int) Server
+	Dir(pattern, root string) Server
+	StatusPage(status int, page Page) Server
+	NotFound(fn HandlerFunc) Server
+	Host(host string) Server
 	Stats() Server
+	Metrics(pattern string) Server
+	StatsData() []RouteStat
+	Assets() []Asset
+	WriteManifest(w io.Writer) error
 	Addr(addr string) Server
+	BaseContext(ctx context.Context) Server
+	CleanPaths(mode PathCleaning) Server
 	TLS(cfg *tls.Config, err error) Server
+	IsTLS() bool
+	Scheme() string
+	Build() (http.Handler, error)
+	Background(fn func(ctx context.Context) error) Server
 	Start() error
+	StartContext(ctx context.Context) error
+	ShutdownTimeout(timeout time.Duration) Server
 	Stop()
+	Close() error
+	Shutdown(ctx context.Context) error
 }
 
 var _ Server = (*serverDev)(nil)
 
 type HandlerFunc func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error
 
+// New creates a server with the SaneHeaders preset, see NewWithoutDefaults to pick another one (or none).
 func New() Server {
+	return NewWithoutDefaults().Middleware(SaneHeaders)
+}
+
+// NewWithoutDefaults creates a server without any header preset, e.g. when running behind a gateway that sets them.
+// Use Middleware(StrictHeaders) or Middleware(MinimalHeaders) to opt into a different baseline.
+func NewWithoutDefaults() Server {
 	result := &serverDev{}
 	result.init()
-	return result.Middleware(SaneHeaders)
+	return result
 }
 
 type serverDev struct {
-	addr         string
-	ctx          context.Context
-	ctxCancel    func()
-	ctxTimeout   time.Duration
-	internal     http.Server
-	tls          *tls.Config
-	cert         *autocert.Manager
-	middleware   []MiddlewareFunc
-	buildError   error
-	buildStart   time.Time
-	handlersLock sync.RWMutex
-	handlersMap  map[string]string
-	handlers     map[string]http.HandlerFunc
+	addr            string
+	ctx             context.Context
+	ctxCancel       func()
+	ctxTimeout      time.Duration
+	shutdownTimeout time.Duration
+	draining        context.Context // Done once the server starts shutting down, streaming handlers end then.
+	drainingCancel  func()
+	background      []func(ctx context.Context) error
+	backgroundWG    sync.WaitGroup
+	backgroundErr   error
+	backgroundLock  sync.Mutex
+	internal        *http.Server
+	internalLock    sync.Mutex
+	tls             *tls.Config
+	cert            *autocert.Manager
+	middleware      []MiddlewareFunc
+	headers         http.Header
+	buildError      error
+	buildErrorLock  sync.Mutex
+	buildStart      time.Time
+	buildEnd        time.Time
+	handlersLock    sync.RWMutex
+	handlersMap     map[string]RouteStat
+	pageSums        map[string][sha256.Size]byte
+	assets          map[string]Asset
+	handlers        map[string]http.HandlerFunc
+	pathCleaning    PathCleaning
+	statusPages     map[int]BuiltPage
+	host            string
+	transforms      []func(pattern string, page *BuiltPage) error
+	pendingPages    []pendingPage
+	notFound        http.HandlerFunc
+}
+
+// serverContextKey holds the *serverDev in handlers' context, e.g. for responseError to find status pages.
+type serverContextKey struct{}
+
+// ProxyOption configures a Proxy route, e.g. ProxyMethods.
+type ProxyOption func(options *proxyOptions)
+
+type proxyOptions struct {
+	methods   []string
+	transport http.RoundTripper
+}
+
+// ProxyTransport sends the proxied requests with transport instead of http.DefaultTransport, e.g. an *http.Transport
+// with dial timeouts, MaxIdleConns, or a TLSClientConfig trusting the private CA of an internal https backend.
+func ProxyTransport(transport http.RoundTripper) ProxyOption {
+	return func(options *proxyOptions) {
+		options.transport = transport
+	}
+}
+
+// ProxyMethods allows only these methods through the proxy, the rest get 405 (with Allow) without reaching
+// the destination, e.g. ProxyMethods("GET") for a read-only backend. GET allows HEAD too, as in ServeMux.
+func ProxyMethods(methods ...string) ProxyOption {
+	return func(options *proxyOptions) {
+		for _, method := range methods {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			options.methods = append(options.methods, method)
+			if method == http.MethodGet && !slices.Contains(methods, http.MethodHead) {
+				options.methods = append(options.methods, http.MethodHead)
+			}
+		}
+	}
 }
 
-func (server *serverDev) Proxy(source, destination string) Server {
+// Proxy forwards requests matching source to destination, with the source prefix trimmed off the path.
+// Source may have {name} wildcards (see PathValue), the prefix is trimmed by segments, so e.g. /t/{tenant}/ forwards
+// /t/acme/items as /items, and wildcards never match parts of the destination's own path.
+func (server *serverDev) Proxy(source, destination string, options ...ProxyOption) Server {
 	dest, err := url.Parse(destination)
 	if err != nil {
 		return server.WithBuildError(err)
 	}
-	proxy := httputil.NewSingleHostReverseProxy(dest)
-	director := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		director(req)
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, source)
-		if req.URL.Path == "" {
-			req.URL.Path = "/"
-		}
+	config := proxyOptions{}
+	for _, option := range options {
+		option(&config)
 	}
+	allow := strings.Join(config.methods, ", ")
+	prefix := parseRoute(source).Path
+	if host := (route{Path: prefix}).Host(); host != "" {
+		prefix = strings.TrimPrefix(prefix, host)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(dest)
+	proxy.Transport = config.transport
 	return server.Handler(source, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, source)
-		if req.URL.Path == "" {
-			req.URL.Path = "/"
+		if len(config.methods) > 0 && !slices.Contains(config.methods, req.Method) {
+			rw.Header().Set("Allow", allow)
+			return NewStatusError(http.StatusMethodNotAllowed, "")
+		}
+		req.URL.Path = trimPatternPrefix(req.URL.Path, prefix)
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = trimPatternPrefix(req.URL.RawPath, prefix) // Keeps escapes, e.g. %2F in /files/a%2Fb.
 		}
 		proxy.ServeHTTP(rw, req)
 		return nil
 	})
 }
 
+// Redirect registers a redirect from the from pattern to to (see the Redirect handler), code is 308 by default.
+// Subtree patterns keep the rest of the path: Redirect("www.example.com/", "https://example.com") redirects
+// www.example.com/a?b=c to https://example.com/a?b=c, and Redirect("/old/", "/new/") /old/a to /new/a.
+func (server *serverDev) Redirect(from, to string, code ...int) Server {
+	options := RedirectOptions{Code: def(code, http.StatusPermanentRedirect)}
+	if options.Code < 300 || options.Code > 399 {
+		return server.WithBuildError(fmt.Errorf("mono.Redirect: unexpected status %d for %q", options.Code, from))
+	}
+	prefix := parseRoute(from).Path
+	if host := (route{Path: prefix}).Host(); host != "" {
+		prefix = strings.TrimPrefix(prefix, host)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = ""
+	}
+	return server.Handler(from, redirect(to, options, prefix))
+}
+
+// Dir serves the files under root at pattern, e.g. Dir("/static/", "./public") serves ./public/css/app.css at
+// /static/css/app.css, and index.html files serve their directory as well. Files up to InMemoryFilesizeThreshold are
+// static pages (precompressed, cached like any Page), larger ones stream from disk with the same caching headers.
+// Hidden files (".env", ".git/") are skipped.
+func (server *serverDev) Dir(pattern, root string) Server {
+	prefix := strings.TrimSuffix(pattern, "/")
+	err := filepath.WalkDir(root, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && filename != root {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.ContainsAny(rel, " {}") {
+			Log.Warn("mono.Dir: skipping a file unfit for patterns", "file", filename)
+			return nil
+		}
+
+		patterns := []string{prefix + "/" + rel}
+		if dir, name := path.Split(rel); name == "index.html" {
+			patterns = append(patterns, prefix+"/"+dir+"{$}")
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() > InMemoryFilesizeThreshold {
+			for _, pattern := range patterns {
+				server.Page(pattern, staticPage(BuiltPage{Filename: filename, ContentType: contentTypeByName(filename)}))
+			}
+			return nil
+		}
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		page := staticPage(BuiltPage{Data: data, ContentType: cmp.Or(contentTypeByName(filename), http.DetectContentType(data))})
+		for _, pattern := range patterns {
+			server.Page(pattern, page)
+		}
+		return nil
+	})
+	if err != nil {
+		return server.WithBuildError(fmt.Errorf("mono.Dir: %w", err))
+	}
+	return server
+}
+
+// trimPatternPrefix trims the part of path matched by pattern's segments, where {name} matches any segment and
+// {name...} (or {$}) the rest of path. The result always starts with "/", path is kept if pattern doesn't match.
+func trimPatternPrefix(path string, pattern string) string {
+	rest := path
+	for segment := range strings.SplitSeq(strings.Trim(pattern, "/"), "/") {
+		isWildcard := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		switch {
+		case segment == "":
+			continue
+		case segment == "{$}" || isWildcard && strings.HasSuffix(segment, "...}"):
+			return "/"
+		case !strings.HasPrefix(rest, "/"):
+			return path
+		}
+		current, next, found := strings.Cut(rest[1:], "/")
+		if current != segment && !isWildcard {
+			return path
+		}
+		rest = ""
+		if found {
+			rest = "/" + next
+		}
+	}
+	if rest == "" {
+		return "/"
+	}
+	return rest
+}
+
 func (server *serverDev) Handler(pattern string, fn HandlerFunc) Server {
-	for _, middleware := range server.middleware {
+	return server.handler(pattern, fn, false)
+}
+
+// handler registers fn, streaming handlers (SSE, WebSocket) aren't limited by the handler timeout, their context
+// is done once the client is gone (or the server stops) instead.
+func (server *serverDev) handler(pattern string, fn HandlerFunc, streaming bool) Server {
+	route := server.route(pattern)
+	if err := validatePattern(route); err != nil {
+		return server.WithBuildError(err)
+	}
+	return server.register(route, server.middleware, fn, streaming)
+}
+
+// register adds fn for the (resolved and validated) route, wrapped into middleware.
+func (server *serverDev) register(route route, middleware []MiddlewareFunc, fn HandlerFunc, streaming bool) Server {
+	pattern := route.String()
+	for _, middleware := range middleware {
 		fn = middleware(fn)
 	}
 
 	server.handlersLock.Lock()
 	defer server.handlersLock.Unlock()
-	server.handlers[pattern] = func(rw http.ResponseWriter, req *http.Request) {
-		ctx, cancel := context.WithTimeout(server.ctx, server.ctxTimeout)
+	server.handlers[pattern] = server.serve(fn, streaming)
+	stat := RouteStat{Pattern: pattern, Method: route.Method, Host: route.Host(), Path: route.Path, Type: RouteDynamic}
+	if streaming {
+		stat.Type = RouteStream
+	}
+	server.handlersMap[pattern] = stat
+	server.buildEnd = time.Now()
+
+	return server
+}
+
+// serve adapts fn (with its middleware applied) to http, with the server's headers, context and error responses.
+func (server *serverDev) serve(fn HandlerFunc, streaming bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if unclean, ok := req.Context().Value(uncleanURLKey{}).(*url.URL); ok {
+			req.URL = unclean
+		}
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if streaming {
+			ctx, cancel = context.WithCancel(server.ctx)
+			defer context.AfterFunc(req.Context(), cancel)()
+			defer context.AfterFunc(server.draining, cancel)()
+		} else {
+			ctx, cancel = context.WithTimeout(server.ctx, server.ctxTimeout)
+		}
 		defer cancel()
 
-		if err := fn(ctx, rw, req); err != nil {
-			Log.Error("handle error", "err", err.Error())
-			_ = responseError(rw, http.StatusInternalServerError)
+		h := rw.Header()
+		server.applyHeaders(h)
+
+		if server.ctx.Err() != nil {
+			h.Set("Connection", "close")
+			_ = responseError(ctx, rw, req, http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+
+		err := fn(ctx, rw, req)
+		if streaming && errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			return // The client is gone, or the server is stopping.
+		}
+		if err != nil {
+			responseFromError(ctx, rw, req, err)
 			return
 		}
 	}
-	server.handlersMap[pattern] = "dynamic"
+}
+
+// NotFound responds to requests no route matches instead of the default 404, e.g. with a branded page of a Nextjs
+// site (see StatusPage for a static one). Registered routes still win, and a path with routes of other methods is
+// still 405. Like handlers, fn runs behind the middleware registered before it (SaneHeaders, rate limiters, etc.),
+// and responds with 404 unless it writes another status.
+func (server *serverDev) NotFound(fn HandlerFunc) Server {
+	notFound := func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		return fn(ctx, &notFoundWriter{ResponseWriter: rw}, req)
+	}
+	for _, middleware := range server.middleware {
+		notFound = middleware(notFound)
+	}
+	server.notFound = server.serve(notFound, false)
+	return server
+}
+
+// notFoundWriter makes NotFound responses 404 by default.
+type notFoundWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (rw *notFoundWriter) WriteHeader(status int) {
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *notFoundWriter) Write(data []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusNotFound)
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+func (rw *notFoundWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+// SSE serves Server-Sent Events: fn sends events until it returns, each one is flushed right away.
+// Unlike Handler, SSE isn't limited by the handler timeout, ctx is done once the client disconnects
+// or the server stops, fn should return then (returning ctx.Err() is fine). An empty event is a "message".
+func (server *serverDev) SSE(pattern string, fn func(ctx context.Context, send func(event, data string) error) error) Server {
+	return server.handler(pattern, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		controller := http.NewResponseController(rw)
+		if err := controller.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		h := rw.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("X-Accel-Buffering", "no") // nginx.
+		rw.WriteHeader(http.StatusOK)
+		if err := controller.Flush(); err != nil {
+			return err
+		}
+
+		return fn(ctx, func(event, data string) error {
+			message := strings.Builder{}
+			if event != "" {
+				message.WriteString("event: " + event + "\n")
+			}
+			for line := range strings.SplitSeq(data, "\n") {
+				message.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+			}
+			message.WriteString("\n")
+			if _, err := io.WriteString(rw, message.String()); err != nil {
+				return err
+			}
+			return controller.Flush()
+		})
+	}, true)
+}
 
+// Host scopes the routes registered after it to requests with this Host header, e.g. serving different
+// route sets for api.example.com and www.example.com (see TLSMulti for their certificates). "" is any host again.
+// Routes of any host are used only if none of the request's host match, as ServeMux prefers host patterns.
+// The host has no port, ServeMux matches requests by their host alone.
+func (server *serverDev) Host(host string) Server {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if strings.ContainsAny(host, "/ ") {
+		return server.WithBuildError(fmt.Errorf("mono.Host: unexpected host %q", host))
+	}
+	if strings.Contains(host, ":") {
+		return server.WithBuildError(fmt.Errorf("mono.Host: host %q has a port, it would never match", host))
+	}
+	server.host = host
 	return server
 }
 
+// StatusPage is the HTML body of status responses (e.g. a branded 404) for browsers, see responseError.
+// The page is rendered once, at registration, so it's static.
+func (server *serverDev) StatusPage(status int, page Page) Server {
+	if status < 400 || status >= len(statusMessageCache) {
+		return server.WithBuildError(fmt.Errorf("mono.StatusPage: unexpected status %d", status))
+	}
+	built, err := page.Apply(&Context{Url: ""})
+	if err != nil {
+		return server.WithBuildError(err)
+	}
+	if built.ContentType == "" {
+		built.ContentType = "text/html; charset=utf-8"
+	}
+	server.statusPages[status] = built
+	return server
+}
+
+// Transform registers fn to change every page (subpages, e.g. css of extensions, included) once, as it's built:
+// inject an analytics snippet, add a banner, minify, etc. Check page.ContentType to pick pages, the Data of dynamic
+// pages is their template. An error fails the build. Pages are built by Build (or Start), so it applies to pages
+// registered before it too, Filename pages (streamed from disk) excepted.
+func (server *serverDev) Transform(fn func(pattern string, page *BuiltPage) error) Server {
+	server.transforms = append(server.transforms, fn)
+	return server
+}
+
+// Get registers fn for GET (and HEAD) requests, it's Handler("GET "+pattern, fn). Requests to the path with
+// a method no handler is registered for get 405 with an Allow header.
+func (server *serverDev) Get(pattern string, fn HandlerFunc) Server {
+	return server.method(http.MethodGet, pattern, fn)
+}
+
+func (server *serverDev) Post(pattern string, fn HandlerFunc) Server {
+	return server.method(http.MethodPost, pattern, fn)
+}
+
+func (server *serverDev) Put(pattern string, fn HandlerFunc) Server {
+	return server.method(http.MethodPut, pattern, fn)
+}
+
+func (server *serverDev) Delete(pattern string, fn HandlerFunc) Server {
+	return server.method(http.MethodDelete, pattern, fn)
+}
+
+func (server *serverDev) Patch(pattern string, fn HandlerFunc) Server {
+	return server.method(http.MethodPatch, pattern, fn)
+}
+
+func (server *serverDev) method(method string, pattern string, fn HandlerFunc) Server {
+	if route := parseRoute(pattern); route.Method != "" {
+		return server.WithBuildError(fmt.Errorf("mono.%s: pattern %q already has a method", method, pattern))
+	}
+	return server.Handler(method+" "+strings.TrimSpace(pattern), fn)
+}
+
 func (server *serverDev) Page(pattern string, pageBuilder Page) Server {
-	page, err := pageBuilder.Apply(&Context{Url: pattern})
+	return server.page(pattern, pageBuilder, false)
+}
+
+func (server *serverDev) page(pattern string, pageBuilder Page, isSubpattern bool) Server {
+	route := server.route(pattern)
+	if err := validatePattern(route); err != nil {
+		return server.WithBuildError(err)
+	}
+	pattern = route.String()
+	page, err := pageBuilder.Apply(&Context{Url: strings.TrimSuffix(route.Path, "{$}")})
 	if err != nil {
 		return server.WithBuildError(err)
 	}
 
 	for subpattern, subdata := range page.Subpattern {
-		patternJoined, err := url.JoinPath(pattern, subpattern)
+		subroute := route
+		subroute.Path, err = url.JoinPath(route.Path, subpattern)
 		if err != nil {
-			return server.WithBuildError(err)
+			return server.WithBuildError(fmt.Errorf("mono: subpattern %q of %q: %w", subpattern, pattern, err))
+		}
+		if strings.HasSuffix(subroute.Path, "/") {
+			subroute.Path += "{$}" // E.g. Nextjs' index page, not a catch-all hiding Server.NotFound.
+		}
+		server.page(subroute.String(), subdata, true)
+	}
+	if isCDNPath(route.Path) && page.Headers["Cache-Control"] == "" {
+		page.Headers = maps.Clone(page.Headers)
+		if page.Headers == nil {
+			page.Headers = map[string]string{}
+		}
+		page.Headers["Cache-Control"] = headerCacheControlImmutable
+	}
+	if page.Filename != "" && len(page.Data) == 0 {
+		return server.pageFile(route, page)
+	}
+
+	server.handlersLock.Lock()
+	defer server.handlersLock.Unlock()
+	server.pendingPages = append(server.pendingPages, pendingPage{
+		route:        route,
+		page:         page,
+		isSubpattern: isSubpattern,
+		middleware:   slices.Clone(server.middleware),
+		brotli:       EnableBrotli,
+	})
+	return server
+}
+
+// pendingPage is a Page waiting to be built, with the middleware registered before it (and EnableBrotli then).
+type pendingPage struct {
+	route        route
+	page         BuiltPage
+	isSubpattern bool
+	middleware   []MiddlewareFunc
+	brotli       bool
+}
+
+// buildPages builds the pages registered since the last call (in parallel, it's CPU intensive).
+func (server *serverDev) buildPages() {
+	server.handlersLock.Lock()
+	pending := server.pendingPages
+	server.pendingPages = nil
+	server.handlersLock.Unlock()
+
+	wg := sync.WaitGroup{}
+	workers := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for _, pending := range pending {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			server.buildPage(pending)
+		}()
+	}
+	wg.Wait()
+}
+
+// buildPage transforms, compresses and registers a page.
+func (server *serverDev) buildPage(pending pendingPage) Server {
+	route, page, pattern := pending.route, pending.page, pending.route.String()
+	immutable := isCDNPath(route.Path)
+	for _, transform := range server.transforms {
+		if len(page.Data) == 0 {
+			break
+		}
+		if err := transform(pattern, &page); err != nil {
+			return server.WithBuildError(fmt.Errorf("transform %s: %w", pattern, err))
 		}
-		server.Page(patternJoined, subdata)
 	}
 	if len(page.Data) == 0 {
 		return server
 	}
 
-	serverPageUpdateBuiltPage(&page)
+	if err := server.claimPattern(pattern, page.Data); err != nil {
+		return server.WithBuildError(err)
+	}
+	serverPageUpdateBuiltPage(&page, strings.TrimSuffix(route.Path, "{$}"))
 
-	var dynTemplate *template.Template
+	var (
+		dynTemplate *template.Template
+		err         error
+	)
 	if containsDynamicContent(page.Data) {
-		dynTemplate, err = Schema(string(page.Data), pattern, page.DynamicFuncs, "{${", "}$}")
+		funcs := page.DynamicFuncs
+		if page.RequestFuncs != nil || page.Stream {
+			funcs = maps.Clone(funcs)
+		}
+		if page.RequestFuncs != nil {
+			maps.Copy(funcs, page.RequestFuncs(context.Background(), &http.Request{Header: http.Header{}, URL: &url.URL{}}))
+		}
+		if page.Stream {
+			funcs["flush"] = func() (string, error) { return "", nil } // Bound to the response in streamPage.
+		}
+		dynTemplate, err = Schema(string(page.Data), pattern, funcs, "{${", "}$}")
 		if err != nil {
 			return server.WithBuildError(err)
 		}
 	}
 
 	// Note: this section might be CPU intensive, could be a good place for parallelization.
-	gzipStaticData := server.gzipIfPossible(page, gzip.BestCompression)
-	defer server.updateStats(pattern, dynTemplate, page, gzipStaticData)
+	var gzipStaticData, brotliStaticData []byte
+	rendered := dynTemplate != nil || page.IsDynamic() // The template isn't the response, so it's not precompressed.
+	if !rendered {
+		gzipStaticData = server.gzipIfPossible(page, gzip.BestCompression)
+		brotliStaticData = server.brotliIfPossible(page, pending.brotli)
+	}
+	defer server.updateStats(route, dynTemplate, page, gzipStaticData, brotliStaticData)
+	if pending.isSubpattern && dynTemplate == nil && !page.IsDynamic() && !strings.HasPrefix(page.ContentType, "text/html") {
+		server.addAsset(pattern, page)
+	}
 
-	return server.Handler(pattern, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+	cache := pageCache{precompressed: gzipStaticData != nil || brotliStaticData != nil}
+	if dynTemplate == nil && !page.IsDynamic() {
+		sum := sha256.Sum256(page.Data)
+		cache.etag = hex.EncodeToString(sum[:12])
+		if immutable {
+			cache.lastModified = server.buildStart.UTC().Truncate(time.Second)
+		}
+	}
+
+	coalesce := &singleflight.Group{}
+	return server.register(route, pending.middleware, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
 		headers := serverPageUpdate(rw, page)
 		data := page.Data
+		encoding := "" // Of the precompressed data, brotli is preferred as it's smaller.
+		switch {
+		case brotliStaticData != nil && acceptsEncoding(req, "br"):
+			encoding = "br"
+		case gzipStaticData != nil && acceptsEncoding(req, "gzip"):
+			encoding = "gzip"
+		}
+		if cache.etag != "" && cache.notModified(rw, req, encoding) {
+			return nil
+		}
+		if page.Stream && dynTemplate != nil {
+			return streamPage(ctx, rw, req, page, dynTemplate)
+		}
 
 		if dynTemplate != nil {
-			built, err := ExecuteSchema(dynTemplate, page.DynamicData(ctx, req))
+			render := func() (any, error) {
+				templ := dynTemplate
+				if page.RequestFuncs != nil {
+					// The original is never executed, so it could be cloned for every request.
+					cloned, err := dynTemplate.Clone()
+					if err != nil {
+						return nil, err
+					}
+					templ = cloned.Funcs(page.RequestFuncs(ctx, req))
+				}
+				built, err := ExecuteSchema(templ, page.DynamicData(ctx, req))
+				return []byte(built), err
+			}
+			var (
+				built any
+				err   error
+			)
+			if page.CoalesceKey != nil {
+				built, err, _ = coalesce.Do(page.CoalesceKey(req), render)
+			} else {
+				built, err = render()
+			}
 			if err != nil {
 				return err
 			}
-			data = []byte(built)
+			data = built.([]byte)
 		}
 
-		if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
-			data, err = gzipApplyCompression(data, gzipStaticData, headers, page)
-			if err != nil {
-				return err
+		switch {
+		case encoding == "br":
+			data = brotliStaticData
+			headers.Set("Content-Encoding", "br")
+		case encoding == "gzip":
+			data = gzipStaticData
+			headers.Set("Content-Encoding", "gzip")
+		case rendered && isCompressible(page.ContentType):
+			headers.Add("Vary", "Accept-Encoding")
+			if len(data) >= gzipDynamicMinSize && acceptsEncoding(req, "gzip") {
+				gzipped, err := gzipDynamic(data)
+				if err != nil {
+					return err
+				}
+				data = gzipped
+				headers.Set("Content-Encoding", "gzip")
 			}
 		}
 
+		if cache.etag != "" && headers.Get("Content-Encoding") == "" {
+			http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(data)) // Range requests, e.g. <video> seeking.
+			return nil
+		}
 		if _, err := rw.Write(data); err != nil {
 			return err
 		}
 		return nil
+	}, false)
+}
+
+// pageFile registers a BuiltPage.Filename page, streamed from disk with the page's headers.
+func (server *serverDev) pageFile(route route, page BuiltPage) Server {
+	pattern := route.String()
+	if err := server.claimPattern(pattern, []byte("file:"+page.Filename)); err != nil {
+		return server.WithBuildError(err)
+	}
+	serve := serveFile(page.Filename, "")
+	etag := ""
+	if isCDNPath(route.Path) {
+		etag = `"` + strings.TrimSuffix(path.Base(route.Path), path.Ext(route.Path)) + `"` // The contents' hash.
+	}
+	server.Handler(pattern, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		if etag != "" {
+			rw.Header().Set("ETag", etag) // http.ServeContent handles If-None-Match with it.
+		}
+		serverPageUpdate(rw, page)
+		return serve(ctx, rw, req)
 	})
+	server.updateStats(route, nil, page, nil, nil)
+	return server
 }
 
-func (server *serverDev) updateStats(pattern string, dynTemplate *template.Template, page BuiltPage, gzipStaticData []byte) {
-	type_ := "static_page"
-	if dynTemplate != nil {
-		type_ = "dynamic_page"
+// pageCache validates conditional requests of static pages.
+type pageCache struct {
+	etag          string    // Of the identity-encoded data.
+	precompressed bool      // Responses vary by Accept-Encoding.
+	lastModified  time.Time // Of /mono/cdn/ assets (any time works, as their contents never change), zero otherwise.
+}
+
+// notModified sets the page's ETag, a distinct one for its encoded variants (gzip, br) so caches don't mix them up,
+// and responds with 304 Not Modified (reporting true) if If-None-Match has it (or If-Modified-Since, for cdn assets).
+func (cache pageCache) notModified(rw http.ResponseWriter, req *http.Request, encoding string) bool {
+	h := rw.Header()
+	if cache.precompressed {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	etag := cache.etag
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	etag = `"` + etag + `"`
+	h.Set("ETag", etag)
+	if !cache.lastModified.IsZero() {
+		h.Set("Last-Modified", cache.lastModified.Format(http.TimeFormat))
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	match := false
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/") // If-None-Match compares weakly.
+			match = match || candidate == etag || candidate == "*"
+		}
+	} else if !cache.lastModified.IsZero() && req.Header.Get("If-Modified-Since") != "" {
+		match = true
 	}
-	size := fmt.Sprintf("[%s]", sizeof(page.Data))
-	if gzipStaticData != nil {
-		size = fmt.Sprintf(" [%s (%s)]", sizeof(gzipStaticData), sizeof(gzipStaticData))
+	if match {
+		h.Del("Content-Type")
+		rw.WriteHeader(http.StatusNotModified)
+	}
+	return match
+}
+
+// isCDNPath reports whether path is a /mono/cdn/ asset, its url is derived from the contents (the file extension's
+// hash) or unique to the build (Tailwind's css), so it's cached as immutable.
+func isCDNPath(path string) bool {
+	return strings.Contains(path, "/mono/cdn/")
+}
+
+// streamPage renders a BuiltPage.Stream page right into rw.
+func streamPage(ctx context.Context, rw http.ResponseWriter, req *http.Request, page BuiltPage, dynTemplate *template.Template) error {
+	writer := &streamWriter{rw: rw, out: rw}
+	if acceptsEncoding(req, "gzip") && isCompressible(page.ContentType) {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		writer.gzip, _ = gzip.NewWriterLevel(rw, gzip.BestSpeed)
+		writer.out = writer.gzip
+	}
+
+	err := func() error {
+		templ, err := dynTemplate.Clone()
+		if err != nil {
+			return err
+		}
+		funcs := template.FuncMap{"flush": func() (string, error) { return "", writer.Flush() }}
+		if page.RequestFuncs != nil {
+			maps.Copy(funcs, page.RequestFuncs(ctx, req))
+		}
+		if err := templ.Funcs(funcs).Execute(writer, page.DynamicData(ctx, req)); err != nil {
+			return err
+		}
+		return writer.Close()
+	}()
+	if err != nil && !writer.started {
+		// Nothing is sent yet, the error response mustn't be cached as the page.
+		h := rw.Header()
+		h.Del("Cache-Control")
+		h.Del("Content-Disposition")
+		for key := range page.Headers {
+			h.Del(key)
+		}
+	}
+	return err
+}
+
+// streamWriter flushes rw every StreamChunkSize bytes, out is rw or a gzip.Writer over it.
+// Content-Encoding is set on the first write, so an error before it gets a plain response.
+type streamWriter struct {
+	rw      http.ResponseWriter
+	out     io.Writer
+	gzip    *gzip.Writer
+	pending int
+	started bool
+}
+
+func (writer *streamWriter) start() {
+	if writer.started {
+		return
+	}
+	writer.started = true
+	if writer.gzip != nil {
+		writer.rw.Header().Set("Content-Encoding", "gzip")
+	}
+}
+
+func (writer *streamWriter) Write(data []byte) (int, error) {
+	writer.start()
+	n, err := writer.out.Write(data)
+	if writer.pending += n; err == nil && writer.pending >= StreamChunkSize {
+		err = writer.Flush()
+	}
+	return n, err
+}
+
+func (writer *streamWriter) Flush() error {
+	writer.start()
+	writer.pending = 0
+	if writer.gzip != nil {
+		if err := writer.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := http.NewResponseController(writer.rw).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (writer *streamWriter) Close() error {
+	if writer.gzip != nil {
+		writer.start()
+		return writer.gzip.Close()
+	}
+	return nil
+}
+
+// Pages registers pages in parallel (bounded by GOMAXPROCS), useful for hundreds of programmatically built pages,
+// as building and compressing each page is CPU intensive.
+func (server *serverDev) Pages(pages map[string]Page) Server {
+	wg := sync.WaitGroup{}
+	workers := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for _, pattern := range slices.Sorted(maps.Keys(pages)) {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			server.Page(pattern, pages[pattern])
+		}()
+	}
+	wg.Wait()
+	return server
+}
+
+// Asset is a static file produced by a page build (e.g. file extension outputs, Tailwind css, favicon),
+// Hash is the hex sha256 of the contents, so it could be used as a cache key when pushing assets to a CDN.
+type Asset struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Bytes       int    `json:"bytes"`
+	Hash        string `json:"hash"`
+}
+
+// ManifestVersion is bumped on incompatible changes of the Manifest json.
+const ManifestVersion = 1
+
+// Manifest describes a built site for deploy tooling: diffing builds, pushing Assets to a CDN, verifying hashes.
+type Manifest struct {
+	Version       int             `json:"version"`
+	BuildDuration time.Duration   `json:"build_duration_ns"`
+	Routes        []ManifestRoute `json:"routes"`
+	Assets        []Asset         `json:"assets"`
+}
+
+type ManifestRoute struct {
+	RouteStat
+	Hash string `json:"hash,omitempty"` // Hex sha256 of the page (the template of dynamic ones), "" for handlers.
+}
+
+// WriteManifest writes the Manifest json of the routes and assets registered so far.
+func (server *serverDev) WriteManifest(w io.Writer) error {
+	manifest := Manifest{Version: ManifestVersion, Assets: server.Assets()}
+	server.handlersLock.RLock()
+	manifest.BuildDuration = max(server.buildEnd.Sub(server.buildStart), 0)
+	sums := maps.Clone(server.pageSums)
+	server.handlersLock.RUnlock()
+
+	for _, stat := range server.StatsData() {
+		route := ManifestRoute{RouteStat: stat}
+		if sum, ok := sums[stat.Pattern]; ok && stat.Type != RouteDynamic {
+			route.Hash = hex.EncodeToString(sum[:])
+		}
+		manifest.Routes = append(manifest.Routes, route)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+// Assets lists the static assets registered via pages' subpatterns, sorted by URL.
+func (server *serverDev) Assets() []Asset {
+	server.buildPages()
+	server.handlersLock.RLock()
+	assets := slices.Collect(maps.Values(server.assets))
+	server.handlersLock.RUnlock()
+
+	slices.SortFunc(assets, func(a, b Asset) int { return strings.Compare(a.URL, b.URL) })
+	return assets
+}
+
+func (server *serverDev) addAsset(pattern string, page BuiltPage) {
+	server.handlersLock.Lock()
+	defer server.handlersLock.Unlock()
+	sum := server.pageSums[pattern]
+	server.assets[pattern] = Asset{
+		URL:         pattern,
+		ContentType: page.ContentType,
+		Bytes:       len(page.Data),
+		Hash:        hex.EncodeToString(sum[:]),
+	}
+}
+
+// claimPattern reports a conflict if pattern was already registered by a Page with different contents,
+// re-registering the same contents (e.g. a shared cdn asset) is fine.
+func (server *serverDev) claimPattern(pattern string, data []byte) error {
+	sum := sha256.Sum256(data)
+	server.handlersLock.Lock()
+	defer server.handlersLock.Unlock()
+	if existing, ok := server.pageSums[pattern]; ok && existing != sum {
+		return fmt.Errorf("subpattern conflict: %s is registered with different contents", pattern)
+	}
+	server.pageSums[pattern] = sum
+	return nil
+}
+
+func (server *serverDev) updateStats(route route, dynTemplate *template.Template, page BuiltPage, gzipStaticData []byte, brotliStaticData []byte) {
+	stat := RouteStat{
+		Pattern:     route.String(),
+		Method:      route.Method,
+		Host:        route.Host(),
+		Path:        route.Path,
+		Type:        RouteStaticPage,
+		ContentType: page.ContentType,
+		Bytes:       len(page.Data),
+		GzipBytes:   len(gzipStaticData),
+		BrotliBytes: len(brotliStaticData),
+	}
+	if dynTemplate != nil {
+		stat.Type = RouteDynamicPage
 	}
 	// Note: this is a hack — server.Handler sets handlers[pattern]=dynamic, we override it as static.
-	server.handlersMap[pattern] = fmt.Sprintf("%s %s (%s)", type_, size, page.ContentType)
+	server.handlersLock.Lock()
+	defer server.handlersLock.Unlock()
+	server.handlersMap[stat.Pattern] = stat
+	server.buildEnd = time.Now()
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return slices.ContainsFunc(CompressibleTypes, func(prefix string) bool { return strings.HasPrefix(contentType, prefix) })
 }
 
 func (server *serverDev) gzipIfPossible(page BuiltPage, compression int) (dataOpt []byte) {
-	if !strings.HasPrefix(page.ContentType, "text/") || page.IsDynamic() {
+	if !isCompressible(page.ContentType) || page.IsDynamic() {
 		return nil
 	}
 
 	result := bytes.NewBuffer(nil)
 	compressor, err := gzip.NewWriterLevel(result, compression)
 	if err != nil {
-		server.buildError = errors.Join(server.buildError, err)
+		server.joinBuildError(err)
+		return nil
+	}
+	if _, err := compressor.Write(page.Data); err != nil {
+		server.joinBuildError(err)
+	}
+	if err := compressor.Close(); err != nil {
+		server.joinBuildError(err)
+	}
+	return result.Bytes()
+}
+
+// brotliIfPossible precompresses what gzipIfPossible does with brotli too (if enabled), for clients accepting "br".
+func (server *serverDev) brotliIfPossible(page BuiltPage, enabled bool) (dataOpt []byte) {
+	if !enabled || !isCompressible(page.ContentType) || page.IsDynamic() {
+		return nil
 	}
+
+	result := bytes.NewBuffer(nil)
+	compressor := brotli.NewWriterLevel(result, brotli.DefaultCompression) // Higher levels are several times slower, for a few percent.
 	if _, err := compressor.Write(page.Data); err != nil {
-		server.buildError = errors.Join(server.buildError, err)
+		server.joinBuildError(err)
 	}
 	if err := compressor.Close(); err != nil {
-		server.buildError = errors.Join(server.buildError, err)
+		server.joinBuildError(err)
 	}
 	return result.Bytes()
 }
@@ -200,26 +1064,285 @@ func (server *serverDev) Addr(addr string) Server {
 	return server
 }
 
+// BaseContext sets the root of handlers' contexts, e.g. to carry a db pool or a tracer with context.WithValue.
+// Stop still cancels handlers' contexts, as the server derives a cancellable one from ctx. Call it before Start.
+func (server *serverDev) BaseContext(ctx context.Context) Server {
+	server.ctxCancel()
+	server.ctx, server.ctxCancel = context.WithCancel(context.WithValue(ctx, serverContextKey{}, server))
+	return server
+}
+
+// routeErrors makes the mux's own 404 and 405 responses negotiate on Accept like handlers' errors do.
+// CORS preflights of routes registered for other methods go through the middleware (e.g. Cors answers them) first.
+func (server *serverDev) routeErrors(mux *http.ServeMux) http.Handler {
+	var preflight HandlerFunc = func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		mux.ServeHTTP(&routeErrorWriter{ResponseWriter: rw, ctx: server.ctx, req: req, notFound: server.notFound}, req)
+		return nil
+	}
+	for _, middleware := range server.middleware {
+		preflight = middleware(preflight)
+	}
+	servePreflight := server.serve(preflight, false)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, pattern := mux.Handler(req); pattern != "" {
+			mux.ServeHTTP(rw, req)
+			return
+		}
+		if isPreflight(req) {
+			servePreflight(rw, req)
+			return
+		}
+		server.applyHeaders(rw.Header()) // Unmatched requests (404, 405) don't get to serve.
+		mux.ServeHTTP(&routeErrorWriter{ResponseWriter: rw, ctx: server.ctx, req: req, notFound: server.notFound}, req)
+	})
+}
+
+// routeErrorWriter replaces http.Error responses (status >= 400) with responseError.
+type routeErrorWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	req      *http.Request
+	notFound http.HandlerFunc // See Server.NotFound.
+	handled  bool
+}
+
+func (rw *routeErrorWriter) WriteHeader(status int) {
+	if status < http.StatusBadRequest {
+		rw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	rw.handled = true
+	if status == http.StatusNotFound && rw.notFound != nil {
+		rw.Header().Del("Content-Type") // Set by http.NotFound.
+		rw.notFound(rw.ResponseWriter, rw.req)
+		return
+	}
+	_ = responseError(rw.ctx, rw.ResponseWriter, rw.req, status, "")
+}
+
+func (rw *routeErrorWriter) Write(data []byte) (int, error) {
+	if rw.handled {
+		return len(data), nil
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+// PathCleaning is what happens to requests with unclean paths (//a/b, /a//b, /a/../b) before routing.
+type PathCleaning int
+
+const (
+	PathCleanRedirect PathCleaning = iota // Redirect to the clean path: 301 for GET and HEAD, 308 otherwise (default).
+	PathCleanSilent                       // Route and handle the request as if the path was clean.
+	PathCleanNone                         // Route by the clean path, but handlers (e.g. Proxy) get the path as-is.
+)
+
+// CleanPaths sets the PathCleaning mode, call it before Start.
+func (server *serverDev) CleanPaths(mode PathCleaning) Server {
+	server.pathCleaning = mode
+	return server
+}
+
+type uncleanURLKey struct{}
+
+func (server *serverDev) cleanPaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		clean := cleanPath(req.URL.Path)
+		if req.Method == http.MethodConnect || clean == req.URL.Path {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		cleaned := *req.URL
+		cleaned.Path, cleaned.RawPath = clean, ""
+		switch server.pathCleaning {
+		case PathCleanSilent:
+			req.URL = &cleaned
+		case PathCleanNone:
+			unclean := *req.URL
+			req = req.WithContext(context.WithValue(req.Context(), uncleanURLKey{}, &unclean))
+			req.URL = &cleaned
+		default:
+			status := http.StatusPermanentRedirect
+			if req.Method == http.MethodGet || req.Method == http.MethodHead {
+				status = http.StatusMovedPermanently
+			}
+			http.Redirect(rw, req, cleaned.RequestURI(), status)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// cleanPath is path.Clean keeping the trailing slash, as http.ServeMux does.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	clean := path.Clean(p)
+	if p[len(p)-1] == '/' && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
 func (server *serverDev) Middleware(fn MiddlewareFunc) Server {
 	server.middleware = append(server.middleware, fn)
 	return server
 }
 
+// Header adds a constant header to all responses, it's set before middlewares and handlers, so they can override it.
+// An empty value removes the header added by an earlier Header call.
+func (server *serverDev) Header(key, value string) Server {
+	if value == "" {
+		server.headers.Del(key)
+		return server
+	}
+	server.headers.Set(key, value)
+	return server
+}
+
+// applyHeaders sets the Header ones on h.
+func (server *serverDev) applyHeaders(h http.Header) {
+	for key, values := range server.headers {
+		h[key] = slices.Clone(values)
+	}
+}
+
+func (server *serverDev) Headers(headers map[string]string) Server {
+	for key, value := range headers {
+		server.Header(key, value)
+	}
+	return server
+}
+
+// Stats logs registered routes through Log.Info, a record per route, see StatsData for the routes themselves.
 func (server *serverDev) Stats() Server {
-	stats := []string{}
-	for pattern, type_ := range server.handlersMap {
-		stats = append(stats, fmt.Sprintf("%s%s -> %s", server.hostname(), pattern, type_))
+	for _, stat := range server.StatsData() {
+		Log.Info("mono: route",
+			"url", server.hostname(stat.Host)+strings.TrimPrefix(stat.Path, stat.Host),
+			"method", cmp.Or(stat.Method, "*"),
+			"type", stat.String(),
+		)
 	}
-	slices.SortStableFunc(stats, func(a, b string) int {
-		if len(a) == len(b) {
-			return strings.Compare(a, b)
-		}
-		return cmp.Compare(len(a), len(b))
-	})
-	println(strings.Join(stats, "\n"))
 	return server
 }
 
+// StatsData lists registered routes (GET /x and POST /x are separate ones), sorted by path length,
+// then alphabetically, then by method.
+func (server *serverDev) StatsData() []RouteStat {
+	server.buildPages()
+	server.handlersLock.RLock()
+	stats := slices.Collect(maps.Values(server.handlersMap))
+	server.handlersLock.RUnlock()
+
+	slices.SortStableFunc(stats, func(a, b RouteStat) int {
+		return cmp.Or(
+			cmp.Compare(len(a.Path), len(b.Path)),
+			strings.Compare(a.Path, b.Path),
+			strings.Compare(a.Pattern, b.Pattern),
+		)
+	})
+	return stats
+}
+
+const (
+	RouteDynamic     = "dynamic"
+	RouteStream      = "stream"
+	RouteStaticPage  = "static_page"
+	RouteDynamicPage = "dynamic_page"
+)
+
+type RouteStat struct {
+	Pattern     string `json:"pattern"`          // Normalized "[METHOD ][HOST]/path".
+	Method      string `json:"method,omitempty"` // "" if the route matches any method.
+	Host        string `json:"host,omitempty"`   // "" if the route matches any host, see Server.Host.
+	Path        string `json:"path"`             // Pattern's [HOST]/path part.
+	Type        string `json:"type"`             // RouteDynamic (RouteStream for SSE and WebSocket) for handlers, RouteStaticPage or RouteDynamicPage for pages.
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes"`        // Raw page size (template size for dynamic pages), 0 for handlers.
+	GzipBytes   int    `json:"gzip_bytes"`   // Precompressed size, 0 if the page isn't precompressed.
+	BrotliBytes int    `json:"brotli_bytes"` // Same for brotli, 0 unless EnableBrotli.
+}
+
+func (stat RouteStat) String() string {
+	if stat.Type == RouteDynamic {
+		return stat.Type
+	}
+	size := fmt.Sprintf("[%s]", sizeof(stat.Bytes))
+	if stat.GzipBytes > 0 {
+		size = fmt.Sprintf("[%s (%s)]", sizeof(stat.Bytes), sizeof(stat.GzipBytes))
+	}
+	return fmt.Sprintf("%s %s (%s)", stat.Type, size, stat.ContentType)
+}
+
+// route is a parsed ServeMux pattern "[METHOD ][HOST]/[PATH]", e.g. "GET example.com/posts/{id}",
+// Path keeps the host, as it's what pages are joined to.
+type route struct {
+	Method string
+	Path   string
+}
+
+// Host returns the pattern's host, "" if it matches any.
+func (route route) Host() string {
+	if strings.HasPrefix(route.Path, "/") {
+		return ""
+	}
+	host, _, _ := strings.Cut(route.Path, "/")
+	return host
+}
+
+// route parses pattern, scoping it to the Host set (if the pattern has no host of its own).
+func (server *serverDev) route(pattern string) route {
+	route := parseRoute(pattern)
+	if server.host != "" && route.Host() == "" {
+		route.Path = server.host + route.Path
+	}
+	return route
+}
+
+func parseRoute(pattern string) route {
+	pattern = strings.TrimSpace(pattern)
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		return route{Path: pattern}
+	}
+	return route{Method: method, Path: strings.TrimLeft(path, " \t")}
+}
+
+// validatePattern rejects patterns ServeMux would misroute (or panic on at Start) with the reason why.
+func validatePattern(route route) (err error) {
+	pattern := route.String()
+	switch host := route.Host(); {
+	case route.Path == "":
+		return fmt.Errorf("mono: empty pattern %q", pattern)
+	case len(pattern) > MaxPatternLength:
+		return fmt.Errorf("mono: pattern %.64q... is longer than MaxPatternLength (%d)", pattern, MaxPatternLength)
+	case strings.ContainsFunc(pattern, unicode.IsControl):
+		return fmt.Errorf("mono: pattern %q contains control characters", pattern)
+	case !strings.Contains(route.Path, "/") || host != "" && host != "localhost" && !strings.ContainsAny(host, ".:"):
+		return fmt.Errorf("mono: pattern %q must start with '/' (or a host, e.g. \"example.com/\")", pattern)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("mono: pattern %q: %v", pattern, r)
+		}
+	}()
+	http.NewServeMux().HandleFunc(pattern, func(http.ResponseWriter, *http.Request) {})
+	return nil
+}
+
+func (route route) String() string {
+	if route.Method == "" {
+		return route.Path
+	}
+	return route.Method + " " + route.Path
+}
+
 func (server *serverDev) TLS(cfg *tls.Config, err error) Server {
 	if !enableTLS() {
 		Log.Debug("mono.TLS: dev build, skipping tls")
@@ -238,6 +1361,19 @@ func (server *serverDev) TLS(cfg *tls.Config, err error) Server {
 	return server
 }
 
+// IsTLS reports whether Start serves https, i.e. TLS was configured and not skipped by EnableTLS/MONO_TLS.
+func (server *serverDev) IsTLS() bool {
+	return server.tls != nil || server.cert != nil
+}
+
+// Scheme is "https" if IsTLS, "http" otherwise. See RequestScheme for the one the client used behind a proxy.
+func (server *serverDev) Scheme() string {
+	if server.IsTLS() {
+		return "https"
+	}
+	return "http"
+}
+
 func (server *serverDev) Start() (err error) {
 	defer func() {
 		if errors.Is(err, http.ErrServerClosed) {
@@ -245,56 +1381,191 @@ func (server *serverDev) Start() (err error) {
 		}
 	}()
 
-	if server.buildError != nil {
-		return server.buildError
+	handler, err := server.Build()
+	if err != nil {
+		return err
 	}
 
 	if server.cert != nil {
-		server.addr = ":443"
-		go func() {
-			Log.Debug("mono.Start: have cert, proxying 80 to 443")
-			if err := http.ListenAndServe(":80", server.cert.HTTPHandler(nil)); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				log.Fatalf("HTTP server error: %v", err)
-			}
-		}()
+		logCertCache(server.cert)
+		server.addr = TLSOptions.HTTPSAddr
+		if TLSOptions.HTTPAddr != "" {
+			server.Background(func(ctx context.Context) error {
+				Log.Debug("mono.Start: have cert, proxying http to https", "http", TLSOptions.HTTPAddr, "https", server.addr)
+				redirect := &http.Server{Addr: TLSOptions.HTTPAddr, Handler: server.cert.HTTPHandler(httpsRedirect(server.addr))}
+				defer context.AfterFunc(ctx, func() { _ = redirect.Close() })()
+				if err := redirect.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+					return fmt.Errorf("http to https: %w", err)
+				}
+				return nil
+			})
+		}
 	}
 
-	server.robotsTxt()
-	mux := http.NewServeMux()
-	for pattern, handler := range server.handlers {
-		mux.Handle(pattern, handler)
-	}
-	server.internal = http.Server{
+	internal := &http.Server{
 		Addr:      server.addr,
-		Handler:   mux,
+		Handler:   handler,
 		TLSConfig: server.tls,
 	}
+	server.internalLock.Lock()
+	if server.draining.Err() != nil {
+		server.internalLock.Unlock()
+		return http.ErrServerClosed // Closed before it started, e.g. by StartContext's ctx.
+	}
+	server.internal = internal
+	for _, fn := range server.background {
+		server.backgroundWG.Add(1)
+		go server.runBackground(fn)
+	}
+	server.internalLock.Unlock()
 
 	Log.Info(fmt.Sprintf(
 		"Built in %s. Starting server at %s",
 		time.Since(server.buildStart).String(),
-		server.hostname(),
+		server.hostname(""),
 	))
 	if server.tls != nil {
 		Log.Debug("mono.Start: tls != nil => ListenAndServeTLS")
-		return server.internal.ListenAndServeTLS("", "")
+		return internal.ListenAndServeTLS("", "")
 	}
 	Log.Debug("mono.Start: tls == nil => ListenAndServe")
-	return server.internal.ListenAndServe()
+	return internal.ListenAndServe()
 }
 
-func (server *serverDev) Stop() {
-	server.ctxCancel()
-	_ = server.internal.Shutdown(server.ctx)
+// StartContext is Start until ctx is done, the server is closed then (see Close, it's ShutdownTimeout that drains),
+// e.g. with signal.NotifyContext(ctx, os.Interrupt). The error is Start's one, or the Close's one.
+func (server *serverDev) StartContext(ctx context.Context) error {
+	closed := make(chan error, 1)
+	stop := context.AfterFunc(ctx, func() { closed <- server.Close() })
+	err := server.Start()
+	if stop() {
+		return err
+	}
+	return errors.Join(err, <-closed)
+}
+
+// Build returns the handler Start serves (or the build errors), e.g. to serve it with httptest.NewServer,
+// see the monotest package, or with one's own http.Server. Register routes before it.
+func (server *serverDev) Build() (http.Handler, error) {
+	server.buildPages()
+	server.buildErrorLock.Lock()
+	buildErr := server.buildError
+	server.buildErrorLock.Unlock()
+	if buildErr != nil {
+		return nil, buildErr
+	}
+	if err := server.checkRoutes(); err != nil {
+		return nil, err
+	}
+
+	server.robotsTxt()
+	server.buildPages()
+	mux := http.NewServeMux()
+	server.handlersLock.RLock()
+	for pattern, handler := range server.handlers {
+		mux.Handle(pattern, handler)
+	}
+	server.handlersLock.RUnlock()
+	return server.cleanPaths(server.routeErrors(mux)), nil
+}
+
+// checkRoutes warns about a server without routes (or fails, if Strict), as it's likely a misconfiguration,
+// e.g. a Nextjs root dir without pages.
+func (server *serverDev) checkRoutes() error {
+	server.handlersLock.RLock()
+	routes := len(server.handlers)
+	server.handlersLock.RUnlock()
+	if routes > 0 {
+		return nil
+	}
+
+	msg := "mono.Start: no routes are registered, everything but /robots.txt is 404 (check the pages, e.g. the Nextjs root dir)"
+	if Strict {
+		return errors.New(msg)
+	}
+	Log.Warn(msg)
+	return nil
+}
+
+// ShutdownTimeout is how long Stop and Close wait for in-flight requests before cancelling their context, the
+// default 0 closes the server right away.
+func (server *serverDev) ShutdownTimeout(timeout time.Duration) Server {
+	server.shutdownTimeout = timeout
+	return server
+}
+
+// Stop closes the server, see Close.
+func (server *serverDev) Stop() { _ = server.Close() }
+
+// Close stops the server, draining in-flight requests for up to ShutdownTimeout (cancelling their context right
+// away if it's 0), the error is Shutdown's one.
+func (server *serverDev) Close() error {
+	if server.shutdownTimeout <= 0 {
+		server.ctxCancel()
+		return server.Shutdown(server.ctx)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), server.shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx is done,
+// the error is ctx's one if the drain didn't finish in time. Streaming handlers (SSE, WebSocket) are cancelled
+// as the drain starts, since they'd never finish on their own, the rest of handlers' context is cancelled afterward.
+func (server *serverDev) Shutdown(ctx context.Context) error {
+	defer server.ctxCancel()
+	server.drainingCancel()
+
+	server.internalLock.Lock()
+	internal := server.internal
+	server.internalLock.Unlock()
+	if internal == nil {
+		return nil
+	}
+	err := internal.Shutdown(ctx)
+	server.backgroundWG.Wait()
+	server.backgroundLock.Lock()
+	defer server.backgroundLock.Unlock()
+	return errors.Join(err, server.backgroundErr)
+}
+
+// Background runs fn alongside the server once it's started, e.g. a file watcher or a child process
+// (exec.CommandContext(ctx, ...)), so they don't outlive it. ctx is cancelled as the shutdown starts, and
+// Shutdown waits for fn to return, so it must return promptly then. Errors while the server runs are logged,
+// ones during the shutdown are Shutdown's (context.Canceled aside).
+func (server *serverDev) Background(fn func(ctx context.Context) error) Server {
+	server.background = append(server.background, fn)
+	return server
+}
+
+func (server *serverDev) runBackground(fn func(ctx context.Context) error) {
+	defer server.backgroundWG.Done()
+	err := fn(server.draining)
+	switch {
+	case err == nil || errors.Is(err, context.Canceled):
+	case server.draining.Err() == nil:
+		Log.Error("mono: background error", "err", err.Error())
+	default:
+		server.backgroundLock.Lock()
+		server.backgroundErr = errors.Join(server.backgroundErr, err)
+		server.backgroundLock.Unlock()
+	}
 }
 
 func (server *serverDev) WithBuildError(err error) Server {
 	if err != nil {
-		server.buildError = errors.Join(server.buildError, buildError(err, 1))
+		server.joinBuildError(buildError(err, 1))
 	}
 	return server
 }
 
+// joinBuildError is safe to call from concurrent registrations, e.g. Pages.
+func (server *serverDev) joinBuildError(err error) {
+	server.buildErrorLock.Lock()
+	defer server.buildErrorLock.Unlock()
+	server.buildError = errors.Join(server.buildError, err)
+}
+
 func (server *serverDev) init() {
 	if server.addr == "" {
 		server.addr = ":3000"
@@ -305,17 +1576,34 @@ func (server *serverDev) init() {
 	if len(server.middleware) == 0 {
 		server.middleware = []MiddlewareFunc{interpretPanicsAsError}
 	}
-	server.ctx, server.ctxCancel = context.WithCancel(context.Background())
+	server.ctx, server.ctxCancel = context.WithCancel(context.WithValue(context.Background(), serverContextKey{}, server))
+	server.draining, server.drainingCancel = context.WithCancel(context.Background())
 	server.buildStart = time.Now()
-	server.handlersMap = make(map[string]string)
+	server.handlersMap = make(map[string]RouteStat)
+	server.pageSums = make(map[string][sha256.Size]byte)
+	server.assets = make(map[string]Asset)
+	server.headers = make(http.Header)
 	server.handlers = make(map[string]http.HandlerFunc)
+	server.statusPages = make(map[int]BuiltPage)
 }
 
-func (server *serverDev) hostname() string {
+// hostname is the server's base url for a route's host, "" is the default one (localhost, or the tls ServerName).
+func (server *serverDev) hostname(host string) string {
+	_, port, _ := net.SplitHostPort(server.addr)
 	if server.tls == nil {
-		return fmt.Sprintf("http://localhost%s", server.addr)
+		if host == "" {
+			return fmt.Sprintf("http://localhost%s", server.addr)
+		}
+		if port != "" && port != "80" {
+			return fmt.Sprintf("http://%s:%s", host, port)
+		}
+		return "http://" + host
+	}
+	host = cmp.Or(host, server.tls.ServerName)
+	if port != "" && port != "443" {
+		return fmt.Sprintf("https://%s:%s", host, port)
 	}
-	return "https://" + server.tls.ServerName
+	return "https://" + host
 }
 
 func (server *serverDev) robotsTxt() {
@@ -326,13 +1614,16 @@ func (server *serverDev) robotsTxt() {
 	const schema = `User-agent: *
 Allow: /
 Disallow: /mono/cdn/*`
+	host := server.host
+	server.host = "" // Served for every host, not just the last Host scope.
 	server.Page("/robots.txt", BuiltPage{Data: []byte(schema), ContentType: "text/plain"})
+	server.host = host
 }
 
 var sizeofSuffix = []string{"b", "kb", "mb", "gb", "tb", "pb"}
 
-func sizeof(data []byte) string {
-	result := float64(len(data))
+func sizeof(size int) string {
+	result := float64(size)
 	i := 0
 	for result > 1024 {
 		result /= 1024
@@ -388,7 +1679,7 @@ func buildError(err error, depth ...int) error {
 	}
 }
 
-func serverPageUpdateBuiltPage(page *BuiltPage) {
+func serverPageUpdateBuiltPage(page *BuiltPage, pattern string) {
 	if page.DynamicFuncs != nil {
 		for fnName, fn := range DefaultPageDynamicFuncs {
 			if _, ok := page.DynamicFuncs[fnName]; !ok {
@@ -399,15 +1690,9 @@ func serverPageUpdateBuiltPage(page *BuiltPage) {
 		page.DynamicFuncs = DefaultPageDynamicFuncs
 	}
 	if page.DynamicData == nil {
-		type DynamicData struct {
-			Context context.Context
-			Request *http.Request
-		}
+		build := &Context{Url: pattern}
 		page.DynamicData = func(ctx context.Context, req *http.Request) any {
-			return DynamicData{
-				Context: ctx,
-				Request: req,
-			}
+			return NewSchemaData(ctx, build, req, nil)
 		}
 	}
 }
@@ -417,32 +1702,52 @@ func serverPageUpdate(rw http.ResponseWriter, page BuiltPage) http.Header {
 	if page.ContentType != "" {
 		h.Set("Content-Type", page.ContentType)
 	}
-	if strings.HasPrefix(page.ContentType, "text/css") || strings.HasPrefix(page.ContentType, "image/") || strings.HasPrefix(page.ContentType, "video/") {
+	if page.Disposition != "" {
+		h.Set("Content-Disposition", page.Disposition)
+	}
+	// Pages are the single source of their caching headers: max-age only, as Expires is redundant with it.
+	if page.RequestFuncs != nil {
+		h.Set("Cache-Control", headerCacheControlPrivate)
+	} else if strings.HasPrefix(page.ContentType, "text/css") || strings.HasPrefix(page.ContentType, "image/") || strings.HasPrefix(page.ContentType, "video/") {
 		h.Set("Cache-Control", headerCacheControlWeek)
-		h.Set("Expires", time.Now().Add(time.Hour*24*7).Format(http.TimeFormat))
 	} else {
 		h.Set("Cache-Control", headerCacheControlDay)
-		h.Set("Expires", time.Now().Add(time.Hour*24).Format(http.TimeFormat))
 	}
+	h.Del("Expires")
+	setHeaders(h, page.Headers)
 	return h
 }
 
-func gzipApplyCompression(data []byte, gzipStaticData []byte, headers http.Header, page BuiltPage) ([]byte, error) {
-	if gzipStaticData != nil && !page.IsDynamic() {
-		data = gzipStaticData
-		headers.Set("Content-Encoding", "gzip")
-	}
-	if page.IsDynamic() {
-		gzipped := bytes.NewBuffer(nil)
-		compressor, _ := gzip.NewWriterLevel(gzipped, gzip.BestSpeed)
-		if _, err := compressor.Write(data); err != nil {
-			return nil, err
-		}
-		if err := compressor.Flush(); err != nil {
-			return nil, err
+// setHeaders sets headers on h, removing the ones with empty values.
+func setHeaders(h http.Header, headers map[string]string) {
+	for key, value := range headers {
+		if value == "" {
+			h.Del(key)
+			continue
 		}
-		data = gzipped.Bytes()
-		headers.Set("Content-Encoding", "gzip")
+		h.Set(key, value)
+	}
+}
+
+// gzipDynamicMinSize is the smallest rendered page worth compressing on the fly, smaller ones barely shrink.
+const gzipDynamicMinSize = 512
+
+var gzipWriters = sync.Pool{New: func() any {
+	compressor, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return compressor
+}}
+
+// gzipDynamic compresses a rendered page, reusing the compressors, as dynamic pages are compressed on every request.
+func gzipDynamic(data []byte) ([]byte, error) {
+	compressed := bytes.NewBuffer(make([]byte, 0, len(data)/3))
+	compressor := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(compressor)
+	compressor.Reset(compressed)
+	if _, err := compressor.Write(data); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
 	}
-	return data, nil
+	return compressed.Bytes(), nil
 }
@@ -2,13 +2,30 @@ package mono_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"github.com/kittenbark/mono"
+	"github.com/kittenbark/mono/monotest"
+	"html/template"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -23,6 +40,7 @@ func init() {
 }
 
 func StartForT(t *testing.T, server mono.Server, timeout time.Duration, after time.Duration) {
+	_, _ = server.Build() // Pages are built by Start, up front the timeout is just for listening (Start reports errors).
 	time.AfterFunc(after, server.Stop)
 	go func() {
 		if err := server.Start(); err != nil {
@@ -42,6 +60,21 @@ func PrepareTest() (MonoClient, mono.Server) {
 	return client, server
 }
 
+// WriteFiles writes files (names are slash-separated paths, their dirs are created) into a t.TempDir(), returns it.
+func WriteFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, data := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
 func ReadFile(t *testing.T, expectedFile string) []byte {
 	expectedData, err := os.ReadFile(expectedFile)
 	if err != nil {
@@ -101,6 +134,34 @@ func (client *MonoClient) GetTimeout(t *testing.T, timeout time.Duration, path s
 	return body
 }
 
+func (client *MonoClient) Do(t *testing.T, method string, path string, headers ...string) (*http.Response, []byte) {
+	link, err := url.JoinPath(client.url, path)
+	if err != nil {
+		t.Fatalf("client do: %v (path=%s)", err, path)
+	}
+
+	req, err := http.NewRequestWithContext(t.Context(), method, link, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, body
+}
+
 func TestDev_File(t *testing.T) {
 	t.Parallel()
 
@@ -119,9 +180,1597 @@ func TestDev_File(t *testing.T) {
 	}
 }
 
+func TestDev_StatusError(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		Handler("/missing", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			return fmt.Errorf("wrapped: %w", mono.NewStatusError(http.StatusNotFound, "no such thing"))
+		}).
+		Handler("/broken", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			return errors.New("unclassified")
+		}).
+		Handler("/ok", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			return mono.NewStatusError(http.StatusOK, "not an error")
+		})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	resp, body := cl.Do(t, http.MethodGet, "/missing")
+	if resp.StatusCode != http.StatusNotFound || string(body) != "404 no such thing" {
+		t.Fatalf(`/missing: expected 404 "404 no such thing", got %d "%s"`, resp.StatusCode, body)
+	}
+	resp, body = cl.Do(t, http.MethodGet, "/broken")
+	if resp.StatusCode != http.StatusInternalServerError || string(body) != "500 Internal Server Error" {
+		t.Fatalf(`/broken: expected 500, got %d "%s"`, resp.StatusCode, body)
+	}
+	resp, body = cl.Do(t, http.MethodGet, "/ok")
+	if resp.StatusCode != http.StatusInternalServerError || string(body) != "500 not an error" {
+		t.Fatalf(`/ok: expected a non-error status to be 500, got %d "%s"`, resp.StatusCode, body)
+	}
+	for _, status := range []int{0, 200, 302, 600} {
+		if err := mono.NewStatusError(status, ""); err.(mono.StatusError).Status != http.StatusInternalServerError {
+			t.Errorf("NewStatusError(%d): expected 500, got %v", status, err)
+		}
+	}
+}
+
 func def[T any](value []T, otherwise T) T {
 	if len(value) == 0 {
 		return otherwise
 	}
 	return value[0]
 }
+
+func BenchmarkPages(b *testing.B) {
+	pages := map[string]mono.Page{}
+	for i := range 500 {
+		pages[fmt.Sprintf("/page/%d", i)] = mono.Html(template.HTML(strings.Repeat(
+			fmt.Sprintf("<p>page %d: some moderately compressible text</p>\n", i),
+			200,
+		)))
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		for b.Loop() {
+			server := mono.New()
+			for pattern, page := range pages {
+				server.Page(pattern, page)
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		for b.Loop() {
+			mono.New().Pages(pages)
+		}
+	})
+}
+
+func TestStatsData(t *testing.T) {
+	t.Parallel()
+
+	data := strings.Repeat("<p>budget</p>\n", 512)
+	compressed := bytes.NewBuffer(nil)
+	compressor, _ := gzip.NewWriterLevel(compressed, gzip.BestCompression)
+	_, _ = compressor.Write([]byte(data))
+	_ = compressor.Close()
+
+	stats := mono.New().
+		Page("/", mono.Html(template.HTML(data))).
+		Handler("/api", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil }).
+		StatsData()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 routes, got %v", stats)
+	}
+
+	home, api := stats[0], stats[1]
+	if home.Pattern != "/" || home.Type != mono.RouteStaticPage || home.Bytes != len(data) || home.GzipBytes != compressed.Len() {
+		t.Fatalf("unexpected home stats: %+v (expected bytes=%d, gzip=%d)", home, len(data), compressed.Len())
+	}
+	if home.GzipBytes > 1024 {
+		t.Fatalf("home page is over the 1kb gzip budget: %d", home.GzipBytes)
+	}
+	if api.Pattern != "/api" || api.Type != mono.RouteDynamic || api.Bytes != 0 {
+		t.Fatalf("unexpected api stats: %+v", api)
+	}
+}
+
+func TestDev_PanicResponse(t *testing.T) {
+	env := mono.CurrentEnv
+	defer func() { mono.CurrentEnv = env }()
+
+	cl, server := PrepareTest()
+	server.Handler("/panic", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		panic("boom")
+	})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	mono.CurrentEnv = mono.EnvDev
+	resp, body := cl.Do(t, http.MethodGet, "/panic")
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "panic: boom") || !strings.Contains(string(body), "goroutine") {
+		t.Fatalf("dev: expected 500 with panic details, got %d %q", resp.StatusCode, body)
+	}
+	resp, body = cl.Do(t, http.MethodGet, "/panic", "Accept", "application/json")
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") || !strings.Contains(string(body), "panic: boom") {
+		t.Fatalf("dev: expected the panic details as json, got %s %q", resp.Header.Get("Content-Type"), body)
+	}
+
+	mono.CurrentEnv = mono.EnvProd
+	resp, body = cl.Do(t, http.MethodGet, "/panic")
+	if resp.StatusCode != http.StatusInternalServerError || string(body) != "500 Internal Server Error" {
+		t.Fatalf("prod: expected a generic 500, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestDev_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	t.Run("clean", func(t *testing.T) {
+		t.Parallel()
+
+		cl, server := PrepareTest()
+		server.Page("/", mono.Html("ok"))
+		go func() { _ = server.Start() }()
+		time.Sleep(time.Millisecond * 10)
+
+		if body := cl.Get(t, "/"); string(body) != "ok" {
+			t.Fatalf(`expected "ok", got "%s"`, body)
+		}
+		ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Fatalf("expected a clean shutdown, got %v", err)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		t.Parallel()
+
+		cl, server := PrepareTest()
+		inflight := make(chan struct{})
+		server.Handler("/slow", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			close(inflight)
+			time.Sleep(time.Millisecond * 500)
+			return nil
+		})
+		go func() { _ = server.Start() }()
+		time.Sleep(time.Millisecond * 10)
+
+		go func() {
+			if resp, err := http.Get(cl.url + "/slow"); err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+		<-inflight
+
+		ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond*50)
+		defer cancel()
+		if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a deadline error, got %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+
+		cl, server := PrepareTest()
+		inflight := make(chan struct{})
+		server.
+			ShutdownTimeout(time.Second).
+			Handler("/slow", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+				close(inflight)
+				time.Sleep(time.Millisecond * 100)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				_, err := rw.Write([]byte("drained"))
+				return err
+			}).
+			SSE("/events", func(ctx context.Context, send func(event, data string) error) error {
+				<-ctx.Done()
+				return ctx.Err()
+			})
+		go func() { _ = server.Start() }()
+		time.Sleep(time.Millisecond * 10)
+
+		events, err := http.Get(cl.url + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer events.Body.Close()
+		slow := make(chan string, 1)
+		go func() {
+			resp, err := http.Get(cl.url + "/slow")
+			if err != nil {
+				slow <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			slow <- string(body)
+		}()
+		<-inflight
+
+		start := time.Now()
+		if err := server.Close(); err != nil {
+			t.Fatalf("expected the in-flight request to drain, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+			t.Errorf("expected the open event stream not to hold the drain, took %v", elapsed)
+		}
+		if body := <-slow; body != "drained" {
+			t.Errorf(`expected "drained", got %q`, body)
+		}
+	})
+}
+
+func TestDev_StartContext(t *testing.T) {
+	t.Parallel()
+
+	t.Run("cancel", func(t *testing.T) {
+		t.Parallel()
+
+		cl, server := PrepareTest()
+		server.Page("/", mono.Html("ok"))
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan error, 1)
+		go func() { done <- server.StartContext(ctx) }()
+		time.Sleep(time.Millisecond * 10)
+
+		if body := cl.Get(t, "/"); string(body) != "ok" {
+			t.Fatalf(`expected "ok", got "%s"`, body)
+		}
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("expected a clean stop, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the server to stop once ctx is cancelled")
+		}
+		if _, err := http.Get(cl.url + "/"); err == nil {
+			t.Error("expected the listener to be closed")
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+
+		_, server := PrepareTest()
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		done := make(chan error, 1)
+		go func() { done <- server.Page("/", mono.Html("ok")).StartContext(ctx) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("expected a clean stop, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected a cancelled ctx not to start the server")
+		}
+	})
+}
+
+func TestDev_Background(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	started := make(chan struct{}, 2)
+	var child *exec.Cmd
+	watcherClosed := atomic.Bool{}
+	server.
+		Page("/", mono.Html("ok")).
+		Background(func(ctx context.Context) error {
+			child = exec.CommandContext(ctx, "sleep", "60")
+			if err := child.Start(); err != nil {
+				return err
+			}
+			started <- struct{}{}
+			_ = child.Wait() // Killed once the shutdown starts.
+			return nil
+		}).
+		Background(func(ctx context.Context) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			watcherClosed.Store(true)
+			return errors.New("watcher: close failed")
+		})
+	go func() { _ = server.Start() }()
+	<-started
+	<-started
+	time.Sleep(time.Millisecond * 10)
+
+	if body := cl.Get(t, "/"); string(body) != "ok" {
+		t.Fatalf(`expected "ok", got "%s"`, body)
+	}
+	if err := server.Close(); err == nil || !strings.Contains(err.Error(), "watcher: close failed") {
+		t.Errorf("expected the watcher's error from Close, got %v", err)
+	}
+	if child.ProcessState == nil || child.ProcessState.Success() {
+		t.Errorf("expected the child process to be killed, got %v", child.ProcessState)
+	}
+	if !watcherClosed.Load() {
+		t.Error("expected the watcher to be closed")
+	}
+}
+
+func TestDev_CoalesceDynamicPage(t *testing.T) {
+	t.Parallel()
+
+	renders := atomic.Int64{}
+	cl, server := PrepareTest()
+	server.Page("/expensive", mono.BuiltPage{
+		Data:        []byte(`render #{${.}$}`),
+		ContentType: "text/plain",
+		Dynamic:     true,
+		DynamicData: func(ctx context.Context, req *http.Request) any {
+			time.Sleep(time.Millisecond * 200)
+			return renders.Add(1)
+		},
+		CoalesceKey: mono.CoalesceByURL,
+	})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	const requests = 10
+	bodies := make(chan string, requests)
+	wg := sync.WaitGroup{}
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies <- string(cl.Get(t, "/expensive"))
+		}()
+	}
+	wg.Wait()
+	close(bodies)
+
+	if renders.Load() != 1 {
+		t.Fatalf("expected a single render, got %d", renders.Load())
+	}
+	for body := range bodies {
+		if body != "render #1" {
+			t.Fatalf(`expected "render #1", got "%s"`, body)
+		}
+	}
+}
+
+func TestDev_Headers(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		Header("X-Site", "mono").
+		Headers(map[string]string{"Permissions-Policy": "camera=()", "X-Frame-Options": "SAMEORIGIN", "X-Draft": "1"}).
+		Header("X-Draft", "").
+		Page("/{$}", mono.Html("home")).
+		Handler("/api", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			rw.Header().Set("X-Site", "api")
+			return nil
+		}).
+		Get("/feed", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil })
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for path, site := range map[string]string{"/": "mono", "/robots.txt": "mono", "/api": "api"} {
+		resp, _ := cl.Do(t, http.MethodGet, path)
+		if resp.Header.Get("X-Draft") != "" {
+			t.Errorf(`%s: expected X-Draft to be removed, got "%s"`, path, resp.Header.Get("X-Draft"))
+		}
+		if actual := resp.Header.Get("X-Site"); actual != site {
+			t.Errorf(`%s: expected X-Site "%s", got "%s"`, path, site, actual)
+		}
+		if actual := resp.Header.Get("Permissions-Policy"); actual != "camera=()" {
+			t.Errorf(`%s: expected Permissions-Policy "camera=()", got "%s"`, path, actual)
+		}
+		if actual := resp.Header.Get("X-Frame-Options"); actual != "DENY" {
+			t.Errorf(`%s: expected SaneHeaders to override X-Frame-Options, got "%s"`, path, actual)
+		}
+	}
+	// Unmatched requests are answered by the mux, without middleware, the constant headers still apply.
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{{http.MethodGet, "/missing", http.StatusNotFound}, {http.MethodPost, "/feed", http.StatusMethodNotAllowed}} {
+		resp, _ := cl.Do(t, tc.method, tc.path)
+		if resp.StatusCode != tc.status || resp.Header.Get("X-Site") != "mono" || resp.Header.Get("X-Draft") != "" {
+			t.Errorf(`%s %s: expected %d with X-Site, got %d %v`, tc.method, tc.path, tc.status, resp.StatusCode, resp.Header)
+		}
+	}
+}
+
+func TestDev_ConcurrentBuildErrors(t *testing.T) {
+	t.Parallel()
+
+	_, server := PrepareTest()
+	pages := map[string]mono.Page{}
+	for i := range 32 {
+		pattern := fmt.Sprintf("/batch/%d", i)
+		if i%2 == 0 {
+			pages[pattern] = mono.Html("ok")
+			continue
+		}
+		pages[pattern] = mono.StaticFunc(func(ctx *mono.Context) (mono.BuiltPage, error) {
+			return mono.BuiltPage{}, fmt.Errorf("broken(%s)", ctx.Url)
+		})
+	}
+
+	wg := sync.WaitGroup{}
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Page(fmt.Sprintf("/single/%d", i), mono.Html(`{${ broken }$}`))
+		}()
+	}
+	server.Pages(pages)
+	wg.Wait()
+
+	err := server.Start()
+	if err == nil {
+		t.Fatal("expected build errors")
+	}
+	for i := range 32 {
+		if i%2 == 1 && !strings.Contains(err.Error(), fmt.Sprintf("broken(/batch/%d)", i)) {
+			t.Errorf("missing error for /batch/%d", i)
+		}
+	}
+	for i := range 16 {
+		if !strings.Contains(err.Error(), fmt.Sprintf("/single/%d", i)) {
+			t.Errorf("missing error for /single/%d", i)
+		}
+	}
+}
+
+func TestDev_SubpatternConflict(t *testing.T) {
+	t.Parallel()
+
+	withAsset := func(css string) mono.BuiltPage {
+		return mono.BuiltPage{
+			Data:        []byte("home"),
+			ContentType: "text/html; charset=utf-8",
+			Subpattern: map[string]*mono.BuiltPage{
+				"/mono/cdn/file/style.css": {Data: []byte(css), ContentType: "text/css"},
+			},
+		}
+	}
+	asset := func(css string) mono.BuiltPage {
+		return mono.BuiltPage{Data: []byte(css), ContentType: "text/css"}
+	}
+
+	t.Run("identical", func(t *testing.T) {
+		_, server := PrepareTest()
+		server.
+			Page("/", withAsset("body{}")).
+			Page("/mono/cdn/file/style.css", asset("body{}"))
+		StartForT(t, server, time.Millisecond*10, time.Millisecond*100)
+	})
+
+	t.Run("different", func(t *testing.T) {
+		_, server := PrepareTest()
+		server.
+			Page("/", withAsset("body{}")).
+			Page("/mono/cdn/file/style.css", asset("body{color:red}"))
+		time.AfterFunc(time.Millisecond*100, server.Stop)
+		err := server.Start()
+		if err == nil || !strings.Contains(err.Error(), "subpattern conflict: /mono/cdn/file/style.css") {
+			t.Fatalf("expected a subpattern conflict, got %v", err)
+		}
+	})
+
+	t.Run("built page", func(t *testing.T) {
+		page := mono.BuiltPage{}
+		if err := page.SetSubpattern("/x.css", &mono.BuiltPage{Data: []byte("a")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := page.SetSubpattern("/x.css", &mono.BuiltPage{Data: []byte("a")}); err != nil {
+			t.Fatalf("identical contents must not conflict: %v", err)
+		}
+		if err := page.SetSubpattern("/x.css", &mono.BuiltPage{Data: []byte("b")}); err == nil {
+			t.Fatal("expected a subpattern conflict")
+		}
+	})
+}
+
+func TestDev_Assets(t *testing.T) {
+	t.Parallel()
+
+	image := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	dir := WriteFiles(t, map[string]string{
+		"layout.gohtml": `<html><head>{{tailwind "inline=false"}}</head><body>{{children}}</body></html>`,
+		"index.gohtml":  `<main class="p-4">{{file (rel "cat.png")}}</main>`,
+		"cat.png":       string(image),
+	})
+
+	cl, server := PrepareTest()
+	server.Page("/", mono.Nextjs(dir, &mono.Tailwind{CLI: FakeTailwindCLI(t, ".p-4{padding:1rem}.m-4{margin:1rem}")}))
+	assets := server.Assets()
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	if len(assets) != 2 {
+		t.Fatalf("expected the image and tailwind css, got %+v", assets)
+	}
+	png, css := assets[0], assets[1]
+	checks := []struct {
+		asset       mono.Asset
+		prefix      string
+		contentType string
+		data        []byte
+	}{
+		{png, "/mono/cdn/file/", "image/png", image},
+		{css, "/mono/cdn/tailwind/", "text/css; charset=utf-8", []byte(".p-4{padding:1rem}.m-4{margin:1rem}")},
+	}
+	for _, check := range checks {
+		sum := sha256.Sum256(check.data)
+		if !strings.HasPrefix(check.asset.URL, check.prefix) ||
+			check.asset.ContentType != check.contentType ||
+			check.asset.Bytes != len(check.data) ||
+			check.asset.Hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected asset %+v", check.asset)
+		}
+		if body := cl.Get(t, check.asset.URL); !bytes.Equal(body, check.data) {
+			t.Errorf("%s: expected the asset contents, got %q", check.asset.URL, body)
+		}
+	}
+}
+
+func TestDev_BaseContext(t *testing.T) {
+	t.Parallel()
+
+	type key struct{}
+	base, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "pool"))
+	defer cancel()
+
+	value := func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		_, err := fmt.Fprint(rw, ctx.Value(key{}))
+		return err
+	}
+	cl, server := PrepareTest()
+	server.
+		BaseContext(base).
+		Handler("/a", value).
+		Handler("/b", value)
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for _, path := range []string{"/a", "/b"} {
+		if body := string(cl.Get(t, path)); body != "pool" {
+			t.Errorf(`%s: expected "pool", got "%s"`, path, body)
+		}
+	}
+
+	server.Stop()
+	if base.Err() != nil {
+		t.Fatal("Stop must not cancel the base context itself")
+	}
+}
+
+func TestStatsData_Methods(t *testing.T) {
+	t.Parallel()
+
+	reply := func(body string) mono.HandlerFunc {
+		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := rw.Write([]byte(body))
+			return err
+		}
+	}
+	cl, server := PrepareTest()
+	server.
+		Handler("GET /x", reply("get")).
+		Handler("POST  /x", reply("post")).
+		Page("GET /page", mono.Html("page"))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	stats := server.StatsData()
+	expected := []mono.RouteStat{
+		{Pattern: "GET /x", Method: http.MethodGet, Path: "/x", Type: mono.RouteDynamic},
+		{Pattern: "POST /x", Method: http.MethodPost, Path: "/x", Type: mono.RouteDynamic},
+	}
+	if len(stats) != 4 || stats[0] != expected[0] || stats[1] != expected[1] {
+		t.Fatalf("expected GET /x and POST /x to be separate routes, got %+v", stats)
+	}
+	if page := stats[2]; page.Pattern != "GET /page" || page.Path != "/page" || page.Type != mono.RouteStaticPage {
+		t.Fatalf("unexpected page stats: %+v", page)
+	}
+
+	for method, expected := range map[string]string{http.MethodGet: "get", http.MethodPost: "post"} {
+		if _, body := cl.Do(t, method, "/x"); string(body) != expected {
+			t.Errorf(`%s /x: expected "%s", got "%s"`, method, expected, body)
+		}
+	}
+}
+
+func TestStats_Log(t *testing.T) {
+	defer mono.ResetDefaults()
+	logs := bytes.NewBuffer(nil)
+	mono.Log = slog.New(slog.NewTextHandler(logs, nil))
+
+	mono.NewWithoutDefaults().
+		Addr(":3000").
+		Handler("POST /x", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil }).
+		Page("/page", mono.Html("page")).
+		Stats()
+
+	for _, expected := range []string{
+		`msg="mono: route" url=http://localhost:3000/x method=POST type=dynamic`,
+		`msg="mono: route" url=http://localhost:3000/page method=* type=`,
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected %q in logs: %s", expected, logs.String())
+		}
+	}
+}
+
+func TestDev_RequestFuncs(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.Page("/", mono.BuiltPage{
+		Data:        []byte(`<p>hi, {${ user }$}</p>`),
+		ContentType: "text/html; charset=utf-8",
+		Dynamic:     true,
+		RequestFuncs: func(ctx context.Context, req *http.Request) template.FuncMap {
+			return template.FuncMap{"user": func() string {
+				if user := req.Header.Get("X-User"); user != "" {
+					return user
+				}
+				return "anonymous"
+			}}
+		},
+	})
+	server.Page("/no-store", mono.BuiltPage{
+		Data:        []byte(`<p>{${ now }$}</p>`),
+		ContentType: "text/html; charset=utf-8",
+		Dynamic:     true,
+		Headers:     map[string]string{"Cache-Control": "no-store"},
+		RequestFuncs: func(ctx context.Context, req *http.Request) template.FuncMap {
+			return template.FuncMap{"now": time.Now}
+		},
+	})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for user, expected := range map[string]string{"kitten": "<p>hi, kitten</p>", "": "<p>hi, anonymous</p>"} {
+		resp, body := cl.Do(t, http.MethodGet, "/", "X-User", user)
+		if string(body) != expected {
+			t.Errorf("expected %s, got %s", expected, body)
+		}
+		if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "private, no-cache" {
+			t.Errorf(`expected Cache-Control "private, no-cache", got "%s"`, cacheControl)
+		}
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/no-store"); resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf(`expected the page's Cache-Control "no-store", got "%s"`, resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestDev_WriteManifest(t *testing.T) {
+	t.Parallel()
+
+	css := []byte(".p-4{padding:1rem}")
+	home := mono.BuiltPage{
+		Data:        []byte(`<main class="p-4">hi</main>`),
+		ContentType: "text/html; charset=utf-8",
+		Subpattern:  map[string]*mono.BuiltPage{"/style.css": {Data: css, ContentType: "text/css; charset=utf-8"}},
+	}
+	_, server := PrepareTest()
+	server.
+		Page("/", home).
+		Handler("POST /api", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil })
+
+	buffer := bytes.NewBuffer(nil)
+	if err := server.WriteManifest(buffer); err != nil {
+		t.Fatal(err)
+	}
+	manifest := mono.Manifest{}
+	if err := json.Unmarshal(buffer.Bytes(), &manifest); err != nil {
+		t.Fatalf("%v: %s", err, buffer)
+	}
+
+	homeSum, cssSum := sha256.Sum256(home.Data), sha256.Sum256(css)
+	routes := map[string]mono.ManifestRoute{}
+	for _, route := range manifest.Routes {
+		routes[route.Pattern] = route
+	}
+	if manifest.Version != mono.ManifestVersion || manifest.BuildDuration <= 0 || len(routes) != 3 {
+		t.Fatalf("unexpected manifest: %s", buffer)
+	}
+	if route := routes["/"]; route.Type != mono.RouteStaticPage || route.GzipBytes == 0 || route.Hash != hex.EncodeToString(homeSum[:]) {
+		t.Errorf("unexpected / route: %+v", route)
+	}
+	if route := routes["POST /api"]; route.Type != mono.RouteDynamic || route.Hash != "" {
+		t.Errorf("unexpected POST /api route: %+v", route)
+	}
+	if len(manifest.Assets) != 1 || manifest.Assets[0].URL != "/style.css" || manifest.Assets[0].Hash != hex.EncodeToString(cssSum[:]) {
+		t.Errorf("unexpected assets: %+v", manifest.Assets)
+	}
+	if !strings.Contains(buffer.String(), `"gzip_bytes"`) {
+		t.Errorf("expected snake_case fields: %s", buffer)
+	}
+}
+
+func TestDev_CleanPaths(t *testing.T) {
+	t.Parallel()
+
+	echo := func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		_, err := rw.Write([]byte(req.URL.Path))
+		return err
+	}
+	noRedirects := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	type expected struct {
+		status   int
+		body     string
+		location string
+	}
+	modes := map[mono.PathCleaning]map[string]expected{
+		mono.PathCleanRedirect: {
+			"//a/b":   {status: http.StatusMovedPermanently, location: "/a/b"},
+			"/a//b":   {status: http.StatusMovedPermanently, location: "/a/b"},
+			"/a/../b": {status: http.StatusMovedPermanently, location: "/b"},
+		},
+		mono.PathCleanSilent: {
+			"//a/b":   {status: http.StatusOK, body: "/a/b"},
+			"/a//b":   {status: http.StatusOK, body: "/a/b"},
+			"/a/../b": {status: http.StatusOK, body: "/b"},
+		},
+		mono.PathCleanNone: {
+			"//a/b":   {status: http.StatusOK, body: "//a/b"},
+			"/a//b":   {status: http.StatusOK, body: "/a//b"},
+			"/a/../b": {status: http.StatusOK, body: "/a/../b"},
+		},
+	}
+	for mode, tests := range modes {
+		cl, server := PrepareTest()
+		server.CleanPaths(mode).Handler("/a/b", echo).Handler("/b", echo)
+		StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+		for path, expected := range tests {
+			resp, err := noRedirects.Get(cl.url + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != expected.status || string(body) != expected.body && expected.status == http.StatusOK ||
+				resp.Header.Get("Location") != expected.location {
+				t.Errorf("mode %d, %s: expected %+v, got %d %q (location %q)",
+					mode, path, expected, resp.StatusCode, body, resp.Header.Get("Location"))
+			}
+		}
+	}
+}
+
+func TestDev_CompressibleTypes(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(strings.Repeat(`{"name":"kitten","lives":9},`, 64))
+	cl, server := PrepareTest()
+	server.
+		Page("/data.json", mono.BuiltPage{Data: data, ContentType: "application/json"}).
+		Page("/icon.svg", mono.BuiltPage{Data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), ContentType: "image/svg+xml"}).
+		Page("/cat.png", mono.BuiltPage{Data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), ContentType: "image/png"})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	resp, body := cl.Do(t, http.MethodGet, "/data.json", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzipped json, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed, err := io.ReadAll(reader); err != nil || !bytes.Equal(decompressed, data) {
+		t.Errorf("expected the json back, got %q (%v)", decompressed, err)
+	}
+
+	for path, expected := range map[string]string{"/icon.svg": "gzip", "/cat.png": ""} {
+		if resp, _ := cl.Do(t, http.MethodGet, path, "Accept-Encoding", "gzip"); resp.Header.Get("Content-Encoding") != expected {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", path, expected, resp.Header.Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestDev_ErrorNegotiation(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		StatusPage(http.StatusNotFound, mono.Html("<h1>Lost?</h1>")).
+		Handler("/user", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			return mono.NewStatusError(http.StatusNotFound, "no such user")
+		})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	tests := []struct {
+		path, accept string
+		contentType  string
+		body         string
+	}{
+		{"/missing", "application/json", "application/json", `{"error":"Not Found","status":404}`},
+		{"/user", "application/problem+json, */*;q=0.1", "application/json", `{"error":"no such user","status":404}`},
+		{"/missing", "text/html,application/xhtml+xml,*/*;q=0.8", "text/html", "<h1>Lost?</h1>"},
+		{"/user", "text/html", "text/html", "<h1>Lost?</h1>"},
+		{"/missing", "*/*", "text/plain", "404 Not Found"},
+		{"/user", "", "text/plain", "404 no such user"},
+	}
+	for _, test := range tests {
+		resp, body := cl.Do(t, http.MethodGet, test.path, "Accept", test.accept)
+		if resp.StatusCode != http.StatusNotFound ||
+			!strings.HasPrefix(resp.Header.Get("Content-Type"), test.contentType) ||
+			!strings.Contains(string(body), test.body) {
+			t.Errorf("%s (Accept: %s): expected 404 %s %q, got %d %s %q",
+				test.path, test.accept, test.contentType, test.body, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+}
+
+func TestDev_ShuttingDown(t *testing.T) {
+	t.Parallel()
+
+	// Stop cancels the handlers' base context before draining, cancelling it by hand keeps the listener open.
+	base, cancel := context.WithCancel(context.Background())
+	called := atomic.Bool{}
+	cl, server := PrepareTest()
+	server.
+		BaseContext(base).
+		Handler("/", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			called.Store(true)
+			return ctx.Err()
+		})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	cancel()
+	resp, body := cl.Do(t, http.MethodGet, "/")
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "503 server is shutting down" {
+		t.Errorf("expected 503 while shutting down, got %d %q", resp.StatusCode, body)
+	}
+	if called.Load() {
+		t.Error("expected the handler not to be called while shutting down")
+	}
+}
+
+func TestDev_Host(t *testing.T) {
+	t.Parallel()
+
+	reply := func(body string) mono.HandlerFunc {
+		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := rw.Write([]byte(body))
+			return err
+		}
+	}
+	cl, server := PrepareTest()
+	server.
+		Handler("/", reply("any")).
+		Host("api.test").
+		Handler("/", reply("api")).
+		Page("GET /status", mono.Html("api status")).
+		Host("WWW.test").
+		Handler("/home", reply("www")).
+		Host("").
+		Handler("/shared", reply("shared"))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for _, test := range []struct{ host, path, body string }{
+		{"api.test", "/", "api"},
+		{"api.test", "/status", "api status"},
+		{"www.test", "/home", "www"},
+		{"www.test", "/shared", "shared"},
+		{"api.test", "/shared", "api"},
+		{"other.test", "/", "any"},
+	} {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, cl.url+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = test.host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if !strings.Contains(string(body), test.body) {
+			t.Errorf("%s%s: expected %q, got %q", test.host, test.path, test.body, body)
+		}
+	}
+
+	hosts := map[string]string{}
+	for _, stat := range server.StatsData() {
+		hosts[stat.Pattern] = stat.Host
+	}
+	if hosts["api.test/"] != "api.test" || hosts["GET api.test/status"] != "api.test" || hosts["/shared"] != "" {
+		t.Errorf("expected hosts in stats, got %v", hosts)
+	}
+
+	_, err := mono.New().Host("api.test:8080").Handler("/", reply("api")).Build()
+	if err == nil || !strings.Contains(err.Error(), "has a port") {
+		t.Errorf("expected a build error for a host with a port, got %v", err)
+	}
+}
+
+func TestDev_RobotsTxtHost(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.Host("api.test").Page("/status", mono.Html("api status"))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for _, host := range []string{"api.test", "other.test"} {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, cl.url+"/robots.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "User-agent: *") {
+			t.Errorf("%s: expected robots.txt, got %d %q", host, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestDev_Methods(t *testing.T) {
+	t.Parallel()
+
+	reply := func(body string) mono.HandlerFunc {
+		return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := rw.Write([]byte(body))
+			return err
+		}
+	}
+	cl, server := PrepareTest()
+	server.
+		Get("/item", reply("get")).
+		Post("/item", reply("post")).
+		Put("/item", reply("put")).
+		Delete("/item", reply("delete")).
+		Patch("/other", reply("patch"))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for method, expected := range map[string]string{
+		http.MethodGet:    "get",
+		http.MethodPost:   "post",
+		http.MethodPut:    "put",
+		http.MethodDelete: "delete",
+	} {
+		if resp, body := cl.Do(t, method, "/item"); resp.StatusCode != http.StatusOK || string(body) != expected {
+			t.Errorf("%s /item: expected %q, got %d %q", method, expected, resp.StatusCode, body)
+		}
+	}
+	if resp, body := cl.Do(t, http.MethodPatch, "/other"); string(body) != "patch" {
+		t.Errorf("PATCH /other: expected patch, got %d %q", resp.StatusCode, body)
+	}
+
+	resp, body := cl.Do(t, http.MethodPatch, "/item")
+	allow := resp.Header.Get("Allow")
+	if resp.StatusCode != http.StatusMethodNotAllowed || string(body) != "405 Method Not Allowed" {
+		t.Errorf("PATCH /item: expected 405, got %d %q", resp.StatusCode, body)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		if !strings.Contains(allow, method) {
+			t.Errorf("expected %s in Allow, got %q", method, allow)
+		}
+	}
+
+	if err := mono.New().Get("POST /x", reply("")).Start(); err == nil {
+		t.Error("expected a build error for a pattern with a method")
+	}
+}
+
+func TestDev_StreamPage(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	releaseOnce := sync.OnceFunc(func() { close(release) })
+	time.AfterFunc(time.Millisecond*500, releaseOnce) // Not to hang if the page isn't streamed.
+	cl, server := PrepareTest()
+	server.Page("/big", mono.BuiltPage{
+		Data:        []byte(`<p>start</p>{${flush}$}{${wait}$}<p>end</p>`),
+		ContentType: "text/html; charset=utf-8",
+		Dynamic:     true,
+		Stream:      true,
+		DynamicFuncs: template.FuncMap{"wait": func() string {
+			<-release
+			return ""
+		}},
+	})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, err := http.Get(cl.url + "/big")
+	if err != nil {
+		releaseOnce()
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	received := []byte{}
+	buffer := make([]byte, 1024)
+	for !bytes.Contains(received, []byte("<p>start</p>")) {
+		n, err := resp.Body.Read(buffer)
+		received = append(received, buffer[:n]...)
+		if err != nil {
+			releaseOnce()
+			t.Fatalf("expected the start before the page is rendered, got %q (%v)", received, err)
+		}
+	}
+	if bytes.Contains(received, []byte("end")) {
+		t.Fatalf("expected only the start so far, got %q", received)
+	}
+
+	releaseOnce()
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(received) + string(rest); body != "<p>start</p><p>end</p>" || !resp.Uncompressed {
+		t.Errorf("expected the whole gzipped page in the end, got %q (uncompressed=%v)", body, resp.Uncompressed)
+	}
+}
+
+func TestDev_StreamPageError(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.Page("/broken", mono.BuiltPage{
+		Data:         []byte(`{${fail}$}<p>never</p>`),
+		ContentType:  "text/html; charset=utf-8",
+		Dynamic:      true,
+		Stream:       true,
+		Headers:      map[string]string{"Cache-Control": "public, max-age=3600"},
+		DynamicFuncs: template.FuncMap{"fail": func() (string, error) { return "", errors.New("no data") }},
+	})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, body := cl.Do(t, http.MethodGet, "/broken", "Accept-Encoding", "gzip")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Cache-Control") != "" {
+		t.Errorf("expected no page headers on the error, got %v", resp.Header)
+	}
+}
+
+func TestDev_Transform(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		Page("/", mono.Html("home")). // Registered before the Transform, it still applies.
+		Transform(func(pattern string, page *mono.BuiltPage) error {
+			if strings.HasPrefix(page.ContentType, "text/html") {
+				page.Data = append(page.Data, []byte("<!-- "+pattern+" -->")...)
+			}
+			return nil
+		}).
+		Page("/about", mono.Html("about")).
+		Page("/style.css", mono.BuiltPage{Data: []byte("p{}"), ContentType: "text/css; charset=utf-8"})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for path, expected := range map[string]string{"/": "<!-- / -->", "/about": "<!-- /about -->"} {
+		if body := string(cl.Get(t, path)); !strings.HasSuffix(body, expected) {
+			t.Errorf("%s: expected %s at the end, got %q", path, expected, body)
+		}
+	}
+	if body := string(cl.Get(t, "/style.css")); body != "p{}" {
+		t.Errorf("expected css to be left alone, got %q", body)
+	}
+
+	err := mono.New().
+		Transform(func(pattern string, page *mono.BuiltPage) error { return fmt.Errorf("minifier failed") }).
+		Page("/", mono.Html("home")).
+		Start()
+	if err == nil || !strings.Contains(err.Error(), "minifier failed") {
+		t.Errorf("expected the transform error to fail the build, got %v", err)
+	}
+}
+
+func TestDev_SSE(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan error, 1)
+	cl, server := PrepareTest()
+	server.
+		SSE("/events", func(ctx context.Context, send func(event, data string) error) error {
+			return errors.Join(send("", "hello"), send("tick", "1\n2"))
+		}).
+		SSE("/forever", func(ctx context.Context, send func(event, data string) error) error {
+			_, hasDeadline := ctx.Deadline()
+			if err := send("deadline", fmt.Sprint(hasDeadline)); err != nil {
+				return err
+			}
+			<-ctx.Done()
+			done <- ctx.Err()
+			return ctx.Err()
+		})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, body := cl.Do(t, http.MethodGet, "/events")
+	if resp.Header.Get("Content-Type") != "text/event-stream" || string(body) != "data: hello\n\nevent: tick\ndata: 1\ndata: 2\n\n" {
+		t.Errorf("unexpected events: %s %q", resp.Header.Get("Content-Type"), body)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, cl.url+"/forever", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, len("event: deadline\ndata: false\n\n"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "event: deadline\ndata: false\n\n" {
+		t.Errorf("expected the first event right away without a handler deadline, got %q (%v)", first, err)
+	}
+	cancel()
+	_ = resp.Body.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the handler context to be cancelled, got %v", err)
+		}
+	case <-time.After(time.Millisecond * 500):
+		t.Error("expected the handler to stop once the client is gone")
+	}
+
+	for _, stat := range server.StatsData() {
+		if stat.Path != "/robots.txt" && stat.Type != mono.RouteStream {
+			t.Errorf("%s: expected a stream route, got %s", stat.Pattern, stat.Type)
+		}
+	}
+}
+
+func TestDev_NoRoutes(t *testing.T) {
+	logs := monotest.CaptureLogs(t) // Resets the defaults below once the test ends.
+
+	_, server := PrepareTest()
+	server.Page("/", mono.Nextjs(t.TempDir()))
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*100)
+	if !strings.Contains(logs.String(), "no routes are registered") {
+		t.Errorf("expected a warning, got logs: %s", logs.String())
+	}
+
+	mono.Strict = true
+	if err := mono.New().Start(); err == nil || !strings.Contains(err.Error(), "no routes are registered") {
+		t.Errorf("expected an error in strict mode, got %v", err)
+	}
+}
+
+func TestDev_Dir(t *testing.T) {
+	defer mono.ResetDefaults()
+	mono.InMemoryFilesizeThreshold = 16
+
+	root := WriteFiles(t, map[string]string{
+		"index.html":      "<h1>root</h1>",
+		"docs/index.html": "<h1>docs</h1>",
+		"css/app.css":     "body{}",
+		".env":            "SECRET=1",
+		".git/config":     "[core]",
+		"big.txt":         "0123456789abcdefghijklmnopqrstuvwxyz",
+	})
+
+	cl, server := PrepareTest()
+	server.Dir("/static/", root)
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	for path, expected := range map[string]string{
+		"/static/":                "<h1>root</h1>",
+		"/static/index.html":      "<h1>root</h1>",
+		"/static/docs/":           "<h1>docs</h1>",
+		"/static/docs/index.html": "<h1>docs</h1>",
+		"/static/css/app.css":     "body{}",
+		"/static/big.txt":         "0123456789abcdefghijklmnopqrstuvwxyz",
+	} {
+		resp, body := cl.Do(t, http.MethodGet, path)
+		if resp.StatusCode != http.StatusOK || string(body) != expected {
+			t.Errorf("%s: unexpected %d %q", path, resp.StatusCode, body)
+		}
+		if resp.Header.Get("Cache-Control") == "" {
+			t.Errorf("%s: expected caching headers", path)
+		}
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/static/css/app.css"); !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css") {
+		t.Errorf("expected css by extension, got %s", resp.Header.Get("Content-Type"))
+	}
+	for _, path := range []string{"/static/.env", "/static/.git/config", "/static/docs/missing", "/static/css/"} {
+		if resp, _ := cl.Do(t, http.MethodGet, path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, resp.StatusCode)
+		}
+	}
+
+	resp, body := cl.Do(t, http.MethodGet, "/static/big.txt", "Range", "bytes=10-15")
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "abcdef" {
+		t.Errorf("expected large files to stream from disk with ranges, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestDev_InvalidPatterns(t *testing.T) {
+	t.Parallel()
+
+	hello := mono.BuiltPage{Data: []byte("hello"), ContentType: "text/plain"}
+	for pattern, reason := range map[string]string{
+		"":                              "empty pattern",
+		"GET ":                          "must start with '/'",
+		"about":                         "must start with '/'",
+		"about/us":                      "must start with '/'",
+		"/new\nline":                    "control characters",
+		"/" + strings.Repeat("a", 2048): "longer than MaxPatternLength",
+		"/users/{id":                    "bad wildcard",
+	} {
+		_, server := PrepareTest()
+		err := server.Page(pattern, hello).Start()
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("%.32q: expected a build error with %q, got %v", pattern, reason, err)
+		}
+	}
+
+	_, server := PrepareTest()
+	server.Page("example.com/", hello).Page("localhost:8080/about", hello).Page("POST /{id}/{$}", hello)
+	if _, err := server.Build(); err != nil {
+		t.Errorf("expected valid patterns, got %v", err)
+	}
+}
+
+func TestDev_NotFound(t *testing.T) {
+	t.Parallel()
+
+	calls := atomic.Int64{}
+	cl, server := PrepareTest()
+	server.
+		Middleware(func(handler mono.HandlerFunc) mono.HandlerFunc {
+			return func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+				calls.Add(1)
+				return handler(ctx, rw, req)
+			}
+		}).
+		Page("/about", mono.BuiltPage{Data: []byte("about"), ContentType: "text/plain"}).
+		Post("/form", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error { return nil }).
+		NotFound(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, err := fmt.Fprintf(rw, "<h1>no %s here</h1>", req.URL.Path)
+			return err
+		})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, body := cl.Do(t, http.MethodGet, "/missing")
+	if resp.StatusCode != http.StatusNotFound || string(body) != "<h1>no /missing here</h1>" {
+		t.Errorf("expected the branded 404, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" || resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("expected NotFound headers along with SaneHeaders, got %v", resp.Header)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the middleware to run for 404, got %d calls", calls.Load())
+	}
+
+	if resp, body := cl.Do(t, http.MethodGet, "/about"); resp.StatusCode != http.StatusOK || string(body) != "about" {
+		t.Errorf("expected registered routes to win, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/form"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for other methods, got %d", resp.StatusCode)
+	}
+}
+
+func TestDev_NotFoundNextjs(t *testing.T) {
+	t.Parallel()
+
+	dir := WriteFiles(t, map[string]string{
+		"layout.gohtml":     `{{children}}`,
+		"index.gohtml":      `home`,
+		"post/index.gohtml": `post`,
+	})
+
+	cl, server := PrepareTest()
+	server.
+		Page("/", mono.Nextjs(dir)).
+		NotFound(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := fmt.Fprint(rw, "lost")
+			return err
+		})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	for path, expected := range map[string]struct {
+		code int
+		body string
+	}{
+		"/":          {http.StatusOK, "home"},
+		"/post":      {http.StatusOK, "post"},
+		"/missing":   {http.StatusNotFound, "lost"},
+		"/post/nope": {http.StatusNotFound, "lost"},
+	} {
+		resp, body := cl.Do(t, http.MethodGet, path)
+		if resp.StatusCode != expected.code || strings.TrimSpace(string(body)) != expected.body {
+			t.Errorf("%s: expected %d %q, got %d %q", path, expected.code, expected.body, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestDev_Redirect(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		CleanPaths(mono.PathCleanNone).
+		Redirect("/old/", "/new/").
+		Redirect("/root/", "/").
+		Redirect("/moved", "/here?from=moved#top", http.StatusFound).
+		Handler("/strip", mono.RedirectWith("/clean", mono.RedirectOptions{StripQuery: true}))
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for path, expected := range map[string]struct {
+		code     int
+		location string
+	}{
+		"/old/a/b?x=1":       {http.StatusPermanentRedirect, "/new/a/b?x=1"},
+		"/old/":              {http.StatusPermanentRedirect, "/new/"},
+		"/root//evil.com":    {http.StatusPermanentRedirect, "/evil.com"},
+		"/moved?utm=mail":    {http.StatusFound, "/here?from=moved&utm=mail#top"},
+		"/strip?session=abc": {http.StatusPermanentRedirect, "/clean"},
+	} {
+		req, _ := http.NewRequestWithContext(t.Context(), http.MethodGet, cl.url, nil)
+		req.URL.Path, req.URL.RawQuery, _ = strings.Cut(path, "?")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != expected.code || resp.Header.Get("Location") != expected.location {
+			t.Errorf("%s: expected %d to %s, got %d to %s", path, expected.code, expected.location, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+
+	_, invalid := PrepareTest()
+	if _, err := invalid.Redirect("/a", "/b", http.StatusOK).Build(); err == nil || !strings.Contains(err.Error(), "unexpected status 200") {
+		t.Errorf("expected a build error for a non-3xx code, got %v", err)
+	}
+}
+
+func TestDev_Proxy(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprint(rw, req.URL.EscapedPath())
+	}))
+	defer backend.Close()
+
+	cl, server := PrepareTest()
+	server.Proxy("/tenants/{tenant}/", backend.URL+"/v1")
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	for path, expected := range map[string]string{
+		"/tenants/acme/items/7":     "/v1/items/7",
+		"/tenants/acme/files/a%2Fb": "/v1/files/a%2Fb", // Not /v1/files/a/b, a different file.
+	} {
+		if body := string(cl.Get(t, path)); body != expected {
+			t.Errorf(`%s: expected the proxied "%s", got %q`, path, expected, body)
+		}
+	}
+}
+
+func TestDev_ProxyMethods(t *testing.T) {
+	t.Parallel()
+
+	hits := atomic.Int64{}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		_, _ = fmt.Fprintf(rw, "%s %s", req.Method, req.URL.Path)
+	}))
+	defer backend.Close()
+
+	cl, server := PrepareTest()
+	server.Proxy("/api/", backend.URL, mono.ProxyMethods("GET"))
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	if resp, body := cl.Do(t, http.MethodGet, "/api/users"); resp.StatusCode != http.StatusOK || string(body) != "GET /users" {
+		t.Errorf("expected GET to be proxied, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := cl.Do(t, http.MethodHead, "/api/users"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected HEAD to be allowed along with GET, got %d", resp.StatusCode)
+	}
+	resp, _ := cl.Do(t, http.MethodPost, "/api/users")
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("expected 405 with Allow for POST, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected only GET and HEAD to reach the backend, got %d hits", hits.Load())
+	}
+}
+
+func TestDev_ProxyTransport(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintf(rw, "%s %s", req.Method, req.URL.Path)
+	}))
+	defer backend.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate()) // Self-signed, as a private CA's backend would be.
+
+	cl, server := PrepareTest()
+	server.
+		Proxy("/internal/", backend.URL, mono.ProxyTransport(&http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+			MaxIdleConns:    4,
+		})).
+		Proxy("/untrusted/", backend.URL)
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	if resp, body := cl.Do(t, http.MethodGet, "/internal/users"); resp.StatusCode != http.StatusOK || string(body) != "GET /users" {
+		t.Errorf("expected the trusting transport to reach the backend, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/untrusted/users"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected the default transport to refuse the self-signed backend, got %d", resp.StatusCode)
+	}
+}
+
+func TestDev_PageHeaders(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		Page("/draft", mono.BuiltPage{
+			Data:        []byte("<h1>draft</h1>"),
+			ContentType: "text/html; charset=utf-8",
+			Headers:     map[string]string{"X-Robots-Tag": "noindex", "Cache-Control": "no-store", "X-Frame-Options": ""},
+		}).
+		Page("/public", mono.BuiltPage{Data: []byte("<h1>public</h1>"), ContentType: "text/html; charset=utf-8"})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, body := cl.Do(t, http.MethodGet, "/draft")
+	if string(body) != "<h1>draft</h1>" || resp.Header.Get("X-Robots-Tag") != "noindex" {
+		t.Errorf("expected the page header, got %v %q", resp.Header, body)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Values("X-Frame-Options") != nil {
+		t.Errorf("expected the page headers to override the defaults, got %v", resp.Header)
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/public"); resp.Header.Get("X-Robots-Tag") != "" {
+		t.Errorf("expected page headers to stay on their page, got %v", resp.Header)
+	}
+}
+
+func TestDev_PageETag(t *testing.T) {
+	t.Parallel()
+
+	html := strings.Repeat("<p>cache me</p>\n", 200)
+	cl, server := PrepareTest()
+	server.
+		Page("/", mono.Html(template.HTML(html))).
+		Page("/dynamic", mono.BuiltPage{Data: []byte("{${ mono_time }$}"), ContentType: "text/plain"})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, body := cl.Do(t, http.MethodGet, "/", "Accept-Encoding", "identity")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || string(body) != html || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("expected the page with an ETag, got %d %q", resp.StatusCode, etag)
+	}
+	resp, body = cl.Do(t, http.MethodGet, "/", "Accept-Encoding", "identity", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("expected 304 for a matching If-None-Match, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/", "Accept-Encoding", "identity", "If-None-Match", `"other", W/`+etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for a weak match in a list, got %d", resp.StatusCode)
+	}
+
+	resp, _ = cl.Do(t, http.MethodGet, "/", "Accept-Encoding", "gzip", "If-None-Match", etag)
+	gzipETag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" || gzipETag == etag || gzipETag == "" {
+		t.Errorf("expected the gzip variant to have its own ETag, got %d %q (plain %q)", resp.StatusCode, gzipETag, etag)
+	}
+	if !slices.Contains(resp.Header.Values("Vary"), "Accept-Encoding") {
+		t.Errorf("expected Vary: Accept-Encoding, got %v", resp.Header.Values("Vary"))
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/", "Accept-Encoding", "gzip", "If-None-Match", gzipETag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for the gzip ETag, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := cl.Do(t, http.MethodGet, "/dynamic"); resp.Header.Get("ETag") != "" {
+		t.Errorf("expected no ETag for dynamic pages, got %q", resp.Header.Get("ETag"))
+	}
+}
+
+func TestDev_Brotli(t *testing.T) {
+	defer mono.ResetDefaults()
+
+	html := strings.Repeat("<p>squeeze me</p>\n", 200)
+	cl, server := PrepareTest()
+	server.Page("/", mono.Html(template.HTML(html)))
+	mono.EnableBrotli = false
+	server.Page("/gzip-only", mono.Html(template.HTML(html)))
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, body := cl.Do(t, http.MethodGet, "/", "Accept-Encoding", "gzip, br")
+	if resp.Header.Get("Content-Encoding") != "br" || !strings.HasSuffix(resp.Header.Get("ETag"), `-br"`) {
+		t.Fatalf("expected brotli to be preferred, got %q %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("ETag"))
+	}
+	if !slices.Contains(resp.Header.Values("Vary"), "Accept-Encoding") {
+		t.Errorf("expected Vary: Accept-Encoding, got %v", resp.Header.Values("Vary"))
+	}
+	if decoded, err := io.ReadAll(brotli.NewReader(bytes.NewReader(body))); err != nil || string(decoded) != html {
+		t.Errorf("expected the page in brotli, got %v", err)
+	}
+
+	for _, tc := range []struct{ path, accept string }{{"/", "gzip"}, {"/gzip-only", "gzip, br"}} {
+		if resp, _ := cl.Do(t, http.MethodGet, tc.path, "Accept-Encoding", tc.accept); resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("%s (%s): expected gzip, got %q", tc.path, tc.accept, resp.Header.Get("Content-Encoding"))
+		}
+	}
+
+	for _, stat := range server.StatsData() {
+		if stat.Path == "/" && (stat.BrotliBytes == 0 || stat.BrotliBytes >= stat.Bytes) {
+			t.Errorf("expected brotli stats for /, got %+v", stat)
+		}
+		if stat.Path == "/gzip-only" && stat.BrotliBytes != 0 {
+			t.Errorf("expected no brotli with EnableBrotli=false, got %+v", stat)
+		}
+	}
+}
+
+func TestDev_CDNCaching(t *testing.T) {
+	t.Parallel()
+
+	css := strings.Repeat(".p-4{padding:1rem}\n", 100)
+	cl, server := PrepareTest()
+	server.
+		Page("/", mono.Html("<p>home</p>")).
+		Page("/mono/cdn/file/0123abcd.css", mono.BuiltPage{Data: []byte(css), ContentType: "text/css"})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	resp, body := cl.Do(t, http.MethodGet, "/mono/cdn/file/0123abcd.css", "Accept-Encoding", "br")
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || len(body) == 0 || etag == "" || lastModified == "" {
+		t.Fatalf("expected the asset with validators, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if cache := resp.Header.Get("Cache-Control"); cache != "public, max-age=31536000, immutable" {
+		t.Errorf("expected cdn assets to be immutable, got %q", cache)
+	}
+	for _, conditional := range [][]string{{"If-None-Match", etag}, {"If-Modified-Since", lastModified}} {
+		resp, body := cl.Do(t, http.MethodGet, "/mono/cdn/file/0123abcd.css", "Accept-Encoding", "br", conditional[0], conditional[1])
+		if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+			t.Errorf("%s: expected 304, got %d %d bytes", conditional[0], resp.StatusCode, len(body))
+		}
+	}
+	if resp, _ := cl.Do(t, http.MethodGet, "/mono/cdn/file/0123abcd.css", "If-None-Match", `"stale"`, "If-Modified-Since", lastModified); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected If-None-Match to take precedence over If-Modified-Since, got %d", resp.StatusCode)
+	}
+
+	resp, _ = cl.Do(t, http.MethodGet, "/", "If-Modified-Since", lastModified)
+	if resp.StatusCode != http.StatusOK || strings.Contains(resp.Header.Get("Cache-Control"), "immutable") || resp.Header.Get("Last-Modified") != "" {
+		t.Errorf("expected regular pages to keep their caching, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestDev_DynamicGzip(t *testing.T) {
+	t.Parallel()
+
+	template := `<p>{${ mono_tee "rendered" }$}</p>` + strings.Repeat("<p>padding</p>", 100)
+	cl, server := PrepareTest()
+	server.
+		Page("/large", mono.BuiltPage{Data: []byte(template), ContentType: "text/html; charset=utf-8"}).
+		Page("/small", mono.BuiltPage{Data: []byte(`<p>{${ mono_tee "small" }$}</p>`), ContentType: "text/html; charset=utf-8"})
+	StartForT(t, server, time.Millisecond*10, time.Second)
+
+	_, identity := cl.Do(t, http.MethodGet, "/large", "Accept-Encoding", "identity")
+	if !strings.HasPrefix(string(identity), "<p>rendered</p>") {
+		t.Fatalf("unexpected render: %.32q", identity)
+	}
+	resp, body := cl.Do(t, http.MethodGet, "/large", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || !slices.Contains(resp.Header.Values("Vary"), "Accept-Encoding") {
+		t.Fatalf("expected the rendered page gzipped, got %v", resp.Header)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := io.ReadAll(reader); err != nil || !bytes.Equal(decoded, identity) {
+		t.Errorf("expected the rendered page (not the template) in gzip, got %.32q (%v)", decoded, err)
+	}
+
+	if resp, _ := cl.Do(t, http.MethodGet, "/large", "Accept-Encoding", "br"); resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("expected rendered pages in gzip only, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	resp, body = cl.Do(t, http.MethodGet, "/small", "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != "<p>small</p>" {
+		t.Errorf("expected small pages uncompressed, got %q %q", resp.Header.Get("Content-Encoding"), body)
+	}
+}
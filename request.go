@@ -0,0 +1,212 @@
+package mono
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+	ThemeSystem = "system"
+)
+
+var (
+	CookieTheme  = "mono_theme"
+	CookieLocale = "mono_locale"
+)
+
+// ThemeFromRequest reads the theme cookie set by DefaultTailwindThemeButton, ThemeSystem if it's missing or unknown.
+func ThemeFromRequest(req *http.Request) string {
+	cookie, err := req.Cookie(CookieTheme)
+	if err != nil {
+		return ThemeSystem
+	}
+	switch theme := strings.ToLower(cookie.Value); theme {
+	case ThemeLight, ThemeDark:
+		return theme
+	default:
+		return ThemeSystem
+	}
+}
+
+// LocaleFromRequest picks one of supported locales: the locale cookie first, then Accept-Language
+// (by q-value, matching "en-US" to "en" as well), otherwise the first supported locale.
+func LocaleFromRequest(req *http.Request, supported []string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	if cookie, err := req.Cookie(CookieLocale); err == nil {
+		if locale, ok := localeMatch(cookie.Value, supported); ok {
+			return locale
+		}
+	}
+	for _, accepted := range acceptValues(req.Header.Get("Accept-Language")) {
+		if locale, ok := localeMatch(accepted, supported); ok {
+			return locale
+		}
+	}
+	return supported[0]
+}
+
+func localeMatch(locale string, supported []string) (string, bool) {
+	locale = strings.TrimSpace(locale)
+	if locale == "" || locale == "*" {
+		return "", false
+	}
+	for _, candidate := range supported {
+		if strings.EqualFold(candidate, locale) {
+			return candidate, true
+		}
+	}
+	base, _, _ := strings.Cut(locale, "-")
+	for _, candidate := range supported {
+		candidateBase, _, _ := strings.Cut(candidate, "-")
+		if strings.EqualFold(candidateBase, base) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// maxAcceptHeader bounds the negotiation headers (Accept, Accept-Encoding, Accept-Language) worth parsing, longer
+// ones are ignored as if missing, so a huge header can't make every request sort thousands of values.
+const maxAcceptHeader = 4 << 10
+
+// acceptValues returns the values of an Accept-like header (Accept, Accept-Language) ordered by q-value,
+// values with q=0 are dropped.
+func acceptValues(header string) []string {
+	if len(header) > maxAcceptHeader {
+		return nil
+	}
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	tags := []weighted{}
+	for part := range strings.SplitSeq(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		q, ok := 1.0, true
+		for param := range strings.SplitSeq(params, ";") {
+			if value, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				parsed, err := strconv.ParseFloat(value, 64)
+				q, ok = parsed, err == nil
+			}
+		}
+		if !ok {
+			continue
+		}
+		if tag == "" || q <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag: tag, q: q})
+	}
+	slices.SortStableFunc(tags, func(a, b weighted) int { return -cmp.Compare(a.q, b.q) })
+
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		result = append(result, tag.tag)
+	}
+	return result
+}
+
+// PathValue returns the {name} wildcard of the matched route, e.g. "42" for /posts/{id} at /posts/42.
+// Handlers get the request matched by Start's ServeMux as is, so it's req.PathValue, kept for discoverability.
+func PathValue(req *http.Request, name string) string {
+	return req.PathValue(name)
+}
+
+// RoutePattern returns the registered pattern which matched req, e.g. "/posts/{id}".
+func RoutePattern(req *http.Request) string {
+	return req.Pattern
+}
+
+// RequestScheme is the scheme the client used: "https" for TLS connections, or whatever X-Forwarded-Proto says
+// when the request comes from one of TrustedProxies (e.g. a TLS-terminating load balancer), "http" otherwise.
+func RequestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	if IsTrustedProxy(req) {
+		proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+		switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	return "http"
+}
+
+// RequestHost is the host the client used, X-Forwarded-Host is only trusted from TrustedProxies.
+func RequestHost(req *http.Request) string {
+	if IsTrustedProxy(req) {
+		host, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Host"), ",")
+		if host = strings.TrimSpace(host); host != "" {
+			return host
+		}
+	}
+	return req.Host
+}
+
+// AbsoluteURL builds an absolute url to path as seen by the client, use it for sitemaps, RSS, OG tags and redirects.
+func AbsoluteURL(req *http.Request, path string) string {
+	result := url.URL{
+		Scheme: RequestScheme(req),
+		Host:   RequestHost(req),
+		Path:   path,
+	}
+	if pathOnly, query, ok := strings.Cut(path, "?"); ok {
+		result.Path, result.RawQuery = pathOnly, query
+	}
+	return result.String()
+}
+
+func IsTrustedProxy(req *http.Request) bool {
+	return ipInList(remoteIP(req), TrustedProxies)
+}
+
+func remoteIP(req *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// ipInList checks addr against a list of CIDRs ("10.0.0.0/8") and plain IPs ("127.0.0.1").
+func ipInList(addr netip.Addr, list []string) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, item := range list {
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			if prefix.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if ip, err := netip.ParseAddr(item); err == nil && ip.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding reports whether Accept-Encoding has encoding (with q > 0), e.g. "br" or "gzip" (x-gzip too),
+// responses are identity-encoded otherwise.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	return slices.ContainsFunc(acceptValues(req.Header.Get("Accept-Encoding")), func(accepted string) bool {
+		return strings.EqualFold(accepted, encoding) || encoding == "gzip" && strings.EqualFold(accepted, "x-gzip")
+	})
+}
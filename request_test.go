@@ -0,0 +1,131 @@
+package mono_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/kittenbark/mono"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThemeFromRequest(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		cookie   string
+		expected string
+	}{
+		{cookie: "", expected: mono.ThemeSystem},
+		{cookie: "dark", expected: mono.ThemeDark},
+		{cookie: "Light", expected: mono.ThemeLight},
+		{cookie: "sepia", expected: mono.ThemeSystem},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: mono.CookieTheme, Value: tc.cookie})
+		}
+		if actual := mono.ThemeFromRequest(req); actual != tc.expected {
+			t.Errorf(`cookie "%s": expected "%s", got "%s"`, tc.cookie, tc.expected, actual)
+		}
+	}
+}
+
+func TestLocaleFromRequest(t *testing.T) {
+	t.Parallel()
+
+	supported := []string{"en", "de", "pt-BR"}
+	for _, tc := range []struct {
+		acceptLanguage string
+		cookie         string
+		expected       string
+	}{
+		{acceptLanguage: "", expected: "en"},
+		{acceptLanguage: "de-AT,de;q=0.9,en;q=0.8", expected: "de"},
+		{acceptLanguage: "fr-FR,ja;q=0.5", expected: "en"},
+		{acceptLanguage: "fr;q=0.9,pt-br;q=0.8", expected: "pt-BR"},
+		{acceptLanguage: "en;q=0.1,de;q=0.5", expected: "de"},
+		{acceptLanguage: "de", cookie: "pt-BR", expected: "pt-BR"},
+		{acceptLanguage: "de", cookie: "klingon", expected: "de"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", tc.acceptLanguage)
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: mono.CookieLocale, Value: tc.cookie})
+		}
+		if actual := mono.LocaleFromRequest(req, supported); actual != tc.expected {
+			t.Errorf(`"%s" (cookie "%s"): expected "%s", got "%s"`, tc.acceptLanguage, tc.cookie, tc.expected, actual)
+		}
+	}
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	trusted := mono.TrustedProxies
+	mono.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	defer func() { mono.TrustedProxies = trusted }()
+
+	for _, tc := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: "10.1.2.3:4567", expected: "https://example.com/feed.xml?page=2"},
+		{remoteAddr: "192.168.1.1:4567", expected: "https://example.com/feed.xml?page=2"},
+		{remoteAddr: "203.0.113.7:4567", expected: "http://internal:3000/feed.xml?page=2"},
+	} {
+		req := httptest.NewRequest("GET", "http://internal:3000/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "example.com")
+		if actual := mono.AbsoluteURL(req, "/feed.xml?page=2"); actual != tc.expected {
+			t.Errorf(`%s: expected "%s", got "%s"`, tc.remoteAddr, tc.expected, actual)
+		}
+	}
+}
+
+func TestPathValue(t *testing.T) {
+	t.Parallel()
+
+	cl, server := PrepareTest()
+	server.
+		Middleware(mono.ServerSideTheme).
+		Handler("/a/{x}/b/{y}", func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+			_, err := fmt.Fprintf(rw, "%s %s %s", mono.PathValue(req, "x"), mono.PathValue(req, "y"), mono.RoutePattern(req))
+			return err
+		})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*500)
+
+	if body := string(cl.Get(t, "/a/1/b/two")); body != "1 two /a/{x}/b/{y}" {
+		t.Fatalf(`expected "1 two /a/{x}/b/{y}", got "%s"`, body)
+	}
+}
+
+func TestAcceptHeaderLimits(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "fr,"+strings.Repeat("de-DE;q=0.5,", 100_000))
+	start := time.Now()
+	if locale := mono.LocaleFromRequest(req, []string{"en", "fr", "de"}); locale != "en" {
+		t.Errorf("expected an oversized Accept-Language to be ignored, got %s", locale)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*50 {
+		t.Errorf("expected an oversized header to be skipped right away, took %s", elapsed)
+	}
+
+	cl, server := PrepareTest()
+	server.Page("/", mono.Html(template.HTML(strings.Repeat("<p>compress me</p>\n", 200))))
+	StartForT(t, server, time.Millisecond*10, time.Second)
+	for encoding, expected := range map[string]string{
+		"gzip":                                 "gzip",
+		"deflate, gzip;q=0.5":                  "gzip",
+		"gzip;q=0":                             "",
+		"gzip, " + strings.Repeat("x, ", 4096): "",
+	} {
+		if resp, _ := cl.Do(t, http.MethodGet, "/", "Accept-Encoding", encoding); resp.Header.Get("Content-Encoding") != expected {
+			t.Errorf("%.32q: expected %q encoding, got %q", encoding, expected, resp.Header.Get("Content-Encoding"))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package mono
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Conn is a WebSocket connection of Server.WebSocket, reading and writing whole text or binary messages.
+type Conn struct {
+	ws *websocket.Conn
+}
+
+// Request is the upgraded request, e.g. for PathValue or cookies.
+func (conn *Conn) Request() *http.Request { return conn.ws.Request() }
+
+// ReadText reads the next message as text.
+func (conn *Conn) ReadText() (string, error) {
+	var message string
+	err := websocket.Message.Receive(conn.ws, &message)
+	return message, err
+}
+
+// ReadBinary reads the next message as bytes.
+func (conn *Conn) ReadBinary() ([]byte, error) {
+	var message []byte
+	err := websocket.Message.Receive(conn.ws, &message)
+	return message, err
+}
+
+func (conn *Conn) WriteText(message string) error { return websocket.Message.Send(conn.ws, message) }
+
+func (conn *Conn) WriteBinary(message []byte) error { return websocket.Message.Send(conn.ws, message) }
+
+func (conn *Conn) Close() error { return conn.ws.Close() }
+
+// WebSocket upgrades requests to WebSocket connections served by fn, the connection is closed once fn returns.
+// Like SSE, it isn't limited by the handler timeout: ctx is done once the server stops (closing conn, so pending
+// reads fail). Cross-origin upgrades are refused, so other sites can't ride the user's cookies.
+// As the connection is hijacked, errors of fn are logged instead of being responded with.
+func (server *serverDev) WebSocket(pattern string, fn func(ctx context.Context, conn *Conn) error) Server {
+	return server.handler(pattern, func(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			rw.Header().Set("Upgrade", "websocket")
+			return NewStatusError(http.StatusUpgradeRequired, "")
+		}
+		if !websocketSameOrigin(req) {
+			return NewStatusError(http.StatusForbidden, "cross-origin websocket")
+		}
+
+		ws := websocket.Server{Handler: func(ws *websocket.Conn) {
+			defer context.AfterFunc(ctx, func() { _ = ws.Close() })()
+			err := fn(ctx, &Conn{ws: ws})
+			if err != nil && !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				Log.Error("websocket error", "pattern", pattern, "err", err.Error())
+			}
+		}}
+		ws.ServeHTTP(websocketHijacker{rw}, req)
+		return nil
+	}, true)
+}
+
+// websocketSameOrigin allows requests without Origin (non browser clients) and the ones from the same host.
+func websocketSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, req.Host)
+}
+
+// websocketHijacker lets websocket.Server hijack through middleware writers (see http.ResponseController).
+type websocketHijacker struct {
+	http.ResponseWriter
+}
+
+func (rw websocketHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("mono.WebSocket: %w", err)
+	}
+	return conn, buf, nil
+}
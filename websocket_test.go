@@ -0,0 +1,92 @@
+package mono_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kittenbark/mono"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan error, 1)
+	cl, server := PrepareTest()
+	server.
+		Middleware(mono.Stealth()).
+		WebSocket("/echo/{name}", func(ctx context.Context, conn *mono.Conn) error {
+			_, hasDeadline := ctx.Deadline()
+			if err := conn.WriteText(fmt.Sprintf("hi %s, deadline %v", mono.PathValue(conn.Request(), "name"), hasDeadline)); err != nil {
+				return err
+			}
+			text, err := conn.ReadText()
+			if err != nil {
+				return err
+			}
+			if err := conn.WriteText(strings.ToUpper(text)); err != nil {
+				return err
+			}
+			data, err := conn.ReadBinary()
+			if err != nil {
+				return err
+			}
+			return conn.WriteBinary(append(data, '!'))
+		}).
+		WebSocket("/forever", func(ctx context.Context, conn *mono.Conn) error {
+			_, err := conn.ReadText()
+			done <- errors.Join(err, ctx.Err())
+			return err
+		})
+	StartForT(t, server, time.Millisecond*10, time.Millisecond*300)
+	wsURL := "ws" + strings.TrimPrefix(cl.url, "http")
+
+	ws, err := websocket.Dial(wsURL+"/echo/kitten", "", cl.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var greeting, upper string
+	var data []byte
+	if err := websocket.Message.Receive(ws, &greeting); err != nil || greeting != "hi kitten, deadline false" {
+		t.Errorf("unexpected greeting %q (%v)", greeting, err)
+	}
+	if err := websocket.Message.Send(ws, "meow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.Message.Receive(ws, &upper); err != nil || upper != "MEOW" {
+		t.Errorf("unexpected text echo %q (%v)", upper, err)
+	}
+	if err := websocket.Message.Send(ws, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.Message.Receive(ws, &data); err != nil || string(data) != "\x01\x02!" {
+		t.Errorf("unexpected binary echo %q (%v)", data, err)
+	}
+
+	if _, err := websocket.Dial(wsURL+"/echo/kitten", "", "http://evil.example.com"); err == nil {
+		t.Error("expected cross-origin upgrades to be refused")
+	}
+	resp, _ := cl.Do(t, http.MethodGet, "/echo/kitten")
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("expected 426 for plain requests, got %d", resp.StatusCode)
+	}
+
+	forever, err := websocket.Dial(wsURL+"/forever", "", cl.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forever.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the pending read to fail once the server stops, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the connection to be closed once the server stops")
+	}
+}